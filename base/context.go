@@ -18,7 +18,8 @@ type OpContext struct {
 type CreateContext struct {
 	Repl       bool // adding here instead of in OpContext so that creation of OpContext can be avoided
 	InRes      *Resource
-	*OpContext // the operation context
+	Secret     string // the secret generated for an Application, only its hash is stored
+	*OpContext        // the operation context
 }
 
 type GetContext struct {
@@ -237,7 +238,7 @@ func (pc *PatchContext) EvalPatch(res *Resource) bool {
 	}
 
 	rp := pc.Session.EffPerms[pc.Rt.Name]
-	if rp.WritePerm == nil {
+	if rp == nil || rp.WritePerm == nil {
 		return false
 	} else if rp.WritePerm.AllowAll {
 		return true
@@ -306,21 +307,34 @@ func (gc *GetContext) AllowRead(res *Resource) bool {
 	return rp.ReadPerm.EvalFilter(res)
 }
 
-func (rc *ReplaceContext) AllowOp() bool {
+// replace requires write permission on all the attributes
+func (rc *ReplaceContext) GetDecision() OpDecision {
+	od := OpDecision{}
 	rp := rc.Session.EffPerms[rc.Rt.Name]
-	if rp == nil {
-		return false
+	if rp == nil || !rp.WritePerm.AllowAll {
+		od.Deny = true
+		return od
+	}
+
+	if rp.WritePerm.OnAnyResource {
+		od.Allow = true
+	} else {
+		od.EvalFilter = true
 	}
+	return od
+}
 
-	if !rp.WritePerm.AllowAll {
+func (rc *ReplaceContext) AllowOp() bool {
+	od := rc.GetDecision()
+	if od.Deny {
 		return false
 	}
 
-	if rp.WritePerm.OnAnyResource {
+	if od.Allow {
 		return true
 	}
 
-	return rp.WritePerm.EvalFilter(rc.InRes)
+	return rc.Session.EffPerms[rc.Rt.Name].WritePerm.EvalFilter(rc.InRes)
 }
 
 func (sc *SearchContext) CanDenyOp() (bool, *FilterNode) {
@@ -372,17 +386,50 @@ func (sc *SearchContext) CanDenyOp() (bool, *FilterNode) {
 func (auth ModifyGroupsOfUserRequest) AllowOp(res *Resource) bool {
 	rt := res.resType
 	rp := auth.Session.EffPerms[rt.Name]
-	if rp == nil {
+	if rp != nil {
+		if rp.WritePerm.OnAnyResource && rp.WritePerm.AllowAll {
+			return true
+		}
+
+		entryOk := rp.WritePerm.EvalFilter(res)
+
+		// only allow the one who has write access to *all*
+		// attributes of User (a.k.a an admin)
+		if entryOk && rp.WritePerm.AllowAll {
+			return true
+		}
+	}
+
+	return auth.allowDelegatedOp(res)
+}
+
+// checks if the operation is allowed by any of the administrative scopes of the session
+func (auth ModifyGroupsOfUserRequest) allowDelegatedOp(res *Resource) bool {
+	// a delegated administrator can never modify their own memberships
+	if res.GetId() == auth.Session.Sub {
 		return false
 	}
 
-	if rp.WritePerm.OnAnyResource && rp.WritePerm.AllowAll {
-		return true
+	gids := make([]string, 0, len(auth.AddGids)+len(auth.RemoveGids))
+	gids = append(gids, auth.AddGids...)
+	gids = append(gids, auth.RemoveGids...)
+	if len(gids) == 0 {
+		return false
 	}
 
-	entryOk := rp.WritePerm.EvalFilter(res)
+	for _, gid := range gids {
+		allowed := false
+		for _, as := range auth.Session.AdmScopes {
+			if as.AssignableGroups[gid] && as.Covers(res) {
+				allowed = true
+				break
+			}
+		}
 
-	// only allow the one who has write access to *all*
-	// attributes of User (a.k.a an admin)
-	return entryOk && rp.WritePerm.AllowAll
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
 }
@@ -35,6 +35,7 @@ var (
 	ST_INVALIDVERS            = "invalidVers"
 	ST_SENSITIVE              = "sensitive"
 	ST_PEER_CONNECTION_FAILED = "failed to connect to peer"
+	ST_QUOTA_EXCEEDED         = "quotaExceeded"
 )
 
 type ScimError struct {
@@ -127,6 +128,15 @@ func NewToomanyResults(detail string) *ScimError {
 	return err
 }
 
+func NewQuotaExceededError(detail string) *ScimError {
+	err := NewError()
+	err.Detail = detail
+	err.code = 403
+	err.ScimType = ST_QUOTA_EXCEEDED
+	err.Status = Forbidden
+	return err
+}
+
 func NewPeerConnectionFailed(detail string) *ScimError {
 	err := NewError()
 	err.Detail = detail
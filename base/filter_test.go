@@ -203,3 +203,56 @@ func bnfgen() string {
 
 	return string(out.Bytes())
 }
+
+func TestResolveSelfVars(t *testing.T) {
+	self := createTestUser()
+	self.SetId("self")
+	other := createTestUser()
+	other.SetId("other")
+
+	node, err := ParseFilter(`userName eq $self.userName and emails.value eq "$self.emails.value"`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !HasSelfVars(node) {
+		t.Errorf("filter must contain $self variables")
+	}
+
+	resolved := ResolveSelfVars(node, self)
+	if HasSelfVars(resolved) {
+		t.Errorf("all $self variables must be resolved %s", resolved)
+	}
+
+	if node.Children[0].Value != "$self.userName" {
+		t.Errorf("original filter must not be modified")
+	}
+
+	p := &Permission{Filter: resolved}
+	if !p.EvalFilter(self) {
+		t.Errorf("resolved filter %s must match the user to whom it belongs", resolved)
+	}
+
+	p = &Permission{Filter: ResolveSelfVars(node, self)}
+	if p.EvalFilter(other) {
+		t.Errorf("resolved filter %s must not match other users", resolved)
+	}
+
+	// an absent attribute never matches
+	node, _ = ParseFilter(`userName eq $self.nickName`)
+	p = &Permission{Filter: ResolveSelfVars(node, self)}
+	if p.EvalFilter(self) {
+		t.Errorf("filter referring an absent attribute must not match")
+	}
+
+	// the milliseconds of the datetime values are retained
+	if err = self.AddCA("groups", map[string]interface{}{"value": "g1", "validUntil": "2019-01-01T00:00:00.123Z"}); err != nil {
+		t.Fatal(err)
+	}
+	node, _ = ParseFilter(`groups.validUntil eq $self.groups.validUntil`)
+	resolved = ResolveSelfVars(node, self)
+	if resolved.Value != "2019-01-01T00:00:00.123Z" {
+		t.Errorf("the milliseconds of the datetime value must be retained in %s", resolved.Value)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"sparrow/schema"
+	"strings"
 	"time"
 )
 
@@ -33,9 +34,58 @@ type RbacUser struct {
 }
 
 type Role struct {
-	Id    string
-	Name  string
-	Perms map[string]*ResourcePermission
+	Id      string
+	Name    string
+	Perms   map[string]*ResourcePermission
+	Juniors []string    // IDs of the inherited roles
+	Scope   *AdminScope // the administrative scope, nil if the role is not a delegated administrator
+}
+
+// the scope of a delegated administrator, the members of the role can only
+// modify the group memberships of the users matching the filter and can only
+// assign the listed groups
+type AdminScope struct {
+	RoleId           string
+	Filter           *FilterNode
+	AssignableGroups map[string]bool
+	evaluator        Evaluator
+}
+
+// a node in the resolved role hierarchy
+type RoleNode struct {
+	Id       string      `json:"id"`
+	Name     string      `json:"name"`
+	Inherits []*RoleNode `json:"inherits,omitempty"`
+}
+
+// describes the role from which a permission was obtained
+type PermissionOrigin struct {
+	ResType          string `json:"resourceType"`
+	Op               string `json:"op"`
+	RoleId           string `json:"roleId"`
+	RoleName         string `json:"roleName"`
+	AssignedRoleId   string `json:"assignedRoleId"` // the role assigned to the user through which this permission was obtained
+	AssignedRoleName string `json:"assignedRoleName"`
+	Inherited        bool   `json:"inherited"`
+	AllowAll         bool   `json:"allowAll"`
+	OnAnyResource    bool   `json:"onAnyRes"`
+	Filter           string `json:"filter,omitempty"`
+}
+
+// the result of evaluating an operation of a subject on a resourcetype or resource
+type PermissionCheck struct {
+	Subject       string              `json:"subject"`
+	Op            string              `json:"op"`
+	ResType       string              `json:"resourceType"`
+	ResId         string              `json:"resourceId,omitempty"`
+	Allow         bool                `json:"allow"`
+	Decision      string              `json:"decision"` // one of allow, deny, evalFilter or evalWithoutFetch
+	FilterEvald   bool                `json:"filterEvaluated"`
+	Filter        string              `json:"filter,omitempty"` // the effective filter of all the contributing roles
+	OnAnyResource bool                `json:"onAnyRes"`
+	AllowAll      bool                `json:"allowAll"`
+	AllowAttrs    []string            `json:"allowAttrs,omitempty"`
+	Roles         []*PermissionOrigin `json:"roles"` // the roles contributing to the permission
 }
 
 type ResourcePermission struct {
@@ -70,7 +120,11 @@ type RbacSession struct {
 	Ito       string                         `json:"ito"` // The ID of the oAuth client to who this JWT was sent to
 	Apps      map[string]SamlAppSession      `json:"-"`   // a map of application SAML issuer IDs and their SessionIndexes
 	Username  string                         `json:"-"`
-	LastAccAt int64                          `json:"-"` // time when this session was last accessed
+	Scope     string                         `json:"scope,omitempty"` // the space separated list of scopes granted to the client
+	AdmScopes []*AdminScope                  `json:"-"`               // scopes of the activated administrative roles
+	LastAccAt int64                          `json:"-"`               // time when this session was last accessed
+	AuthTime  int64                          `json:"-"`               // time when the user was authenticated, zero if unknown
+	Amr       []string                       `json:"-"`               // the methods used for authenticating the user
 	//Aud      string         `json:"aud"`
 	//Nbf	int64 `json:"nbf"`
 }
@@ -80,9 +134,10 @@ func (session *RbacSession) Valid() error {
 	return nil
 }
 
-func (session *RbacSession) ToJwt(key crypto.PrivateKey) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, session)
+func (session *RbacSession) ToJwt(alg string, kid string, key crypto.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), session)
 	token.Header["d"] = session.Domain
+	token.Header["kid"] = kid
 	str, err := token.SignedString(key)
 	if err != nil {
 		panic(fmt.Errorf("could not create the JWT from session %#v", err))
@@ -94,6 +149,31 @@ func (session *RbacSession) ToJwt(key crypto.PrivateKey) string {
 	return str
 }
 
+// Restricts the effective permissions of the session to the given operations. The keys of the map are
+// the lowercased names of the resourcetypes and the values are the allowed operations, read and write.
+// The permissions on the resourcetypes that are not present in the map are removed.
+func (session *RbacSession) RestrictPerms(allowed map[string]map[string]bool) {
+	for rtName, rp := range session.EffPerms {
+		ops := allowed[strings.ToLower(rtName)]
+		if ops == nil {
+			delete(session.EffPerms, rtName)
+			continue
+		}
+
+		// the permissions may be shared with the roles, they must not be modified
+		n := &ResourcePermission{RType: rp.RType, ReadPerm: rp.ReadPerm, WritePerm: rp.WritePerm}
+		if !ops["read"] {
+			n.ReadPerm = &Permission{Name: "read"}
+		}
+
+		if !ops["write"] {
+			n.WritePerm = &Permission{Name: "write"}
+		}
+
+		session.EffPerms[rtName] = n
+	}
+}
+
 func (session *RbacSession) IsExpired() bool {
 	now := time.Now().Unix()
 
@@ -130,12 +210,55 @@ func (p *Permission) EvalFilter(rs *Resource) bool {
 	}
 
 	if p.evaluator == nil {
+		setAtTypes(p.Filter, rs)
 		p.evaluator = BuildEvaluator(p.Filter)
 	}
 
 	return p.evaluator.Evaluate(rs)
 }
 
+// Returns true if the membership represented by the given sub-attributes of a Group's
+// members or a User's groups attribute is effective at the given time
+func IsMembershipActive(subAtMap map[string]*SimpleAttribute, now time.Time) bool {
+	from := subAtMap["validfrom"]
+	if from != nil && from.Values[0].(int64) > toMillis(now) {
+		return false
+	}
+
+	return !IsMembershipExpired(subAtMap, now)
+}
+
+// Returns true if the membership represented by the given sub-attributes has expired at the given time
+func IsMembershipExpired(subAtMap map[string]*SimpleAttribute, now time.Time) bool {
+	until := subAtMap["validuntil"]
+	return until != nil && until.Values[0].(int64) <= toMillis(now)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (as *AdminScope) Clone() *AdminScope {
+	n := &AdminScope{RoleId: as.RoleId}
+	n.Filter = as.Filter.Clone()
+	n.AssignableGroups = make(map[string]bool)
+	for gid, _ := range as.AssignableGroups {
+		n.AssignableGroups[gid] = true
+	}
+
+	return n
+}
+
+// Returns true if the given resource is in the scope of the administrator
+func (as *AdminScope) Covers(rs *Resource) bool {
+	if as.evaluator == nil {
+		setAtTypes(as.Filter, rs)
+		as.evaluator = BuildEvaluator(as.Filter)
+	}
+
+	return as.evaluator.Evaluate(rs)
+}
+
 func CloneAtParamMap(m map[string]*AttributeParam) map[string]*AttributeParam {
 	if m == nil {
 		return nil
@@ -0,0 +1,181 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package base
+
+import (
+	"fmt"
+	"sparrow/utils"
+	"strings"
+)
+
+// the prefix of the variables in permission filters that refer to the attributes
+// of the user to whom the session belongs, e.g manager.value eq $self.id
+const SELF_VAR_PREFIX = "$self."
+
+// Returns true if any of the nodes of the given filter contain a $self variable
+func HasSelfVars(node *FilterNode) bool {
+	if node == nil {
+		return false
+	}
+
+	if strings.HasPrefix(strings.ToLower(node.Value), SELF_VAR_PREFIX) {
+		return true
+	}
+
+	for _, ch := range node.Children {
+		if HasSelfVars(ch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a copy of the given filter after replacing all the $self variables with the values
+// of the corresponding attributes of the given user. A node referring to a multi-valued attribute
+// gets replaced by an OR node with one child per value, and a node referring to an absent
+// attribute gets replaced by a node that never matches.
+func ResolveSelfVars(node *FilterNode, self *Resource) *FilterNode {
+	if node == nil {
+		return nil
+	}
+
+	if isLogical(node.Op) || node.Op == "NOT" {
+		clone := &FilterNode{Op: node.Op, Count: -1}
+		clone.Children = make([]*FilterNode, len(node.Children))
+		for i, ch := range node.Children {
+			clone.Children[i] = ResolveSelfVars(ch, self)
+		}
+
+		return clone
+	}
+
+	if !strings.HasPrefix(strings.ToLower(node.Value), SELF_VAR_PREFIX) {
+		return node.Clone()
+	}
+
+	values := selfValues(self, node.Value[len(SELF_VAR_PREFIX):])
+	if len(values) == 0 {
+		never := &FilterNode{Op: "NOT", Count: -1}
+		never.Children = []*FilterNode{&FilterNode{Name: "id", Op: "PR", Count: -1}}
+		return never
+	}
+
+	var resolved *FilterNode
+	for _, v := range values {
+		tmp := &FilterNode{Name: node.Name, Op: node.Op, Value: v, Count: -1}
+		if resolved == nil {
+			resolved = tmp
+		} else {
+			// logical nodes always have two children
+			resolved = &FilterNode{Op: "OR", Count: -1, Children: []*FilterNode{resolved, tmp}}
+		}
+	}
+
+	return resolved
+}
+
+// Returns a copy of the permission with the $self variables resolved using the given user,
+// the same instance is returned if the filter has no variables
+func (p *Permission) ResolveSelfVars(self *Resource) *Permission {
+	if p == nil || !HasSelfVars(p.Filter) {
+		return p
+	}
+
+	n := p.Clone()
+	n.Filter = ResolveSelfVars(p.Filter, self)
+	n.evaluator = nil
+
+	return n
+}
+
+// Returns a copy of the resource permission with the $self variables of both read and write
+// permissions resolved using the given user, the same instance is returned if there are no variables
+func (rp *ResourcePermission) ResolveSelfVars(self *Resource) *ResourcePermission {
+	if !HasSelfVars(rp.ReadPerm.filterOrNil()) && !HasSelfVars(rp.WritePerm.filterOrNil()) {
+		return rp
+	}
+
+	n := &ResourcePermission{RType: rp.RType}
+	n.ReadPerm = rp.ReadPerm.ResolveSelfVars(self)
+	n.WritePerm = rp.WritePerm.ResolveSelfVars(self)
+
+	return n
+}
+
+func (p *Permission) filterOrNil() *FilterNode {
+	if p == nil {
+		return nil
+	}
+
+	return p.Filter
+}
+
+// Resolves the $self variables present in the filter of the scope using the given user
+func (as *AdminScope) ResolveSelfVars(self *Resource) {
+	if HasSelfVars(as.Filter) {
+		as.Filter = ResolveSelfVars(as.Filter, self)
+		as.evaluator = nil
+	}
+}
+
+// Returns the values of the attribute with the given name, in the form they appear in a filter,
+// no values are returned if the user is nil
+func selfValues(self *Resource, name string) []string {
+	values := make([]string, 0)
+	if self == nil { // sessions of OAuth clients have no user
+		return values
+	}
+
+	if strings.ToLower(name) == "id" {
+		return append(values, self.GetId())
+	}
+
+	var simpleAts []*SimpleAttribute
+	pos := strings.LastIndex(name, ATTR_DELIM)
+	if pos > 0 {
+		parent := self.GetAttr(name[:pos])
+		if parent == nil || parent.IsSimple() {
+			return values
+		}
+
+		child := strings.ToLower(name[pos+1:])
+		for _, subAtMap := range parent.GetComplexAt().SubAts {
+			if sa, ok := subAtMap[child]; ok {
+				simpleAts = append(simpleAts, sa)
+			}
+		}
+	} else {
+		at := self.GetAttr(name)
+		if at == nil || !at.IsSimple() {
+			return values
+		}
+		simpleAts = append(simpleAts, at.GetSimpleAt())
+	}
+
+	for _, sa := range simpleAts {
+		for _, v := range sa.Values {
+			if sa.atType != nil && sa.atType.Type == "datetime" {
+				millis, _ := v.(int64)
+				v = utils.FormatMillis(millis)
+			}
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+
+	return values
+}
+
+// sets the attribute types of all the leaf nodes of the filter using the given resource type
+func setAtTypes(node *FilterNode, rs *Resource) {
+	switch node.Op {
+	case "NOT", "AND", "OR":
+		for _, ch := range node.Children {
+			setAtTypes(ch, rs)
+		}
+
+	default:
+		node.SetAtType(rs.GetType().GetAtType(node.Name))
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"sparrow/base"
 	"sparrow/utils"
+	"strings"
 	"time"
 )
 
@@ -31,11 +32,14 @@ type ServerConf struct {
 	TmplDir           string              `json:"-"` // template directory
 	ReplDir           string              `json:"-"` // replication data directory
 	DomainsDir        string              `json:"-"` // domains' data directory
+	StashDir          string              `json:"-"` // the directory holding the data of deleted domains
 	CertChain         []*x509.Certificate `json:"-"`
 	PrivKey           crypto.PrivateKey   `json:"-"`
 	PubKey            crypto.PublicKey    `json:"-"`
 	ReplTransport     *http.Transport     `json:"-"`
 	ReplWebHookToken  string              `json:"-"`
+	DomainStashTtl    int                 `json:"domainStashTtl"` // the number of seconds the data of a deleted domain is kept in the stash directory
+	HostDomains       map[string]string   `json:"hostDomains"`    // a map of hostnames to domain names, hostnames can contain a wildcard in the first label e.g *.id.example.com
 }
 
 type AuthenticationScheme struct {
@@ -91,6 +95,10 @@ type DomainConfig struct {
 	Resources   []*ResourceConf    `json:"resources"`
 	Rfc2307bis  *Rfc2307bis        `json:"rfc2307bis"`
 	Replication *ReplicationConfig `json:"replication"`
+	Limits      *LimitsConfig      `json:"limits"`
+	Rbac        *RbacConfig        `json:"rbac"`
+	Signing     *SigningConfig     `json:"signing"`
+	Disabled    bool               `json:"disabled"` // a disabled domain rejects all logins and API calls
 }
 
 type Rfc2307bis struct {
@@ -113,13 +121,64 @@ type ReplicationConfig struct {
 	PurgeInterval int `json:"purgeInterval"` // the interval(in seconds) at which the purging should repeat
 }
 
+// the quotas of a domain, a value of zero means unlimited
+type LimitsConfig struct {
+	MaxResourcesPerType int `json:"maxResourcesPerType"` // the max number of resources of each resourcetype
+	MaxApplications     int `json:"maxApplications"`     // the max number of Applications, takes precedence over maxResourcesPerType
+	MaxSessions         int `json:"maxSessions"`         // the max number of active OAuth sessions
+	MaxDataFileSize     int `json:"maxDataFileSize"`     // the max size of the data file in megabytes
+}
+
+// a separation of duty rule, a user cannot be a member of(or activate) Cardinality
+// or more groups of the given set
+type SodRule struct {
+	Name        string   `json:"name"`
+	GroupIds    []string `json:"groupIds"`
+	Cardinality int      `json:"cardinality"` // defaults to 2, i.e. only one of the groups is allowed
+}
+
+type RbacConfig struct {
+	StaticSod               []*SodRule `json:"staticSod"`               // enforced while assigning users to groups
+	DynamicSod              []*SodRule `json:"dynamicSod"`              // enforced while activating the roles of a session
+	MembershipPurgeInterval int        `json:"membershipPurgeInterval"` // the number of seconds to wait between successive removals of expired group memberships
+}
+
+// the keys used for signing the tokens and SAML assertions issued by a domain
+type SigningConfig struct {
+	Algorithm        string `json:"algorithm"`        // one of RS256, PS256, ES256 or EdDSA
+	RotationInterval int    `json:"rotationInterval"` // the number of seconds a key is used for signing before it gets replaced
+	PrePublishTime   int    `json:"prePublishTime"`   // the number of seconds a new key is published in JWKS before it is used for signing
+	RetentionTime    int    `json:"retentionTime"`    // the number of seconds a replaced key is kept for verifying the tokens it signed
+}
+
 type OauthConfig struct {
-	SsoSessionIdleTime     int    `json:"ssoSessionIdleTime"`     // the idle time of a SSO session in seconds
-	SsoSessionMaxLife      int    `json:"ssoSessionMaxLife"`      // the max life time of a SSO session in seconds
-	TokenPurgeInterval     int    `json:"tokenPurgeInterval"`     // the number of seconds to wait between successive purges of expired tokens
-	GrantCodePurgeInterval int    `json:"grantCodePurgeInterval"` // the number of seconds to wait before purging the OAuth grant codes
-	GrantCodeMaxLife       int    `json:"grantCodeMaxLife"`       // the number of seconds an OAuth grant code is valid for
-	Notes                  string `json:"notes"`
+	SsoSessionIdleTime     int            `json:"ssoSessionIdleTime"`     // the idle time of a SSO session in seconds
+	SsoSessionMaxLife      int            `json:"ssoSessionMaxLife"`      // the max life time of a SSO session in seconds
+	TokenPurgeInterval     int            `json:"tokenPurgeInterval"`     // the number of seconds to wait between successive purges of expired tokens
+	GrantCodePurgeInterval int            `json:"grantCodePurgeInterval"` // the number of seconds to wait before purging the OAuth grant codes
+	GrantCodeMaxLife       int            `json:"grantCodeMaxLife"`       // the number of seconds an OAuth grant code is valid for
+	DeviceCodeMaxLife      int            `json:"deviceCodeMaxLife"`      // the number of seconds a device code is valid for
+	DevicePollInterval     int            `json:"devicePollInterval"`     // the minimum number of seconds a device must wait between polling requests
+	ClientSecretMaxLife    int            `json:"clientSecretMaxLife"`    // the number of seconds a client secret is valid for, the secrets never expire if set to zero
+	ClientSecretOverlap    int            `json:"clientSecretOverlap"`    // the number of seconds the previous secret of a client remains valid after rotation
+	ClientSecretWarnTime   int            `json:"clientSecretWarnTime"`   // the number of seconds before the expiry of a client secret from which its use is warned in the audit log
+	Scopes                 []*ScopeConfig `json:"scopes"`                 // the scopes that can be requested by the clients
+	Notes                  string         `json:"notes"`
+}
+
+// an OAuth scope of a domain, a token granted the scope can access the listed claims. If Permissions
+// are present the SCIM operations allowed with the token are restricted to the listed permissions.
+type ScopeConfig struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"` // shown on the consent page
+	Claims      []string           `json:"claims"`
+	Permissions []*ScopePermission `json:"permissions,omitempty"`
+}
+
+// the operations allowed on a resourcetype
+type ScopePermission struct {
+	ResType string   `json:"resourceType"`
+	Ops     []string `json:"ops"` // read and/or write
 }
 
 type Meta struct {
@@ -193,6 +252,12 @@ func DefaultDomainConfig() *DomainConfig {
 	oauthCf.TokenPurgeInterval = 1 * 3600   // 1 hour
 	oauthCf.GrantCodePurgeInterval = 5 * 60 // 5 minutes
 	oauthCf.GrantCodeMaxLife = 2 * 60       // 2 minutes
+	oauthCf.DeviceCodeMaxLife = 10 * 60     // 10 minutes
+	oauthCf.DevicePollInterval = 5
+	oauthCf.ClientSecretMaxLife = 365 * 24 * 3600 // 1 year
+	oauthCf.ClientSecretOverlap = 7 * 24 * 3600   // 7 days
+	oauthCf.ClientSecretWarnTime = 30 * 24 * 3600 // 30 days
+	oauthCf.Scopes = defaultScopes()
 
 	ppolicy := &PpolicyConfig{}
 	ppolicy.PasswdHashAlgo = "sha256"
@@ -210,10 +275,68 @@ func DefaultDomainConfig() *DomainConfig {
 	cf.Oauth = oauthCf
 	cf.Ppolicy = ppolicy
 	cf.Replication = replication
+	cf.Limits = &LimitsConfig{}
+	cf.Rbac = &RbacConfig{MembershipPurgeInterval: 60}
+	cf.Signing = defaultSigningConfig()
 
 	return cf
 }
 
+func defaultSigningConfig() *SigningConfig {
+	sc := &SigningConfig{Algorithm: "RS256"}
+	sc.RotationInterval = 90 * 24 * 3600 // 90 days
+	sc.PrePublishTime = 2 * 24 * 3600    // 2 days
+	sc.RetentionTime = 2 * 24 * 3600     // 2 days
+
+	return sc
+}
+
+// the standard scopes of section 5.4 of OpenID Connect Core 1.0, groups is not a standard scope
+func defaultScopes() []*ScopeConfig {
+	return []*ScopeConfig{
+		{Name: "openid", Description: "Verify your identity"},
+		{Name: "profile", Description: "View your basic profile", Claims: []string{"name", "family_name", "given_name", "middle_name", "nickname",
+			"preferred_username", "profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale", "updated_at"}},
+		{Name: "email", Description: "View your email address", Claims: []string{"email", "email_verified"}},
+		{Name: "phone", Description: "View your phone number", Claims: []string{"phone_number", "phone_number_verified"}},
+		{Name: "address", Description: "View your address", Claims: []string{"address"}},
+		{Name: "groups", Description: "View your groups", Claims: []string{"groups"}},
+	}
+}
+
+// Validates the scopes and adds the standard scopes that are not defined
+func checkScopes(oauthCf *OauthConfig) error {
+	names := make(map[string]bool)
+	for _, sc := range oauthCf.Scopes {
+		if len(sc.Name) == 0 || strings.ContainsAny(sc.Name, " \t\"\\") {
+			return fmt.Errorf("invalid scope name '%s'", sc.Name)
+		}
+
+		if names[sc.Name] {
+			return fmt.Errorf("scope %s is defined more than once", sc.Name)
+		}
+		names[sc.Name] = true
+
+		for _, sp := range sc.Permissions {
+			for i, op := range sp.Ops {
+				op = strings.ToLower(op)
+				if op != "read" && op != "write" {
+					return fmt.Errorf("invalid operation %s in the permissions of the scope %s", op, sc.Name)
+				}
+				sp.Ops[i] = op
+			}
+		}
+	}
+
+	for _, sc := range defaultScopes() {
+		if !names[sc.Name] {
+			oauthCf.Scopes = append(oauthCf.Scopes, sc)
+		}
+	}
+
+	return nil
+}
+
 func ParseDomainConfig(file string) (*DomainConfig, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -227,6 +350,77 @@ func ParseDomainConfig(file string) (*DomainConfig, error) {
 		return nil, err
 	}
 
+	// limits were not present in the older versions of the config
+	if cf.Limits == nil {
+		cf.Limits = &LimitsConfig{}
+	}
+
+	if cf.Rbac == nil {
+		cf.Rbac = &RbacConfig{}
+	}
+
+	if cf.Rbac.MembershipPurgeInterval <= 0 {
+		cf.Rbac.MembershipPurgeInterval = 60
+	}
+
+	for _, r := range append(cf.Rbac.StaticSod, cf.Rbac.DynamicSod...) {
+		if r.Cardinality < 2 {
+			r.Cardinality = 2
+		}
+	}
+
+	if cf.Signing == nil {
+		cf.Signing = defaultSigningConfig()
+	}
+
+	switch cf.Signing.Algorithm {
+	case "":
+		cf.Signing.Algorithm = "RS256"
+	case "RS256", "PS256", "ES256", "EdDSA":
+	default:
+		return nil, fmt.Errorf("%s is not a supported signing algorithm", cf.Signing.Algorithm)
+	}
+
+	if cf.Signing.RotationInterval <= 0 {
+		cf.Signing.RotationInterval = 90 * 24 * 3600
+	}
+
+	// the old key must be retained at least till the tokens signed by it expire
+	if cf.Signing.RetentionTime < cf.Oauth.SsoSessionMaxLife {
+		cf.Signing.RetentionTime = cf.Oauth.SsoSessionMaxLife
+	}
+
+	if cf.Signing.PrePublishTime < 0 || cf.Signing.PrePublishTime >= cf.Signing.RotationInterval {
+		cf.Signing.PrePublishTime = cf.Signing.RotationInterval / 2
+	}
+
+	// device grant settings were not present in the older versions of the config
+	if cf.Oauth.DeviceCodeMaxLife <= 0 {
+		cf.Oauth.DeviceCodeMaxLife = 10 * 60
+	}
+
+	if cf.Oauth.DevicePollInterval <= 0 {
+		cf.Oauth.DevicePollInterval = 5
+	}
+
+	// client secrets did not expire in the older versions, zero retains that behaviour
+	if cf.Oauth.ClientSecretMaxLife < 0 {
+		return nil, fmt.Errorf("invalid clientSecretMaxLife %d, must be zero or a positive number of seconds", cf.Oauth.ClientSecretMaxLife)
+	}
+
+	if cf.Oauth.ClientSecretOverlap <= 0 {
+		cf.Oauth.ClientSecretOverlap = 7 * 24 * 3600
+	}
+
+	if cf.Oauth.ClientSecretWarnTime <= 0 {
+		cf.Oauth.ClientSecretWarnTime = 30 * 24 * 3600
+	}
+
+	err = checkScopes(cf.Oauth)
+	if err != nil {
+		return nil, err
+	}
+
 	if !utils.IsHashAlgoSupported(cf.Ppolicy.PasswdHashAlgo) {
 		panic(fmt.Errorf("%s is not a supported hashing algorithm", cf.Ppolicy.PasswdHashAlgo))
 	}
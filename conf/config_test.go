@@ -6,6 +6,8 @@ package conf
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -18,3 +20,53 @@ func TestParseConfig(t *testing.T) {
 
 	fmt.Println(string(data))
 }
+
+func TestCheckScopes(t *testing.T) {
+	oauthCf := &OauthConfig{}
+	oauthCf.Scopes = []*ScopeConfig{{Name: "api", Permissions: []*ScopePermission{{ResType: "User", Ops: []string{"READ"}}}}}
+	err := checkScopes(oauthCf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(oauthCf.Scopes) != len(defaultScopes())+1 || oauthCf.Scopes[0].Permissions[0].Ops[0] != "read" {
+		t.Errorf("the standard scopes must be added and the operations must be lowercased")
+	}
+
+	oauthCf.Scopes = []*ScopeConfig{{Name: "api", Permissions: []*ScopePermission{{ResType: "User", Ops: []string{"delete"}}}}}
+	if checkScopes(oauthCf) == nil {
+		t.Errorf("invalid operations must be rejected")
+	}
+
+	oauthCf.Scopes = []*ScopeConfig{{Name: "email"}, {Name: "email"}}
+	if checkScopes(oauthCf) == nil {
+		t.Errorf("duplicate scopes must be rejected")
+	}
+}
+
+func TestClientSecretMaxLife(t *testing.T) {
+	file, err := ioutil.TempFile("", "domain-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	cf := DefaultDomainConfig()
+	for _, maxLife := range []int{0, -1} {
+		cf.Oauth.ClientSecretMaxLife = maxLife
+		data, _ := json.Marshal(cf)
+		ioutil.WriteFile(file.Name(), data, 0600)
+
+		parsed, err := ParseDomainConfig(file.Name())
+		if maxLife < 0 {
+			if err == nil {
+				t.Errorf("a negative max life of the client secrets must be rejected")
+			}
+			continue
+		}
+
+		if err != nil || parsed.Oauth.ClientSecretMaxLife != 0 {
+			t.Errorf("zero max life of the client secrets must be retained [%v]", err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"os"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+	"strings"
+	"testing"
+)
+
+func TestRegisterAndUpdateClient(t *testing.T) {
+	home := "/tmp/client_registration_test"
+	os.RemoveAll(home)
+	defer os.RemoveAll(home)
+
+	sp := NewSparrowServer(home, "")
+	pr := sp.providers[sp.srvConf.DefaultDomain]
+
+	session, err := pr.GenSessionForUserId(provider.AdminUserId)
+	if err != nil {
+		t.Fatalf("failed to generate the session of the admin user %s", err)
+	}
+
+	// a minimal registration
+	md := &oauth.ClientMetadata{RedirectUris: []string{"https://client.example.com/cb"}}
+	if ep := md.Validate(); ep != nil {
+		t.Fatalf("failed to validate the metadata %s", ep.Desc)
+	}
+
+	opCtx := &base.OpContext{Session: session, Endpoint: "/oauth2/register"}
+	cl, _, regToken, err := pr.RegisterClient(md, opCtx)
+	if err != nil {
+		t.Fatalf("failed to register a client with the minimal metadata %#v", err)
+	}
+
+	if cl.HomeUrl != "https://client.example.com" {
+		t.Errorf("the home URL must default to the origin of the redirect URI, found %s", cl.HomeUrl)
+	}
+
+	if cl.Oauth.RefreshTokenValidity != 0 || !cl.Oauth.DisableDeviceGrant {
+		t.Errorf("the grant types that were not registered must not be allowed")
+	}
+
+	rmd := oauth.NewClientMetadata(cl)
+	if len(rmd.GrantTypes) != 1 || rmd.GrantTypes[0] != oauth.AUTHORIZATION_CODE {
+		t.Errorf("unexpected grant types %v", rmd.GrantTypes)
+	}
+
+	// the home URL is retained when the client_uri is absent
+	md = &oauth.ClientMetadata{RedirectUris: []string{"https://client.example.com/cb2"}, GrantTypes: []string{oauth.AUTHORIZATION_CODE, oauth.REFRESH_TOKEN, oauth.DEVICE_CODE}}
+	if ep := md.Validate(); ep != nil {
+		t.Fatalf("failed to validate the metadata %s", ep.Desc)
+	}
+
+	cl, err = pr.UpdateRegisteredClient(cl.Id, regToken, md, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to update the client without client_uri %#v", err)
+	}
+
+	if cl.HomeUrl != "https://client.example.com" || cl.Oauth.RedUri != "https://client.example.com/cb2" {
+		t.Errorf("failed to update the client, home URL %s redirect URI %s", cl.HomeUrl, cl.Oauth.RedUri)
+	}
+
+	if cl.Oauth.RefreshTokenValidity <= 0 || cl.Oauth.DisableDeviceGrant {
+		t.Errorf("the registered refresh_token and device_code grant types must be allowed")
+	}
+
+	md.ClientUri = "https://www.example.com"
+	md.GrantTypes = nil
+	md.Validate()
+	cl, err = pr.UpdateRegisteredClient(cl.Id, regToken, md, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to update the client %#v", err)
+	}
+
+	if cl.HomeUrl != md.ClientUri || cl.Oauth.RefreshTokenValidity != 0 || !cl.Oauth.DisableDeviceGrant {
+		t.Errorf("the client_uri and grant types must be updated")
+	}
+
+	// an administrator replacing the Application cannot send the attributes which are never returned
+	rt := pr.RsTypes["Application"]
+	rs, err := base.ParseResource(pr.RsTypes, pr.Schemas, strings.NewReader(`{"schemas":["`+rt.Schema+`"], "name":"replaced", "redirectUri":"https://client.example.com/cb", "homeUrl":"https://www.example.com"}`))
+	if err != nil {
+		t.Fatalf("failed to parse the replacement %#v", err)
+	}
+	rs.SetId(cl.Id)
+
+	stored, _ := pr.GetResourceInternal(cl.Id, rt)
+	replaceCtx := &base.ReplaceContext{InRes: rs, Rt: rt, IfMatch: stored.GetVersion(), OpContext: opCtx}
+	err = pr.Replace(replaceCtx)
+	if err != nil {
+		t.Fatalf("failed to replace the client %#v", err)
+	}
+
+	cl = pr.GetRegisteredClient(cl.Id, regToken)
+	if cl == nil {
+		t.Fatalf("the registration access token must be retained after replacing the client")
+	}
+
+	if len(cl.Oauth.Secret) == 0 || len(cl.Oauth.ServerSecret) == 0 {
+		t.Errorf("the secrets of the client must be retained after replacing the client")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sparrow/provider"
+	"sparrow/utils"
+	"strings"
+	"testing"
+)
+
+func TestCreateApplicationReturnsSecret(t *testing.T) {
+	home := "/tmp/client_secret_test"
+	os.RemoveAll(home)
+	defer os.RemoveAll(home)
+
+	sp := NewSparrowServer(home, "")
+	pr := sp.providers[sp.srvConf.DefaultDomain]
+
+	session, err := pr.GenSessionForUserId(provider.AdminUserId)
+	if err != nil {
+		t.Fatalf("failed to generate the session of the admin user %s", err)
+	}
+	pr.StoreOauthSession(session)
+
+	body := `{"schemas":["urn:keydap:params:scim:schemas:core:2.0:Application"], "name":"secretapp", "redirectUri":"https://secretapp/cb", "homeUrl":"https://secretapp"}`
+	r := httptest.NewRequest(http.MethodPost, "/v2/Applications", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+session.Jti)
+	r.Header.Set("Content-Type", "application/scim+json; charset=utf-8")
+	w := httptest.NewRecorder()
+	sp.handleResRequest(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but received %d %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var created map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	secret, _ := created["secret"].(string)
+	if len(secret) == 0 {
+		t.Fatalf("the generated secret must be sent in the create response")
+	}
+
+	cl := pr.GetClientById(created["id"].(string))
+	if cl == nil {
+		t.Fatalf("the created application was not found")
+	}
+
+	if cl.Oauth.Secret == secret || !utils.IsPasswordHashed(cl.Oauth.Secret) {
+		t.Errorf("only the hash of the secret must be stored")
+	}
+
+	if !utils.ComparePassword(secret, cl.Oauth.Secret) {
+		t.Errorf("the stored hash doesn't match the returned secret")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+)
+
+// the data of the device verification page
+type devicePage struct {
+	Action   string // the path to which the user code is posted
+	UserCode string
+	ErrMsg   string
+	Msg      string // shown instead of the form after the user decides on the grant
+}
+
+// Serves the device authorization requests of RFC 8628. Both public and confidential clients
+// can request a device grant, the device then polls the token endpoint till the user
+// approves or denies the grant on the verification page.
+func (sp *Sparrow) authorizeDevice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOauthError(w, r, "", err)
+		return
+	}
+
+	cl, pr, ep := authenticateClient(r, sp, r.Form.Get("client_id"), r.Form.Get("client_secret"))
+	if ep != nil {
+		sendClientAuthError(w, ep)
+		return
+	}
+
+	if cl.Oauth.DisableDeviceGrant {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Client is not allowed to use the device authorization grant"
+		ep.Err = oauth.ERR_UNAUTHORIZED_CLIENT
+		sendTokenError(w, ep)
+		return
+	}
+
+	scope := r.Form.Get("scope")
+	if len(scope) > oauth.MAX_SCOPE_LEN {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Too many scopes are present"
+		ep.Err = oauth.ERR_INVALID_REQUEST
+		sendTokenError(w, ep)
+		return
+	}
+
+	// the scopes which are not allowed are dropped, section 3.3 of RFC 6749
+	granted := pr.GrantScopes(cl, oauth.ParseScope(scope))
+	oauthCf := pr.Config.Oauth
+	dg := oauth.NewDeviceGrant(cl, granted.String(), oauthCf.DeviceCodeMaxLife, oauthCf.DevicePollInterval)
+	pr.StoreDeviceGrant(dg)
+	log.Debugf("issued device grant with user code %s to the client %s", dg.UserCode, cl.Id)
+
+	dresp := &oauth.DeviceAuthorizationResp{}
+	dresp.DeviceCode = dg.DeviceCode
+	dresp.UserCode = dg.DisplayUserCode()
+	dresp.VerificationUri = sp.baseUrl(r) + OAUTH_BASE + "/device/" + pr.Name
+	dresp.VerificationUriComplete = dresp.VerificationUri + "?user_code=" + url.QueryEscape(dresp.UserCode)
+	dresp.ExpiresIn = oauthCf.DeviceCodeMaxLife
+	dresp.Interval = oauthCf.DevicePollInterval
+
+	data, err := json.Marshal(dresp)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-store")
+	headers.Add("Pragma", "no-cache")
+	headers.Add("Content-Type", JSON_TYPE)
+	w.Write(data)
+}
+
+// Shows the page on which the user enters the code displayed on the device, the code
+// gets pre-filled when the user visits the verification_uri_complete
+func (sp *Sparrow) showDevicePage(w http.ResponseWriter, r *http.Request) {
+	pr := sp.oidcDomain(w, r)
+	if pr == nil {
+		return
+	}
+
+	r.ParseForm()
+	dp := &devicePage{Action: r.URL.Path, UserCode: r.Form.Get("user_code")}
+	sp.templates["device-verification.html"].Execute(w, dp)
+}
+
+// Verifies the user code and resumes the flow with the login page, using the same login and TFA
+// steps of the authorization code flow. The user is directly asked for consent if a SSO session exists.
+func (sp *Sparrow) verifyUserCode(w http.ResponseWriter, r *http.Request) {
+	pr := sp.oidcDomain(w, r)
+	if pr == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	userCode := r.Form.Get("user_code")
+	dg := pr.GetDeviceGrantByUserCode(userCode)
+	var cl *oauth.Client
+	if dg != nil && dg.Status == oauth.DEVICE_GRANT_PENDING {
+		cl = pr.GetClientById(dg.ClientId)
+	}
+
+	if cl == nil {
+		dp := &devicePage{Action: r.URL.Path, UserCode: userCode, ErrMsg: "Invalid or expired code"}
+		sp.templates["device-verification.html"].Execute(w, dp)
+		return
+	}
+
+	paramMap := make(map[string]string)
+	paramMap["user_code"] = dg.UserCode
+	paramMap["client_id"] = cl.Id
+	paramMap["scope"] = dg.Scope
+
+	// the decision is recorded on the grant verified here, not on the one present in the consent form
+	af := &authFlow{}
+	af.SetFromDevice(true)
+	af.UserCode = dg.UserCode
+
+	session := getSsoSessionOfDomain(r, pr)
+	if session != nil {
+		log.Debugf("valid session exists, asking for consent to approve the device grant")
+		af.UserId = session.Sub
+		af.DomainCode = pr.DomainCode()
+		af.markLoginSuccessful()
+		setAuthFlow(sp, af, w)
+		consentTmpl := sp.templates["consent.html"]
+		consentTmpl.Execute(w, newConsentPage(pr, paramMap))
+		return
+	}
+
+	setAuthFlow(sp, af, w)
+	login := sp.templates["login.html"]
+	login.Execute(w, paramMap)
+}
+
+// Records the decision of the user on the device grant after the consent is given or denied
+func (sp *Sparrow) decideDeviceGrant(w http.ResponseWriter, r *http.Request, af *authFlow, approved bool) {
+	setAuthFlow(sp, nil, w)
+
+	dp := &devicePage{Action: OAUTH_BASE + "/device"}
+	pr := sp.dcPrvMap[af.DomainCode]
+	if pr != nil {
+		dp.Action += "/" + pr.Name
+	}
+
+	// the authentication details are taken from the SSO session created on login
+	var authTime int64
+	var amr []string
+	if pr != nil {
+		if session := getSsoSessionOfDomain(r, pr); session != nil && session.Sub == af.UserId {
+			authTime = session.AuthTime
+			amr = session.Amr
+		}
+	}
+
+	if pr == nil || len(af.UserCode) == 0 || !pr.DecideDeviceGrant(af.UserCode, af.UserId, authTime, amr, approved) {
+		dp.ErrMsg = "Invalid or expired code"
+	} else if approved {
+		log.Debugf("user %s approved the device grant", af.UserId)
+		dp.Msg = "The device has been authorized, you can close this window"
+	} else {
+		log.Debugf("user %s denied the device grant", af.UserId)
+		dp.Msg = "The device was denied access, you can close this window"
+	}
+
+	sp.templates["device-verification.html"].Execute(w, dp)
+}
+
+// Issues the tokens to the device once the user approves the grant, section 3.5 of RFC 8628.
+// The polling errors are sent as JSON for the device to distinguish them.
+func (sp *Sparrow) sendDeviceToken(w http.ResponseWriter, r *http.Request, atr *oauth.AccessTokenReq, cl *oauth.Client, pr *provider.Provider) {
+	ep := &oauth.ErrorResp{}
+	dg, slowDown := pr.PollDeviceGrant(atr.DeviceCode, cl.Id)
+	if dg == nil {
+		ep.Desc = "Invalid device_code"
+		ep.Err = oauth.ERR_INVALID_GRANT
+	} else if dg.Status == oauth.DEVICE_GRANT_DENIED {
+		ep.Desc = "User did not authorize the request"
+		ep.Err = oauth.ERR_ACCESS_DENIED
+	} else if dg.Status == oauth.DEVICE_GRANT_PENDING {
+		if dg.IsExpired() {
+			ep.Desc = "Expired device_code"
+			ep.Err = oauth.ERR_EXPIRED_TOKEN
+		} else if slowDown {
+			ep.Desc = "Polling too frequently"
+			ep.Err = oauth.ERR_SLOW_DOWN
+		} else {
+			ep.Desc = "Authorization is pending"
+			ep.Err = oauth.ERR_AUTHORIZATION_PENDING
+		}
+	}
+
+	if len(ep.Err) != 0 {
+		sendTokenError(w, ep)
+		return
+	}
+
+	session, err := pr.GenSessionForUserId(dg.UserId)
+	if err != nil {
+		ep.Desc = "Failed to generate token - " + err.Error()
+		ep.Err = oauth.ERR_SERVER_ERROR
+		sendTokenError(w, ep)
+		return
+	}
+	session.Ito = cl.Id
+	session.AuthTime = dg.AuthTime
+	session.Amr = dg.Amr
+	granted := oauth.ParseScope(dg.Scope)
+	pr.NarrowSession(session, granted)
+
+	err = pr.StoreOauthSession(session)
+	if err != nil {
+		sendTokenError(w, storeTokenError(err, ""))
+		return
+	}
+
+	log.Debugf("issued access token to the device of the client %s", cl.Id)
+	tresp := &oauth.AccessTokenResp{}
+	tresp.AcToken = session.Jti
+	tresp.TokenType = "Bearer"
+	tresp.Scope = session.Scope
+
+	openId := granted.Has(oauth.SCOPE_OPENID)
+	if openId {
+		idt := createIdToken(sp, r, session, cl, pr, granted)
+		tresp.IdToken = oauth.ToJwt(idt, pr.SigningKey())
+	}
+
+	if cl.Oauth.RefreshTokenValidity > 0 {
+		rt := oauth.NewRefreshToken(cl, session.Sub, session.Jti, openId)
+		rt.Scope = dg.Scope
+		rt.AuthTime = dg.AuthTime
+		rt.Amr = dg.Amr
+		pr.StoreRefreshToken(rt)
+		tresp.RefreshToken = rt.Id
+	}
+
+	writeTokenResp(w, tresp)
+}
+
+// Sends the error response of the token endpoint as JSON, section 5.2 of RFC 6749. The
+// client registration endpoint uses the same format for its errors.
+func sendTokenError(w http.ResponseWriter, ep *oauth.ErrorResp) {
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-store")
+	headers.Add("Pragma", "no-cache")
+	headers.Add("Content-Type", JSON_TYPE)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(ep.Serialize())
+}
+
+// Returns the unexpired SSO session of the given domain present in the request
+func getSsoSessionOfDomain(r *http.Request, pr *provider.Provider) *base.RbacSession {
+	ssoCookie, _ := r.Cookie(SSO_COOKIE)
+	if ssoCookie == nil {
+		return nil
+	}
+
+	session := pr.GetSsoSession(ssoCookie.Value)
+	if session == nil || session.IsExpired() {
+		return nil
+	}
+
+	return session
+}
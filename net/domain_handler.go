@@ -1,8 +1,11 @@
 package net
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
 	"sparrow/base"
+	"sparrow/provider"
 	"strings"
 )
 
@@ -19,15 +22,82 @@ func (sp *Sparrow) handleDomainLifecycle(w http.ResponseWriter, r *http.Request)
 	name := strings.TrimSpace(r.Form.Get("name"))
 	name = strings.ToLower(name)
 
+	if r.Method == http.MethodGet && operation != "list" {
+		writeError(w, base.NewBadRequestError("only list operation is allowed using GET method"))
+		return
+	}
+
+	pr := sp.providers[sp.srvConf.ControllerDomain]
+
 	switch operation {
 	case "create":
-		err := sp.createDomain(name)
+		template := strings.ToLower(strings.TrimSpace(r.Form.Get("template")))
+		err := sp.createDomain(name, template)
 		if err != nil {
 			writeError(w, base.NewBadRequestError(err.Error()))
+			return
+		}
+
+		pr.SendCreateDomainEvent(name, template, opCtx)
+
+		// seed resources are cloned after sending the domain creation event
+		// so that the peers create the domain before receiving the seed resources
+		if len(template) > 0 {
+			err = sp.providers[name].CloneSeedResources(sp.providers[template])
+			if err != nil {
+				writeError(w, base.NewInternalserverError(err.Error()))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "delete":
+		err := sp.deleteDomain(name)
+		if err != nil {
+			writeError(w, err)
 		} else {
-			pr := sp.providers[sp.srvConf.ControllerDomain]
-			pr.SendCreateDomainEvent(name, opCtx)
-			w.WriteHeader(http.StatusCreated)
+			pr.SendDeleteDomainEvent(name, opCtx)
+			w.WriteHeader(http.StatusNoContent)
 		}
+
+	case "disable", "enable":
+		disabled := (operation == "disable")
+		err := sp.setDomainDisabled(name, disabled)
+		if err != nil {
+			writeError(w, err)
+		} else {
+			pr.SendDisableDomainEvent(name, disabled, opCtx)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case "rename":
+		newName := strings.ToLower(strings.TrimSpace(r.Form.Get("newName")))
+		err := sp.renameDomain(name, newName)
+		if err != nil {
+			writeError(w, err)
+		} else {
+			pr.SendRenameDomainEvent(name, newName, opCtx)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case "list":
+		stats := make([]*provider.DomainStats, 0)
+		for _, p := range sp.providers {
+			stats = append(stats, p.Stats())
+		}
+
+		sort.Slice(stats, func(i, j int) bool {
+			return stats[i].Name < stats[j].Name
+		})
+
+		data, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, base.NewInternalserverError(err.Error()))
+			return
+		}
+		writeJson(w, data)
+
+	default:
+		writeError(w, base.NewBadRequestError("unknown domain lifecycle operation "+operation))
 	}
 }
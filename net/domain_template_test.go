@@ -0,0 +1,96 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"os"
+	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/provider"
+	"strings"
+	"testing"
+)
+
+func TestCloneTemplateWithRoleHierarchy(t *testing.T) {
+	home := "/tmp/domain_template_test"
+	os.RemoveAll(home)
+	defer os.RemoveAll(home)
+
+	sp := NewSparrowServer(home, "")
+	err := sp.createDomain("tmpl.example.com", "")
+	if err != nil {
+		t.Fatalf("failed to create the template domain %s", err)
+	}
+
+	tmpl := sp.providers["tmpl.example.com"]
+	session, err := tmpl.GenSessionForUserId(provider.AdminUserId)
+	if err != nil {
+		t.Fatalf("failed to generate the session of the admin user %s", err)
+	}
+	opCtx := &base.OpContext{Session: session, Endpoint: "/v2/Groups"}
+
+	createGroup := func(data string) *base.Resource {
+		rs, err := base.ParseResource(tmpl.RsTypes, tmpl.Schemas, strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse the group %s", err)
+		}
+
+		err = tmpl.CreateResource(&base.CreateContext{InRes: rs, OpContext: opCtx})
+		if err != nil {
+			t.Fatalf("failed to create the group %#v", err)
+		}
+
+		return rs
+	}
+
+	// the groups are cloned in the order of their IDs, the senior may be cloned before the junior
+	junior := createGroup(`{"schemas":["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName":"junior"}`)
+	senior := createGroup(`{"schemas":["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName":"senior", "inherits":[{"value":"` + junior.GetId() + `"}],
+	                        "adminFilter":"userName pr", "assignableGroups":[{"value":"` + junior.GetId() + `"}]}`)
+
+	tmpl.Config.Rbac.StaticSod = []*conf.SodRule{{Name: "split", GroupIds: []string{junior.GetId(), senior.GetId()}, Cardinality: 2}}
+
+	err = sp.createDomain("cloned.example.com", "tmpl.example.com")
+	if err != nil {
+		t.Fatalf("failed to create the domain %s", err)
+	}
+
+	pr := sp.providers["cloned.example.com"]
+	err = pr.CloneSeedResources(tmpl)
+	if err != nil {
+		t.Fatalf("failed to clone the template with a role hierarchy %s", err)
+	}
+
+	gids := make(map[string]string)
+	outPipe := make(chan *base.Resource)
+	go pr.ReadAllInternal(pr.RsTypes["Group"], outPipe)
+	for rs := range outPipe {
+		gids[rs.GetAttr("displayname").GetSimpleAt().GetStringVal()] = rs.GetId()
+	}
+
+	clonedJunior, clonedSenior := gids["junior"], gids["senior"]
+	if len(clonedJunior) == 0 || len(clonedSenior) == 0 || clonedJunior == junior.GetId() {
+		t.Fatalf("the groups were not cloned %v", gids)
+	}
+
+	rs, _ := pr.GetResourceInternal(clonedSenior, pr.RsTypes["Group"])
+	for _, atName := range []string{"inherits", "assignablegroups"} {
+		at := rs.GetAttr(atName)
+		if at == nil {
+			t.Errorf("the %s attribute of the cloned group is missing", atName)
+			continue
+		}
+
+		for _, subAtMap := range at.GetComplexAt().SubAts {
+			if gid := subAtMap["value"].Values[0].(string); gid != clonedJunior {
+				t.Errorf("the %s attribute refers to %s instead of the cloned group %s", atName, gid, clonedJunior)
+			}
+		}
+	}
+
+	rule := pr.Config.Rbac.StaticSod[0]
+	if len(rule.GroupIds) != 2 || rule.GroupIds[0] != clonedJunior || rule.GroupIds[1] != clonedSenior {
+		t.Errorf("the separation of duty rule refers to the template's groups %v", rule.GroupIds)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+	"strings"
+	"testing"
+)
+
+func TestImplicitResponseWithoutSession(t *testing.T) {
+	home := "/tmp/final_response_test"
+	os.RemoveAll(home)
+	defer os.RemoveAll(home)
+
+	sp := NewSparrowServer(home, "")
+	pr := sp.providers[sp.srvConf.DefaultDomain]
+
+	session, err := pr.GenSessionForUserId(provider.AdminUserId)
+	if err != nil {
+		t.Fatalf("failed to generate the session of the admin user %s", err)
+	}
+
+	md := &oauth.ClientMetadata{RedirectUris: []string{"https://client.example.com/cb"}, GrantTypes: []string{oauth.IMPLICIT}, ResponseTypes: []string{"id_token token"}}
+	if ep := md.Validate(); ep != nil {
+		t.Fatalf("failed to validate the metadata %s", ep.Desc)
+	}
+
+	cl, _, _, err := pr.RegisterClient(md, &base.OpContext{Session: session})
+	if err != nil {
+		t.Fatalf("failed to register the client %#v", err)
+	}
+
+	params := url.Values{}
+	params.Set("client_id", cl.Id)
+	params.Set("response_type", "id_token token")
+	params.Set("redirect_uri", cl.Oauth.RedUri)
+	params.Set("scope", "openid")
+	params.Set("nonce", "n-0S6_WzA2Mj")
+	r := httptest.NewRequest(http.MethodGet, "/oauth2/authorize?"+params.Encode(), nil)
+	r.Header.Set(TENANT_HEADER, pr.Name)
+	w := httptest.NewRecorder()
+
+	// the user logged in but the SSO session of the client's domain is absent
+	af := &authFlow{UserId: provider.AdminUserId, DomainCode: pr.DomainCode()}
+	sendFinalResponse(sp, w, r, nil, af)
+
+	loc := w.Header().Get("Location")
+	if !strings.Contains(loc, oauth.ERR_LOGIN_REQUIRED) {
+		t.Errorf("expected the %s error but received the response %d %s", oauth.ERR_LOGIN_REQUIRED, w.Code, loc)
+	}
+}
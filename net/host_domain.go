@@ -0,0 +1,77 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Returns the name of the domain mapped to the host of the given request, or an empty string if
+// the host is not mapped to any domain
+func (sp *Sparrow) domainOfHost(r *http.Request) string {
+	if len(sp.srvConf.HostDomains) == 0 {
+		return ""
+	}
+
+	return matchHostDomain(stripPort(r.Host), sp.srvConf.HostDomains)
+}
+
+// Returns the base URL to be used in the issuer and endpoint URLs. The URL is formed using the
+// request's host if the host is mapped to a domain, otherwise the server's home URL is returned.
+func (sp *Sparrow) baseUrl(r *http.Request) string {
+	if r == nil || sp.domainOfHost(r) == "" {
+		return sp.homeUrl
+	}
+
+	if sp.srvConf.Https {
+		return "https://" + r.Host
+	}
+
+	return "http://" + r.Host
+}
+
+// Matches the host against the given host to domain mapping. An exact match takes precedence over
+// a wildcard match and the longest wildcard pattern wins. A '*' in the domain name of a wildcard mapping
+// gets replaced with the matched subdomain, e.g. with the mapping "*.id.example.com" : "*.com"
+// the host acme.id.example.com resolves to the domain acme.com
+func matchHostDomain(host string, hostDomains map[string]string) string {
+	host = strings.ToLower(host)
+	if domain, ok := hostDomains[host]; ok {
+		return domain
+	}
+
+	domain := ""
+	matchLen := 0
+	for pattern, d := range hostDomains {
+		if !strings.HasPrefix(pattern, "*.") {
+			continue
+		}
+
+		suffix := pattern[1:]
+		if len(suffix) <= matchLen || len(host) <= len(suffix) || !strings.HasSuffix(host, suffix) {
+			continue
+		}
+
+		// wildcard matches a single label only
+		sub := host[:len(host)-len(suffix)]
+		if strings.ContainsRune(sub, '.') {
+			continue
+		}
+
+		domain = strings.Replace(d, "*", sub, -1)
+		matchLen = len(suffix)
+	}
+
+	return domain
+}
+
+func stripPort(host string) string {
+	pos := strings.LastIndexByte(host, ':')
+	if pos > strings.LastIndexByte(host, ']') {
+		host = host[:pos]
+	}
+
+	return host
+}
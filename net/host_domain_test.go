@@ -0,0 +1,126 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"sparrow/conf"
+	"sparrow/provider"
+	"strings"
+	"testing"
+)
+
+func TestMatchHostDomain(t *testing.T) {
+	hostDomains := make(map[string]string)
+	hostDomains["login.example.com"] = "example.com"
+	hostDomains["*.id.example.com"] = "*"
+	hostDomains["*.eu.id.example.com"] = "*.eu"
+
+	tests := map[string]string{
+		"login.example.com":        "example.com",
+		"LOGIN.example.com":        "example.com",
+		"acme.id.example.com":      "acme",
+		"acme.eu.id.example.com":   "acme.eu",
+		"a.b.id.example.com":       "",
+		"id.example.com":           "",
+		"other.example.com":        "",
+		"acme.id.example.com.evil": "",
+	}
+
+	for host, expected := range tests {
+		actual := matchHostDomain(host, hostDomains)
+		if actual != expected {
+			t.Errorf("expected domain '%s' for host %s but found '%s'", expected, host, actual)
+		}
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := map[string]string{
+		"localhost:7090": "localhost",
+		"localhost":      "localhost",
+		"[::1]:7090":     "[::1]",
+		"[::1]":          "[::1]",
+	}
+
+	for host, expected := range tests {
+		actual := stripPort(host)
+		if actual != expected {
+			t.Errorf("expected %s but found %s", expected, actual)
+		}
+	}
+}
+
+func TestHostDomainTakesPrecedence(t *testing.T) {
+	sp := &Sparrow{srvConf: &conf.ServerConf{DefaultDomain: "example.com"}}
+	sp.srvConf.HostDomains = map[string]string{"login.acme.com": "acme.com"}
+	sp.providers = make(map[string]*provider.Provider)
+	for _, name := range []string{"example.com", "acme.com", "other.com"} {
+		sp.providers[name] = &provider.Provider{Name: name, Config: &conf.DomainConfig{}}
+	}
+
+	r := httptest.NewRequest("GET", "http://login.acme.com/v2/Users", nil)
+	r.Header.Set(TENANT_HEADER, "other.com")
+	pr, err := getPrFromParam(r, sp)
+	if err != nil || pr.Name != "acme.com" {
+		t.Errorf("the domain mapped to the host must not be overridden by the header")
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost/v2/Users", nil)
+	r.Header.Set(TENANT_HEADER, "other.com")
+	pr, err = getPrFromParam(r, sp)
+	if err != nil || pr.Name != "other.com" {
+		t.Errorf("the domain must be read from the header when the host is not mapped")
+	}
+
+	// the domain segment of the endpoint's path
+	r = httptest.NewRequest("POST", "http://localhost/oauth2/token/acme.com", nil)
+	r.Header.Set(TENANT_HEADER, "other.com")
+	r = mux.SetURLVars(r, map[string]string{"domain": "acme.com"})
+	pr, err = getPrFromParam(r, sp)
+	if err != nil || pr.Name != "acme.com" {
+		t.Errorf("the domain must be read from the path when the host is not mapped")
+	}
+}
+
+func TestHostDomainOverridesUsernameDomain(t *testing.T) {
+	sp := &Sparrow{srvConf: &conf.ServerConf{DefaultDomain: "example.com"}}
+	sp.srvConf.HostDomains = map[string]string{"login.acme.com": "acme.com"}
+
+	tests := map[string][]string{
+		"john":             {"john", "acme.com"},
+		"john@acme.com":    {"john", "acme.com"},
+		"john@other.com":   {"john@other.com", "acme.com"},
+		"john@ACME.com":    {"john", "acme.com"},
+		"john@other.com@x": {"john@other.com@x", "acme.com"},
+	}
+
+	for given, expected := range tests {
+		r := httptest.NewRequest("POST", "http://login.acme.com/login", nil)
+		username, domain := sp.splitUsernameAndDomain(given, r)
+		if username != expected[0] || domain != expected[1] {
+			t.Errorf("expected %v for %s but found %s %s", expected, given, username, domain)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "http://localhost/login", nil)
+	username, domain := sp.splitUsernameAndDomain("john@other.com", r)
+	if username != "john" || domain != "other.com" {
+		t.Errorf("the domain in the username must be used when the host is not mapped")
+	}
+}
+
+func TestDirectLoginToOtherDomainOfMappedHost(t *testing.T) {
+	sp := &Sparrow{srvConf: &conf.ServerConf{DefaultDomain: "example.com"}}
+	sp.srvConf.HostDomains = map[string]string{"login.acme.com": "acme.com"}
+
+	r := httptest.NewRequest("POST", "http://login.acme.com/directLogin", strings.NewReader(`{"username":"john", "password":"secret", "domain":"other.com"}`))
+	w := httptest.NewRecorder()
+	sp.directLogin(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("logging in to a domain other than the one mapped to the host must be rejected, received %d", w.Code)
+	}
+}
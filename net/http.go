@@ -139,7 +139,6 @@ func (sp *Sparrow) setup(c *caddy.Controller) error {
 	scimRouter := router.PathPrefix(API_BASE).Subrouter()
 
 	scimRouter.HandleFunc("/directLogin", sp.directLogin).Methods("POST")
-	//scimRouter.HandleFunc("/revoke", handleRevoke).Methods("DELETE")
 	scimRouter.HandleFunc("/Me", sp.selfServe).Methods("GET")
 	scimRouter.HandleFunc("/pubkeyOptions", sp.pubKeyOptions).Methods("GET")
 	scimRouter.HandleFunc("/registerPubkey", sp.registerPubKey).Methods("POST")
@@ -150,6 +149,9 @@ func (sp *Sparrow) setup(c *caddy.Controller) error {
 	scimRouter.HandleFunc("/ServiceProviderConfigs", sp.getSrvProvConf).Methods("GET")
 	scimRouter.HandleFunc("/DomainConfig", sp.handleDomainConf).Methods("GET", "PATCH") // Sparrow specific endpoint
 	scimRouter.HandleFunc("/Templates", sp.handleTemplateConf).Methods("GET", "PUT")    // Sparrow specific endpoint
+	scimRouter.HandleFunc("/DomainUsage", sp.handleDomainUsage).Methods("GET")          // Sparrow specific endpoint
+	scimRouter.HandleFunc("/RoleHierarchy", sp.handleRoleHierarchy).Methods("GET")      // Sparrow specific endpoint
+	scimRouter.HandleFunc("/PermissionCheck", sp.handlePermissionCheck).Methods("GET")  // Sparrow specific endpoint
 	scimRouter.HandleFunc("/ResourceTypes", sp.getResTypes).Methods("GET")
 	scimRouter.HandleFunc("/Schemas", sp.getSchemas).Methods("GET")
 	scimRouter.HandleFunc("/Bulk", bulkUpdate).Methods("POST")
@@ -158,6 +160,7 @@ func (sp *Sparrow) setup(c *caddy.Controller) error {
 	scimRouter.HandleFunc("/.search", sp.handleResRequest).Methods("POST")
 	// for group management, Sparrow specific method, not a SCIM standard
 	scimRouter.HandleFunc("/ModifyGroupsOfUser", sp.handleResRequest).Methods("POST")
+	scimRouter.HandleFunc("/RotateClientSecret", sp.handleResRequest).Methods("POST") // Sparrow specific endpoint
 
 	// register routes for each resourcetype endpoint
 	// FIXME fix the routes with regex to ignore trailing / chars
@@ -188,12 +191,36 @@ func (sp *Sparrow) setup(c *caddy.Controller) error {
 	oauthRouter.HandleFunc("/authorize", sp.authorize).Methods("GET", "POST").MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
 		return true
 	})
+	oauthRouter.HandleFunc("/authorize/{domain}", sp.authorize).Methods("GET", "POST")
 
 	oauthRouter.HandleFunc("/token", sp.sendToken).Methods("POST")
+	oauthRouter.HandleFunc("/token/{domain}", sp.sendToken).Methods("POST")
+	oauthRouter.HandleFunc("/introspect", sp.introspectToken).Methods("POST")
+	oauthRouter.HandleFunc("/introspect/{domain}", sp.introspectToken).Methods("POST")
+	oauthRouter.HandleFunc("/revoke", sp.revokeToken).Methods("POST")
+	oauthRouter.HandleFunc("/revoke/{domain}", sp.revokeToken).Methods("POST")
+	oauthRouter.HandleFunc("/userinfo", sp.serveUserinfo).Methods("GET", "POST")
+	oauthRouter.HandleFunc("/userinfo/{domain}", sp.serveUserinfo).Methods("GET", "POST")
 	oauthRouter.HandleFunc("/consent", sp.verifyConsent).Methods("POST")
+	oauthRouter.HandleFunc("/device_authorization", sp.authorizeDevice).Methods("POST")
+	oauthRouter.HandleFunc("/device_authorization/{domain}", sp.authorizeDevice).Methods("POST")
+	oauthRouter.HandleFunc("/device", sp.showDevicePage).Methods("GET") // the domain is resolved using the host
+	oauthRouter.HandleFunc("/device", sp.verifyUserCode).Methods("POST")
+	oauthRouter.HandleFunc("/device/{domain}", sp.showDevicePage).Methods("GET")
+	oauthRouter.HandleFunc("/device/{domain}", sp.verifyUserCode).Methods("POST")
+	oauthRouter.HandleFunc("/register", sp.registerClient).Methods("POST") // the domain is resolved using the host
+	oauthRouter.HandleFunc("/register/{domain}", sp.registerClient).Methods("POST")
+	oauthRouter.HandleFunc("/register/{domain}/{clientId}", sp.manageClient).Methods("GET", "PUT", "DELETE")
+	oauthRouter.HandleFunc("/jwks", sp.serveJwks).Methods("GET") // the domain is resolved using the host
+	oauthRouter.HandleFunc("/jwks/{domain}", sp.serveJwks).Methods("GET")
+
+	// OpenID Connect discovery, the document is located relative to the issuer
+	router.HandleFunc(WELL_KNOWN_OIDC_CONF, sp.serveOidcConf).Methods("GET") // the domain is resolved using the host
+	router.HandleFunc("/{domain}"+WELL_KNOWN_OIDC_CONF, sp.serveOidcConf).Methods("GET")
 
 	// SAMLv2 requests
 	samlRouter := router.PathPrefix(SAML_BASE).Subrouter()
+	samlRouter.HandleFunc("/idp/meta", sp.serveIdpMetadata).Methods("GET") // the domain is resolved using the host
 	samlRouter.HandleFunc("/idp/meta/{domain}", sp.serveIdpMetadata).Methods("GET")
 	samlRouter.HandleFunc("/idp/logout", sp.handleSamlLogout).Methods("GET", "POST")
 	// match /saml with any number of query parameters
@@ -212,7 +239,7 @@ func (sp *Sparrow) setup(c *caddy.Controller) error {
 	router.PathPrefix("/repl/").HandlerFunc(sp.replHandler)
 
 	domainsRouter := router.PathPrefix("/domains").Subrouter()
-	domainsRouter.HandleFunc("/dlc", sp.handleDomainLifecycle).Methods("POST")
+	domainsRouter.HandleFunc("/dlc", sp.handleDomainLifecycle).Methods("GET", "POST")
 
 	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
 		return muxHandler{router: router, next: next}
@@ -516,6 +543,46 @@ func modifyGroupsOfUser(hc *httpContext) {
 	log.Debugf("Successfully added user to the given groups")
 }
 
+// request for rotating the secret of an Application, the overlap is the number
+// of seconds during which the current secret remains valid
+type rotateSecretRequest struct {
+	Id      string `json:"id"`
+	Overlap *int   `json:"overlap"`
+}
+
+func rotateClientSecret(hc *httpContext) {
+	defer hc.r.Body.Close()
+	dec := json.NewDecoder(hc.r.Body)
+	var rsr rotateSecretRequest
+
+	err := dec.Decode(&rsr)
+	if err != nil {
+		log.Debugf("%#v", err)
+		err = base.NewBadRequestError(err.Error())
+		writeError(hc.w, err)
+		return
+	}
+
+	overlap := hc.pr.Config.Oauth.ClientSecretOverlap
+	if rsr.Overlap != nil {
+		overlap = *rsr.Overlap
+	}
+
+	secret, rs, err := hc.pr.RotateClientSecret(rsr.Id, overlap, hc.OpContext)
+	if err != nil {
+		log.Debugf("%#v", err)
+		writeError(hc.w, err)
+		return
+	}
+
+	rs.AddSA("secret", secret)
+	writeCommonHeaders(hc.w)
+	hc.w.Header().Add("Etag", rs.GetVersion())
+	hc.w.WriteHeader(http.StatusOK)
+	hc.w.Write(rs.Serialize())
+	log.Debugf("Successfully rotated the secret of the application %s", rsr.Id)
+}
+
 func createResource(hc *httpContext) {
 	defer hc.r.Body.Close()
 	rs, err := base.ParseResource(hc.pr.RsTypes, hc.pr.Schemas, hc.r.Body)
@@ -540,15 +607,19 @@ func createResource(hc *httpContext) {
 		return
 	}
 
+	// the generated secret of an Application is sent only once
+	if len(createCtx.Secret) != 0 {
+		rs.AddSA("secret", createCtx.Secret)
+	}
+
 	rid := rs.GetId()
 	writeCommonHeaders(hc.w)
 	header := hc.w.Header()
 	header.Add("Location", hc.r.RequestURI+"/"+rid)
 	header.Add("Etag", rs.GetVersion())
 	hc.w.WriteHeader(http.StatusCreated)
-	d := rs.Serialize()
-	log.Debugf("-------------------\n%s", string(d))
-	hc.w.Write(d)
+	// the resource is not logged as it may hold the generated secret
+	hc.w.Write(rs.Serialize())
 	log.Debugf("Successfully inserted the resource with ID %s", rid)
 }
 
@@ -725,10 +796,20 @@ func getPrFromParam(r *http.Request, sp *Sparrow) (pr *provider.Provider, err er
 	// NO NEED TO parse Form cause the domain ID will be either in the
 	// Header or in a Cookie
 	//r.ParseForm()
-	domain := ""
-	domainCookie, _ := r.Cookie(TENANT_COOKIE)
-	if domainCookie != nil {
-		domain = domainCookie.Value
+	// a host mapped to a domain always wins, a cookie or header must not
+	// switch the domain of a host that is dedicated to another domain
+	domain := sp.domainOfHost(r)
+
+	// the domain segment of the endpoints advertised in the discovery document
+	if len(domain) == 0 {
+		domain = mux.Vars(r)["domain"]
+	}
+
+	if len(domain) == 0 {
+		domainCookie, _ := r.Cookie(TENANT_COOKIE)
+		if domainCookie != nil {
+			domain = domainCookie.Value
+		}
 	}
 
 	if len(domain) == 0 {
@@ -751,6 +832,11 @@ func getPrFromParam(r *http.Request, sp *Sparrow) (pr *provider.Provider, err er
 		se := base.NewNotFoundError(fmt.Sprintf("No domain '%s' found", domain))
 		return nil, se
 	}
+
+	if pr.IsDisabled() {
+		se := base.NewForbiddenError(fmt.Sprintf("Domain '%s' is disabled", domain))
+		return nil, se
+	}
 	return pr, nil
 }
 
@@ -972,6 +1058,14 @@ func (sp *Sparrow) directLogin(w http.ResponseWriter, r *http.Request) {
 
 	ar.ClientIP = utils.GetRemoteAddr(r)
 	normDomain := strings.ToLower(ar.Domain)
+	// a host mapped to a domain always wins, logging in to a different domain is not allowed
+	if hostDomain := sp.domainOfHost(r); len(hostDomain) != 0 {
+		if len(normDomain) != 0 && normDomain != hostDomain {
+			writeError(w, base.NewBadRequestError("Invalid domain name "+ar.Domain))
+			return
+		}
+		normDomain = hostDomain
+	}
 	if len(normDomain) == 0 {
 		normDomain = sp.srvConf.DefaultDomain
 	}
@@ -992,7 +1086,11 @@ func (sp *Sparrow) directLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := pr.GenSessionForUser(lr.User)
-	pr.StoreOauthSession(token)
+	err = pr.StoreOauthSession(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
 	log.Debugf("Issued token %s by %s", token.Jti, ar.Domain)
 	// write the token
@@ -1028,6 +1126,8 @@ func (sp *Sparrow) handleResRequest(w http.ResponseWriter, r *http.Request) {
 			searchWithSearchRequest(hc)
 		} else if strings.HasSuffix(hc.Endpoint, "/ModifyGroupsOfUser") {
 			modifyGroupsOfUser(hc)
+		} else if strings.HasSuffix(hc.Endpoint, "/RotateClientSecret") {
+			rotateClientSecret(hc)
 		} else {
 			createResource(hc)
 		}
@@ -1192,6 +1292,12 @@ func parseToken(token string, opCtx *base.OpContext, pr *provider.Provider) (ses
 		return nil, base.NewForbiddenError("Expired session token")
 	}
 
+	// the tokens revoked individually or along with their refresh token family
+	if pr.IsRevokedSession(opCtx, session.Jti) {
+		log.Debugf("Revoked session %s", token)
+		return nil, base.NewForbiddenError("Revoked session token")
+	}
+
 	//TODO update the last accesstime if it is a SSO session
 	return session, nil
 }
@@ -1203,7 +1309,22 @@ func (sp *Sparrow) keyFunc(jt *jwt.Token) (key interface{}, err error) {
 	}
 
 	prv := sp.providers[domain.(string)]
-	return prv.Cert.PublicKey, nil
+	if prv == nil || prv.IsDisabled() {
+		return nil, jwt.NewValidationError(fmt.Sprintf("Domain '%s' is either not found or disabled", domain), jwt.ValidationErrorUnverifiable)
+	}
+
+	kid, _ := jt.Header["kid"].(string)
+	sk := prv.VerificationKey(kid)
+	if sk == nil {
+		return nil, jwt.NewValidationError(fmt.Sprintf("Key '%s' is not found in domain '%s'", kid, domain), jwt.ValidationErrorUnverifiable)
+	}
+
+	// the algorithm must match with that of the key to prevent algorithm substitution
+	if jt.Method.Alg() != sk.Alg {
+		return nil, jwt.NewValidationError(fmt.Sprintf("Algorithm '%s' does not match with that of the key '%s'", jt.Method.Alg(), kid), jwt.ValidationErrorSignatureInvalid)
+	}
+
+	return sk.Cert.PublicKey, nil
 }
 
 func parseAttrParams(attributes string, excludedAttributes string, rt *schema.ResourceType) (attrLst map[string]*base.AttributeParam, exclAttrLst map[string]*base.AttributeParam) {
@@ -14,14 +14,14 @@ import (
 const idpMetadataXml = `<?xml version="1.0" encoding="UTF-8"?>
 <md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" cacheDuration="{{.CacheDuration}}" entityID="{{.EntityID}}" validUntil="{{.ValidUntil}}">
     <md:IDPSSODescriptor WantAuthnRequestsSigned="{{.WantAuthnRequestsSigned}}" protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
-        <md:KeyDescriptor use="signing">
+        {{range .SigningCerts}}<md:KeyDescriptor use="signing">
             <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
                 <ds:X509Data>
-                    <ds:X509Certificate>{{.X509Certificate}}</ds:X509Certificate>
+                    <ds:X509Certificate>{{.}}</ds:X509Certificate>
                 </ds:X509Data>
             </ds:KeyInfo>
         </md:KeyDescriptor>
-        <md:KeyDescriptor use="encryption">
+        {{end}}        <md:KeyDescriptor use="encryption">
             <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
                 <ds:X509Data>
                     <ds:X509Certificate>{{.X509Certificate}}</ds:X509Certificate>
@@ -42,6 +42,7 @@ type idpMetadata struct {
 	ValidUntil              string
 	WantAuthnRequestsSigned bool
 	X509Certificate         string
+	SigningCerts            []string // certificates of all the published signing keys
 	SLOLocation             string
 	SLORespLocation         string
 	SSOLocation             string
@@ -54,11 +55,17 @@ func (sp *Sparrow) serveIdpMetadata(w http.ResponseWriter, r *http.Request) {
 		path = path[:plen]
 	}
 
-	pos := strings.LastIndex(path, "/")
-	domain := path[pos+1:]
-	domain = strings.ToLower(domain)
+	var domain string
+	if strings.HasSuffix(path, "/idp/meta") {
+		domain = sp.domainOfHost(r)
+	} else {
+		pos := strings.LastIndex(path, "/")
+		domain = path[pos+1:]
+		domain = strings.ToLower(domain)
+	}
+
 	pr := sp.providers[domain]
-	if pr == nil {
+	if pr == nil || pr.IsDisabled() {
 		// send error
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -74,10 +81,14 @@ func (sp *Sparrow) serveIdpMetadata(w http.ResponseWriter, r *http.Request) {
 	meta.ValidUntil = validity.Format(RFC3339Millis)
 	meta.WantAuthnRequestsSigned = false // for now
 	meta.X509Certificate = utils.B64Encode(pr.Cert.Raw)
+	for _, c := range pr.SamlCerts() {
+		meta.SigningCerts = append(meta.SigningCerts, utils.B64Encode(c))
+	}
 
-	meta.SLOLocation = sp.homeUrl + SAML_BASE + "/idp/logout"
+	baseUrl := sp.baseUrl(r)
+	meta.SLOLocation = baseUrl + SAML_BASE + "/idp/logout"
 	meta.SLORespLocation = meta.SLOLocation
-	meta.SSOLocation = sp.homeUrl + SAML_BASE + "/idp"
+	meta.SSOLocation = baseUrl + SAML_BASE + "/idp"
 
 	var buf bytes.Buffer
 	metaTemplate.Execute(&buf, meta)
@@ -0,0 +1,81 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/utils"
+)
+
+// Serves the token introspection requests of RFC 7662. Only the confidential clients
+// of the domain are allowed to introspect the access tokens issued by the domain.
+func (sp *Sparrow) introspectToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOauthError(w, r, "", err)
+		return
+	}
+
+	cl, pr, ep := authenticateClient(r, sp, r.Form.Get("client_id"), r.Form.Get("client_secret"))
+	if ep != nil {
+		logClientAuthFailure(sp, r, "IntrospectToken", ep)
+		sendClientAuthError(w, ep)
+		return
+	}
+
+	if cl.Oauth.Public {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Public clients are not allowed to introspect tokens"
+		ep.Err = oauth.ERR_UNAUTHORIZED_CLIENT
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	token := r.Form.Get("token")
+	if len(token) == 0 {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Missing token"
+		ep.Err = oauth.ERR_INVALID_REQUEST
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	ir := &oauth.IntrospectionResp{}
+	session := pr.GetOauthSession(token)
+	if session != nil && !session.IsExpired() && !pr.IsRevokedSession(nil, session.Jti) {
+		ir.Active = true
+		ir.ClientId = session.Ito
+		ir.Scope = session.Scope
+		ir.Username = session.Username
+		ir.TokenType = "Bearer"
+		ir.Exp = session.Exp
+		ir.Iat = session.Iat
+		ir.Sub = session.Sub
+		ir.Iss = sp.baseUrl(r) + "/" + session.Domain
+		ir.Jti = session.Jti
+		for _, name := range session.Roles {
+			ir.Roles = append(ir.Roles, name)
+		}
+		sort.Strings(ir.Roles)
+	} else {
+		session = nil
+	}
+
+	pr.Al.LogIntrospection(cl, utils.GetRemoteAddr(r), session)
+
+	data, err := json.Marshal(ir)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-store")
+	headers.Add("Pragma", "no-cache")
+	headers.Add("Content-Type", JSON_TYPE)
+	w.Write(data)
+}
@@ -18,6 +18,7 @@ import (
 	"sparrow/utils"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type LdapSession struct {
@@ -272,7 +273,7 @@ func toSearchContext(req ldap.SearchRequest, ls *LdapSession, sp *Sparrow) (sear
 
 	pr = sp.providers[domain]
 
-	if pr == nil {
+	if pr == nil || pr.IsDisabled() {
 		return nil, nil, fmt.Errorf("Invalid base DN '%s'", domain)
 	}
 
@@ -546,7 +547,13 @@ func sendSearchResultEntry(rs *base.Resource, pr *provider.Provider, messageId i
 			if ldapAt != nil {
 				// fill in the format
 				allValues := make([]string, 0)
+				now := time.Now()
 				for _, mapOfSa := range ca.SubAts {
+					// skip the memberships that are not effective
+					if (fetchUser || ap.Name == "groups") && !base.IsMembershipActive(mapOfSa, now) {
+						continue
+					}
+
 					subAtValues := make([]interface{}, len(ldapAt.SubAtNames))
 					valPresent := false
 					for i, sn := range ldapAt.SubAtNames {
@@ -5,12 +5,15 @@ package net
 
 import (
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	"net/http"
 	"net/url"
 	"sparrow/base"
+	"sparrow/conf"
 	"sparrow/oauth"
 	"sparrow/provider"
 	"sparrow/utils"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,24 +21,57 @@ import (
 // STEP 1 Client sends the request to the Authorization Server
 // Handles the OAuth2 authorization request
 func (sp *Sparrow) authorize(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Debugf("Failed to parse the oauth request %s", err)
+		sendOauthError(w, r, "", err)
+		return
+	}
+
+	areq := oauth.ParseAuthzReq(r)
+	// the request is validated before showing the consent page
+	if !isValidAuthzReq(w, r, areq) {
+		return
+	}
 
 	session := getSessionUsingCookie(r, sp)
-	if session != nil {
+	// a session of another domain cannot be used at the domain's authorization endpoint
+	if domain := mux.Vars(r)["domain"]; session != nil && len(domain) > 0 && session.Domain != strings.ToLower(domain) {
+		session = nil
+	}
+
+	if session != nil && !mustReauthenticate(areq, session) {
+		if areq.HasPrompt(oauth.PROMPT_CONSENT) {
+			log.Debugf("Valid session exists, asking for consent as requested by the client")
+			prv := sp.providers[session.Domain]
+			af := &authFlow{UserId: session.Sub, DomainCode: prv.DomainCode()}
+			af.SetFromOauth(true)
+			af.markLoginSuccessful()
+			setAuthFlow(sp, af, w)
+			showConsentPage(sp, w, prv, copyParams(r))
+			return
+		}
+
 		// valid session exists serve the code or id_token
 		log.Debugf("Valid session exists, sending the final response")
 		sendFinalResponse(sp, w, r, session, nil)
 		return
 	}
 
-	err := r.ParseForm()
-	if err != nil {
-		log.Debugf("Failed to parse the oauth request %s", err)
-		sendOauthError(w, r, "", err)
+	if areq.HasPrompt(oauth.PROMPT_NONE) {
+		// the login_required error is sent after validating the request
+		sendFinalResponse(sp, w, r, nil, nil)
 		return
 	}
 
 	af := &authFlow{}
 	af.SetFromOauth(true)
+	// the domain of the authorization endpoint is used when the username doesn't contain one
+	if domain := mux.Vars(r)["domain"]; len(domain) > 0 {
+		if pr := sp.providers[strings.ToLower(domain)]; pr != nil {
+			af.DomainCode = pr.DomainCode()
+		}
+	}
 
 	setAuthFlow(sp, af, w)
 	paramMap, err := parseParamMap(r)
@@ -58,6 +94,11 @@ func (sp *Sparrow) showLogin(w http.ResponseWriter, r *http.Request) {
 	ologin.Execute(w, paramMap)
 }
 
+func showConsentPage(sp *Sparrow, w http.ResponseWriter, prv *provider.Provider, paramMap map[string]string) {
+	consentTmpl := sp.templates["consent.html"]
+	consentTmpl.Execute(w, newConsentPage(prv, paramMap))
+}
+
 func showOtpPage(sp *Sparrow, w http.ResponseWriter, paramMap map[string]string) {
 	totp := sp.templates["totp-send.html"]
 	totp.Execute(w, paramMap)
@@ -91,7 +132,7 @@ func (sp *Sparrow) verifyPassword(w http.ResponseWriter, r *http.Request) {
 
 	username := r.Form.Get("username")
 	if !af.VerifiedPassword() {
-		username, domain = sp.splitUsernameAndDomain(username)
+		username, domain = sp.splitUsernameAndDomain(username, r)
 		prv = sp.providers[domain]
 	} else {
 		prv = sp.dcPrvMap[af.DomainCode]
@@ -111,6 +152,15 @@ func (sp *Sparrow) verifyPassword(w http.ResponseWriter, r *http.Request) {
 
 		ar := base.AuthRequest{Username: username, Password: password, ClientIP: utils.GetRemoteAddr(r)}
 		lr := prv.Authenticate(ar)
+		// step-up to TOTP when requested by the client, the users who haven't set up TOTP are asked to register it
+		if lr.Status == base.LOGIN_SUCCESS && af.FromOauth() && oauth.RequiredAcr(paramMap["acr_values"]) == oauth.ACR_TOTP {
+			if lr.User.IsTfaSetupComplete() {
+				lr.Status = base.LOGIN_TFA_REQUIRED
+			} else {
+				lr.Status = base.LOGIN_TFA_REGISTER
+			}
+		}
+
 		if lr.Status == base.LOGIN_FAILED {
 			login := sp.templates["login.html"]
 			login.Execute(w, paramMap)
@@ -187,11 +237,13 @@ func (sp *Sparrow) verifyPassword(w http.ResponseWriter, r *http.Request) {
 			return
 		} else if lr.Status == base.LOGIN_SUCCESS {
 			af.SetTfaRequired(false)
+			af.SetTfaVerified(true)
 			setAuthFlow(sp, af, w)
 			af.markLoginSuccessful()
 		} else if lr.Status == base.LOGIN_CHANGE_PASSWORD {
 			af.SetChangePassword(true)
 			af.SetTfaRequired(false) // otp has been validated earlier, so not required again
+			af.SetTfaVerified(true)
 			setAuthFlow(sp, af, w)
 			showChangePasswordPage(sp, w, paramMap)
 			return
@@ -210,7 +262,9 @@ func (sp *Sparrow) verifyConsent(w http.ResponseWriter, r *http.Request) {
 		if af.isLoginSuccessful() {
 			r.ParseForm()
 			consent := r.Form.Get("consent")
-			if consent == "authorize" {
+			if af.FromDevice() {
+				sp.decideDeviceGrant(w, r, af, consent == "authorize")
+			} else if consent == "authorize" {
 				log.Debugf("sending final response in oauth flow")
 				sendFinalResponse(sp, w, r, nil, af)
 			} else {
@@ -285,46 +339,43 @@ func sendFinalResponse(sp *Sparrow, w http.ResponseWriter, r *http.Request, sess
 		return
 	}
 
-	// send code to the redirect URI
-	tmpUri := cl.Oauth.RedUri
-	if cl.Oauth.HasQueryInUri {
-		tmpUri += "&"
-	} else {
-		tmpUri += "?"
-	}
+	// the scopes which are not allowed are dropped, section 3.3 of RFC 6749
+	areq.Scopes = pr.GrantScopes(cl, areq.Scopes)
 
-	cType := OAuth2
-	if _, ok := areq.Scopes["openid"]; ok {
-		cType = OIDC
+	if areq.IsImplicitOrHybrid() && cl.Oauth.DisableImplicit {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Client is not allowed to use the response_type " + areq.RespType
+		log.Debugf(ep.Desc)
+		ep.Err = oauth.ERR_UNAUTHORIZED_CLIENT
+		ep.State = areq.State
+		sendOauthError(w, r, areq.RedUri, ep)
+		return
 	}
 
-	// check the response_type
-	// supported types are "code", "id_token" and "code id_token"
+	hasCode := areq.HasRespType("code")
+	hasToken := areq.HasRespType("token")
+	hasIdToken := areq.HasRespType("id_token")
 
-	hasCode := false
-	if areq.RespType == "code" || strings.HasPrefix(areq.RespType, "code ") {
-		ttl := time.Now()
-		var userId string
-		var domainCode string
-
-		if af != nil {
-			userId = af.UserId
-			domainCode = af.DomainCode
-		} else {
-			// can happen when there is a redirect for consent
-			if session == nil {
-				session = getSessionUsingCookie(r, sp)
-			}
-
-			userId = session.Sub
-			domainCode = sp.providers[session.Domain].DomainCode()
+	var pc *pkceChallenge
+	if hasCode {
+		pc, err = parsePkceChallenge(areq, cl)
+		if err != nil {
+			ep := &oauth.ErrorResp{}
+			ep.Desc = err.Error()
+			log.Debugf(ep.Desc)
+			ep.Err = oauth.ERR_INVALID_REQUEST
+			ep.State = areq.State
+			sendOauthError(w, r, areq.RedUri, ep)
+			return
 		}
-		code := newOauthCode(cl, ttl, userId, domainCode, cType)
-		tmpUri += ("code=" + url.QueryEscape(code))
-		hasCode = true
 	}
 
-	if !hasCode && cType == OAuth2 {
+	cType := OAuth2
+	if areq.Scopes.Has(oauth.SCOPE_OPENID) {
+		cType = OIDC
+	}
+
+	if hasIdToken && cType == OAuth2 {
 		ep := &oauth.ErrorResp{}
 		ep.Desc = "Invalid response type for non-OpenIdConnect request" + areq.RespType
 		ep.Err = oauth.ERR_INVALID_REQUEST
@@ -338,31 +389,110 @@ func sendFinalResponse(sp *Sparrow, w http.ResponseWriter, r *http.Request, sess
 		session = getSessionUsingCookie(r, sp)
 	}
 
-	if areq.RespType == "id_token" || strings.HasSuffix(areq.RespType, " id_token") {
-		// create RbacSession and then generate ID Token
-		idt := createIdToken(sp, session, cl, pr)
+	// the user must log in, section 3.1.2.6 of OpenID Connect core. A user who
+	// just logged in, i.e. the authflow is present, need not log in again
+	if af == nil && (session == nil || mustReauthenticate(areq, session)) {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "User must log in"
+		log.Debugf(ep.Desc)
+		ep.Err = oauth.ERR_LOGIN_REQUIRED
+		ep.State = areq.State
+		sendOauthError(w, r, areq.RedUri, ep)
+		return
+	}
+
+	userId := ""
+	if af != nil {
+		userId = af.UserId
+	} else {
+		userId = session.Sub
+	}
+
+	// the tokens are issued using the SSO session, which may not be found if the user
+	// logged in to a domain other than the one of the client
+	if (hasToken || hasIdToken) && (session == nil || session.Sub != userId) {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "No session found of the logged in user"
+		log.Debugf(ep.Desc)
+		ep.Err = oauth.ERR_LOGIN_REQUIRED
+		ep.State = areq.State
+		sendOauthError(w, r, areq.RedUri, ep)
+		return
+	}
+
+	params := url.Values{}
+	code := ""
+	if hasCode {
+		ttl := time.Now()
+		var domainCode string
+		if af != nil {
+			domainCode = af.DomainCode
+		} else {
+			domainCode = sp.providers[session.Domain].DomainCode()
+		}
+
+		// the SSO session is created on login, it carries the authentication details even when the authflow is present
+		var authTime int64
+		var amr []string
+		if session != nil {
+			authTime = session.AuthTime
+			amr = session.Amr
+		}
+		code = newOauthCode(cl, ttl, userId, domainCode, cType, pc, areq.Scopes.String(), authTime, amr)
+		params.Set("code", code)
+	}
+
+	acToken := ""
+	if hasToken {
+		// the implicit flow, section 4.2 of RFC 6749. Refresh tokens are not issued
+		acSession, err := pr.GenSessionForUserId(userId)
+		if err != nil {
+			ep := &oauth.ErrorResp{}
+			ep.Desc = "Failed to generate token - " + err.Error()
+			ep.Err = oauth.ERR_SERVER_ERROR
+			ep.State = areq.State
+			sendOauthError(w, r, areq.RedUri, ep)
+			return
+		}
+		acSession.Ito = cl.Id
+		pr.NarrowSession(acSession, areq.Scopes)
+
+		err = pr.StoreOauthSession(acSession)
+		if err != nil {
+			sendOauthError(w, r, areq.RedUri, storeTokenError(err, areq.State))
+			return
+		}
+
+		acToken = acSession.Jti
+		params.Set("access_token", acToken)
+		params.Set("token_type", "Bearer")
+		params.Set("expires_in", strconv.FormatInt(acSession.Exp-acSession.Iat, 10))
+		params.Set("scope", acSession.Scope)
+	}
+
+	if hasIdToken {
+		sk := pr.SigningKey()
+		idt := createIdToken(sp, r, session, cl, pr, areq.Scopes)
 		idt["nonce"] = areq.Nonce
-		strIdt := oauth.ToJwt(idt, sp.srvConf.PrivKey)
 		if hasCode {
-			tmpUri += "&"
+			idt["c_hash"] = oauth.HalfHash(code, sk.Alg)
+		}
+		if hasToken {
+			idt["at_hash"] = oauth.HalfHash(acToken, sk.Alg)
 		}
 
-		tmpUri += ("id_token=" + url.QueryEscape(strIdt))
+		params.Set("id_token", oauth.ToJwt(idt, sk))
 	}
 
-	state := r.Form.Get("state")
-
-	if len(state) > 0 {
-		tmpUri += "&state=" + state
+	if len(areq.State) > 0 {
+		params.Set("state", areq.State)
 	}
 
-	log.Debugf("redirecting to the client with response")
+	log.Debugf("sending the authorization response to the client")
 
 	// delete the authflow cookie
 	setAuthFlow(sp, nil, w)
-	headers := w.Header()
-	headers.Add("Cache-Control", "no-cache")
-	http.Redirect(w, r, tmpUri, http.StatusFound)
+	sendAuthzResp(sp, w, r, cl, areq.RespMode(), params)
 
 	// ignore the received redirect URI
 	/*
@@ -377,7 +507,8 @@ func sendFinalResponse(sp *Sparrow, w http.ResponseWriter, r *http.Request, sess
 	*/
 }
 
-func createIdToken(sp *Sparrow, session *base.RbacSession, cl *oauth.Client, pr *provider.Provider) jwt.MapClaims {
+// Creates the claims of the ID token, only the claims of the granted scopes are included
+func createIdToken(sp *Sparrow, r *http.Request, session *base.RbacSession, cl *oauth.Client, pr *provider.Provider, granted oauth.ScopeSet) jwt.MapClaims {
 	idt := jwt.MapClaims{}
 
 	user, err := pr.GetUserById(session.Sub)
@@ -387,7 +518,9 @@ func createIdToken(sp *Sparrow, session *base.RbacSession, cl *oauth.Client, pr
 	}
 
 	for _, ssoAt := range cl.Oauth.Attributes {
-		ssoAt.GetValueInto(user, idt)
+		if pr.IsClaimReleased(ssoAt.Name, granted) {
+			ssoAt.GetValueInto(user, idt)
+		}
 	}
 
 	idt["aud"] = cl.Id
@@ -395,7 +528,7 @@ func createIdToken(sp *Sparrow, session *base.RbacSession, cl *oauth.Client, pr
 	iat := time.Now().Unix()
 	idt["iat"] = iat
 	idt["exp"] = iat + cl.Oauth.TokenValidity
-	idt["iss"] = sp.homeUrl + "/" + session.Domain
+	idt["iss"] = sp.baseUrl(r) + "/" + session.Domain
 	idt["jti"] = utils.NewRandShaStr()
 	// if sub is not already filled with custom attribute config
 	// fill it with the default value
@@ -403,15 +536,42 @@ func createIdToken(sp *Sparrow, session *base.RbacSession, cl *oauth.Client, pr
 		idt["sub"] = session.Sub
 	}
 
-	// the below claims are not supported yet
-	// and deleting them as a defense against spoofing them using app attribute configuration
+	// the below claim is not supported yet
+	// and deleting it as a defense against spoofing it using app attribute configuration
+	delete(idt, "azp")
+
+	// the authentication details are set only if known, they are not known for
+	// the sessions refreshed using the refresh tokens issued by the older versions
+	delete(idt, "auth_time")
 	delete(idt, "acr")
 	delete(idt, "amr")
-	delete(idt, "azp")
+	if session.AuthTime != 0 {
+		idt["auth_time"] = session.AuthTime
+	}
+	if len(session.Amr) != 0 {
+		idt["amr"] = session.Amr
+		idt["acr"] = oauth.AcrOf(session.Amr)
+	}
 
 	return idt
 }
 
+// Returns true if the SSO session cannot be used for serving the authorization request. The user must
+// log in again if asked by the client, or if the session is older than the max_age or doesn't satisfy
+// the requested ACR.
+func mustReauthenticate(areq *oauth.AuthorizationReq, session *base.RbacSession) bool {
+	if areq.HasPrompt(oauth.PROMPT_LOGIN) {
+		return true
+	}
+
+	maxAge := areq.MaxAgeSecs()
+	if maxAge >= 0 && time.Now().Unix()-session.AuthTime > maxAge {
+		return true
+	}
+
+	return !oauth.SatisfiesAcr(session.Amr, oauth.RequiredAcr(areq.AcrValues))
+}
+
 func getSessionUsingCookie(r *http.Request, sp *Sparrow) *base.RbacSession {
 	ssoCookie, _ := r.Cookie(SSO_COOKIE)
 
@@ -434,26 +594,18 @@ func getSessionUsingCookie(r *http.Request, sp *Sparrow) *base.RbacSession {
 func isValidAuthzReq(w http.ResponseWriter, r *http.Request, areq *oauth.AuthorizationReq) bool {
 	log.Debugf("Validating authorization request")
 
-	errStr := ""
-	if areq.RespType == "" {
-		errStr = "No response_type parameter is present. "
-	}
-
-	if (areq.RespType != "code") && (areq.RespType != "code id_token") && (areq.RespType != "id_token") {
-		errStr = "Unsupported response type " + areq.RespType + ". Only 'code', 'code id_token' and 'id_token' are supported. "
-	}
-
-	if areq.RespType == "" {
-		errStr += "No client_id parameter is present. "
+	ep := oauth.ValidateAuthReq(areq)
+	if ep == nil && len(areq.Scopes.String()) > oauth.MAX_SCOPE_LEN {
+		ep = &oauth.ErrorResp{State: areq.State}
+		ep.Desc = "Too many scopes are present"
+		ep.Err = oauth.ERR_INVALID_REQUEST
 	}
 
-	if len(errStr) == 0 {
+	if ep == nil {
 		return true
 	}
 
-	ep := &oauth.ErrorResp{}
-	ep.Desc = errStr
-	ep.Err = oauth.ERR_INVALID_REQUEST
+	log.Debugf(ep.Desc)
 	sendOauthError(w, r, areq.RedUri, ep)
 
 	return false
@@ -475,8 +627,19 @@ func redirectToUrl(sp *Sparrow, af *authFlow, prv *provider.Provider, w http.Res
 		return
 	}
 
-	if af.FromOauth() || af.FromSaml() {
-		log.Debugf("oauth/saml workflow")
+	// the login must satisfy the ACR requested by the client, e.g. a security key must be used
+	if af.FromOauth() && !oauth.SatisfiesAcr(af.Amr(), oauth.RequiredAcr(paramMap["acr_values"])) {
+		log.Debugf("login of the user %s does not satisfy the requested acr_values", af.UserId)
+		retry := &authFlow{}
+		retry.SetFromOauth(true)
+		setAuthFlow(sp, retry, w)
+		login := sp.templates["login.html"]
+		login.Execute(w, paramMap)
+		return
+	}
+
+	if af.FromOauth() || af.FromSaml() || af.FromDevice() {
+		log.Debugf("oauth/saml/device workflow")
 		setSessionCookie(sp, user, af, prv, w, r, paramMap)
 		return
 	} else {
@@ -499,16 +662,17 @@ func redirectToUrl(sp *Sparrow, af *authFlow, prv *provider.Provider, w http.Res
 
 func setSessionCookie(sp *Sparrow, user *base.Resource, af *authFlow, prv *provider.Provider, w http.ResponseWriter, r *http.Request, paramMap map[string]string) *base.RbacSession {
 	session := prv.GenSessionForUser(user)
+	session.AuthTime = session.Iat
+	session.Amr = af.Amr()
 	prv.StoreSsoSession(session)
 
 	setSsoCookie(prv, session, w)
 
-	if af.FromOauth() {
+	if af.FromOauth() || af.FromDevice() {
 		log.Debugf("sending oauth request for consent")
 		// FIXME show consent only if application/client config enforces it
 		setAuthFlow(sp, af, w)
-		consentTmpl := sp.templates["consent.html"]
-		consentTmpl.Execute(w, paramMap)
+		showConsentPage(sp, w, prv, paramMap)
 		return session
 	} else if af.FromSaml() {
 		log.Debugf("resuming SAML flow")
@@ -525,6 +689,24 @@ func setSessionCookie(sp *Sparrow, user *base.Resource, af *authFlow, prv *provi
 	return session
 }
 
+// the data of the consent page, Params are sent back as hidden fields
+type consentPage struct {
+	ClientName string
+	Scopes     []*conf.ScopeConfig // the scopes that will be granted to the client
+	Params     map[string]string
+}
+
+func newConsentPage(prv *provider.Provider, paramMap map[string]string) *consentPage {
+	cp := &consentPage{Params: paramMap}
+	cl := prv.GetClientById(paramMap["client_id"])
+	if cl != nil {
+		cp.ClientName = cl.Name
+		cp.Scopes = prv.ScopeDefs(prv.GrantScopes(cl, oauth.ParseScope(paramMap["scope"])))
+	}
+
+	return cp
+}
+
 func (sp *Sparrow) handleChangePasswordReq(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	paramMap := copyParams(r)
@@ -588,10 +770,26 @@ func setSsoCookie(pr *provider.Provider, session *base.RbacSession, w http.Respo
 
 }
 
-func (sp *Sparrow) splitUsernameAndDomain(username string) (string, string) {
+func (sp *Sparrow) splitUsernameAndDomain(username string, r *http.Request) (string, string) {
 	pos := strings.LastIndexByte(username, '@')
 	unameLen := len(username) - 1
-	domain := sp.srvConf.DefaultDomain
+
+	// a host mapped to a domain always wins, a different domain in
+	// the username is ignored and treated as a part of the name
+	domain := sp.domainOfHost(r)
+	if len(domain) != 0 {
+		if pos > 0 && strings.ToLower(username[pos+1:]) == domain {
+			username = username[:pos]
+		}
+		return username, domain
+	}
+
+	if af := getAuthFlow(r, sp); af != nil && sp.dcPrvMap[af.DomainCode] != nil {
+		domain = sp.dcPrvMap[af.DomainCode].Name
+	}
+	if len(domain) == 0 {
+		domain = sp.srvConf.DefaultDomain
+	}
 	if pos > 0 && pos != unameLen {
 		domain = strings.ToLower(username[pos+1:])
 		username = username[:pos]
@@ -610,9 +808,13 @@ func (sp *Sparrow) redirectAfterAuth(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	samlReq := r.Form.Get("SAMLRequest")
 
+	af := getAuthFlow(r, sp)
 	if samlReq != "" {
 		log.Debugf("resuming SAML flow after authentication")
 		sp.handleSamlReq(w, r)
+	} else if af != nil && af.FromOauth() && af.isLoginSuccessful() {
+		log.Debugf("resuming oauth flow after authentication, sending oauth request for consent")
+		showConsentPage(sp, w, sp.dcPrvMap[af.DomainCode], copyParams(r))
 	} else {
 		setAuthFlow(sp, nil, w)
 		http.Redirect(w, r, "/ui", http.StatusFound)
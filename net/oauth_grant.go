@@ -8,10 +8,13 @@ import (
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/hex"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"sparrow/oauth"
 	"sparrow/utils"
+	"strings"
 	"time"
 )
 
@@ -38,12 +41,43 @@ type oAuthGrant struct {
 	DomainCode string // first 8 chars of domain name's SHA256 hash
 	CreatedAt  int64
 	CType      CodeType
+	Pkce       *pkceChallenge // nil if the client did not send a code challenge
+	Scope      string         // the space separated list of granted scopes
+	AuthTime   int64          // the time when the user was authenticated
+	Amr        []string       // the methods used for authenticating the user
 }
 
-func newOauthCode(cl *oauth.Client, createdAt time.Time, userId string, domainCode string, ctype CodeType) string {
+const (
+	pkce_plain uint8 = iota + 1
+	pkce_s256
+)
+
+// the code challenge of RFC 7636 bound to an authorization grant. The SHA-256 hash of
+// the code verifier is stored for both the methods, for the plain method it is computed
+// from the received challenge
+type pkceChallenge struct {
+	Method uint8
+	Hash   []byte
+}
+
+// the authentication methods in the order of their bits in the code
+var amrBits = []string{oauth.AMR_PWD, oauth.AMR_OTP, oauth.AMR_HWK}
+
+// the offset of the authentication time in the encrypted part of the code, followed by the bits of the authentication methods
+const authTimeOffset int = 36 + 8 + 8 + 1 + 1 + sha256.Size
+
+// the offset of the granted scopes in the encrypted part of the code, the scopes are prefixed with their length
+const scopeOffset int = authTimeOffset + 8 + 1 + 2
+
+func newOauthCode(cl *oauth.Client, createdAt time.Time, userId string, domainCode string, ctype CodeType, pc *pkceChallenge, scope string, authTime int64, amr []string) string {
 	iv := utils.RandBytes(aes.BlockSize)
 
-	dataLen := macLen + aes.BlockSize + 36 + 8 + 8 + 1 + 11 // the last 11 are filler bytes to satisfy the block size requirement
+	// the remaining bytes after the scopes are filler bytes to satisfy the block size requirement
+	encLen := scopeOffset + len(scope)
+	if rem := encLen % aes.BlockSize; rem != 0 {
+		encLen += aes.BlockSize - rem
+	}
+	dataLen := macLen + aes.BlockSize + encLen
 
 	dst := make([]byte, dataLen)
 	copy(dst[macLen:], iv)
@@ -51,6 +85,14 @@ func newOauthCode(cl *oauth.Client, createdAt time.Time, userId string, domainCo
 	copy(dst[macLen+aes.BlockSize+36:], []byte(domainCode))
 	copy(dst[macLen+aes.BlockSize+36+8:], utils.Itob(createdAt.Unix()))
 	dst[macLen+aes.BlockSize+36+8+8] = byte(ctype)
+	if pc != nil {
+		dst[macLen+aes.BlockSize+36+8+8+1] = pc.Method
+		copy(dst[macLen+aes.BlockSize+36+8+8+1+1:], pc.Hash)
+	}
+	copy(dst[macLen+aes.BlockSize+authTimeOffset:], utils.Itob(authTime))
+	dst[macLen+aes.BlockSize+authTimeOffset+8] = encodeAmr(amr)
+	binary.BigEndian.PutUint16(dst[macLen+aes.BlockSize+scopeOffset-2:], uint16(len(scope)))
+	copy(dst[macLen+aes.BlockSize+scopeOffset:], []byte(scope))
 	// leave the rest of the data as 0s
 
 	block, _ := aes.NewCipher(cl.Oauth.ServerSecret)
@@ -58,22 +100,7 @@ func newOauthCode(cl *oauth.Client, createdAt time.Time, userId string, domainCo
 
 	cbc.CryptBlocks(dst[macLen+aes.BlockSize:], dst[macLen+aes.BlockSize:])
 
-	// generate a new key using ServerSecret and Secret
-	hmacKeySrc := make([]byte, 0)
-	// secret is stored in hex form
-	secretBytes, err := hex.DecodeString(cl.Oauth.Secret)
-	if err != nil {
-		msg := fmt.Sprintf("Decoding hex value of OAuth secret of client %s failed", cl.Id)
-		log.Criticalf(msg)
-		panic(msg)
-	}
-
-	hmacKeySrc = append(hmacKeySrc, secretBytes...)
-	hmacKeySrc = append(hmacKeySrc, cl.Oauth.ServerSecret...)
-
-	hmacKey := sha256.Sum256(hmacKeySrc)
-
-	hmacCalc := hmac.New(sha256.New, hmacKey[:])
+	hmacCalc := hmac.New(sha256.New, codeHmacKey(cl))
 	hmacCalc.Write(dst[macLen:])
 	mac := hmacCalc.Sum(nil)
 
@@ -81,13 +108,20 @@ func newOauthCode(cl *oauth.Client, createdAt time.Time, userId string, domainCo
 	return utils.B64UrlEncode(dst)
 }
 
+// Derives the key of the HMAC of the codes from the ServerSecret of the client. The client's secret is
+// not used as only its hash is stored, and the codes must remain valid while the secret is rotated.
+func codeHmacKey(cl *oauth.Client) []byte {
+	hmacKey := sha256.Sum256(cl.Oauth.ServerSecret)
+	return hmacKey[:]
+}
+
 func decryptOauthCode(code string, cl *oauth.Client) *oAuthGrant {
 	data, err := utils.B64UrlDecode(code)
 	if err != nil {
 		return nil
 	}
 
-	if len(data) != 112 {
+	if len(data) < 144 || (len(data)-macLen)%aes.BlockSize != 0 {
 		//AUDIT
 		log.Debugf("Invalid authorization code received, insufficent bytes")
 		return nil
@@ -96,15 +130,7 @@ func decryptOauthCode(code string, cl *oauth.Client) *oAuthGrant {
 	expectedMac := data[:macLen]
 
 	// verify HMAC first
-	// generate a new key using ServerSecret and Secret
-	hmacKeySrc := make([]byte, 0)
-	secretBytes, _ := hex.DecodeString(cl.Oauth.Secret) // safe to ignore error if the secret is incorrect code wouldn't have been issued
-	hmacKeySrc = append(hmacKeySrc, secretBytes...)
-	hmacKeySrc = append(hmacKeySrc, cl.Oauth.ServerSecret...)
-
-	hmacKey := sha256.Sum256(hmacKeySrc)
-
-	hmacCalc := hmac.New(sha256.New, hmacKey[:])
+	hmacCalc := hmac.New(sha256.New, codeHmacKey(cl))
 	hmacCalc.Write(data[macLen:])
 	mac := hmacCalc.Sum(nil)
 
@@ -129,7 +155,105 @@ func decryptOauthCode(code string, cl *oauth.Client) *oAuthGrant {
 	ac.DomainCode = string(dst[36:44])
 	ac.CreatedAt = utils.Btoi(dst[44:52])
 	ac.CType = CodeType(dst[52])
-	// leave the remaining 15 bytes
+	if dst[53] != 0 {
+		ac.Pkce = &pkceChallenge{Method: dst[53], Hash: dst[54 : 54+sha256.Size]}
+	}
+	ac.AuthTime = utils.Btoi(dst[authTimeOffset : authTimeOffset+8])
+	ac.Amr = decodeAmr(dst[authTimeOffset+8])
+	scopeLen := int(binary.BigEndian.Uint16(dst[scopeOffset-2:]))
+	if scopeOffset+scopeLen > len(dst) {
+		log.Debugf("Invalid authorization code received, invalid length of scopes")
+		return nil
+	}
+	ac.Scope = string(dst[scopeOffset : scopeOffset+scopeLen])
+	// leave the filler bytes
 
 	return ac
 }
+
+func encodeAmr(amr []string) uint8 {
+	var bits uint8
+	for _, m := range amr {
+		for i, v := range amrBits {
+			if m == v {
+				bits |= 1 << uint(i)
+			}
+		}
+	}
+
+	return bits
+}
+
+func decodeAmr(bits uint8) []string {
+	var amr []string
+	for i, v := range amrBits {
+		if bits&(1<<uint(i)) != 0 {
+			amr = append(amr, v)
+		}
+	}
+
+	return amr
+}
+
+// Parses the code challenge sent in the authorization request, a nil challenge is returned
+// if the request has no challenge
+func parsePkceChallenge(areq *oauth.AuthorizationReq, cl *oauth.Client) (pc *pkceChallenge, err error) {
+	if len(areq.CodeChallenge) == 0 {
+		if cl.Oauth.RequirePkce || cl.Oauth.Public {
+			return nil, fmt.Errorf("code_challenge is required")
+		}
+		return nil, nil
+	}
+
+	if !isValidPkceString(areq.CodeChallenge) {
+		return nil, fmt.Errorf("invalid code_challenge")
+	}
+
+	switch areq.CodeChallengeMethod {
+	case "S256":
+		// the challenge is encoded without padding
+		hash, err := base64.RawURLEncoding.DecodeString(areq.CodeChallenge)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid S256 code_challenge")
+		}
+		pc = &pkceChallenge{Method: pkce_s256, Hash: hash}
+
+	case "", "plain": // plain is the default method
+		if !cl.Oauth.AllowPlainPkce {
+			return nil, fmt.Errorf("plain code_challenge_method is not allowed")
+		}
+		hash := sha256.Sum256([]byte(areq.CodeChallenge))
+		pc = &pkceChallenge{Method: pkce_plain, Hash: hash[:]}
+
+	default:
+		return nil, fmt.Errorf("unsupported code_challenge_method %s", areq.CodeChallengeMethod)
+	}
+
+	return pc, nil
+}
+
+// Verifies the code verifier sent in the access token request against the challenge
+func (pc *pkceChallenge) verify(verifier string) bool {
+	if !isValidPkceString(verifier) {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare(hash[:], pc.Hash) == 1
+}
+
+// checks the length and characters of the code verifier or challenge as defined in section 4.1 of RFC 7636
+func isValidPkceString(val string) bool {
+	if len(val) < 43 || len(val) > 128 {
+		return false
+	}
+
+	for _, c := range val {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && !strings.ContainsRune("-._~", c) {
+			return false
+		}
+	}
+
+	return true
+}
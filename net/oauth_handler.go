@@ -8,7 +8,9 @@ import (
 	"encoding/gob"
 	"net/http"
 	"net/url"
+	"sparrow/base"
 	"sparrow/oauth"
+	"sparrow/provider"
 	"sparrow/utils"
 	"strings"
 	"time"
@@ -29,7 +31,9 @@ const (
 	from_saml
 	register_tfa
 	change_password
-	login_complete // flag when set indicates that login is verified including all factors
+	login_complete    // flag when set indicates that login is verified including all factors
+	from_device       // flag to indicate that the user is approving a device grant
+	verified_webauthn // flag to indicate that the user logged in using a security key
 )
 
 type authFlow struct {
@@ -39,6 +43,7 @@ type authFlow struct {
 	TotpSecret      string // the TOTP 2F secret
 	PasswdFailCount uint8
 	OtpFailCount    uint8
+	UserCode        string // the user code of the device grant being approved
 }
 
 func (af *authFlow) setBit(bit uint16, yes bool) {
@@ -77,6 +82,31 @@ func (af *authFlow) SetTfaRequired(yes bool) {
 	af.setBit(required_tfa, yes)
 }
 
+func (af *authFlow) VerifiedWebauthn() bool {
+	return af.isSet(verified_webauthn)
+}
+
+func (af *authFlow) SetWebauthnVerified(yes bool) {
+	af.setBit(verified_webauthn, yes)
+}
+
+// Returns the methods, RFC 8176, used for authenticating the user
+func (af *authFlow) Amr() []string {
+	if af.VerifiedWebauthn() {
+		return []string{oauth.AMR_HWK}
+	}
+
+	var amr []string
+	if af.VerifiedPassword() {
+		amr = append(amr, oauth.AMR_PWD)
+	}
+	if af.VerifiedTfa() {
+		amr = append(amr, oauth.AMR_OTP)
+	}
+
+	return amr
+}
+
 func (af *authFlow) RegisterTfa() bool {
 	return af.isSet(register_tfa)
 }
@@ -104,6 +134,14 @@ func (af *authFlow) SetFromSaml(yes bool) {
 	af.setBit(from_saml, yes)
 }
 
+func (af *authFlow) FromDevice() bool {
+	return af.isSet(from_device)
+}
+
+func (af *authFlow) SetFromDevice(yes bool) {
+	af.setBit(from_device, yes)
+}
+
 func (af *authFlow) SetChangePassword(yes bool) {
 	af.setBit(change_password, yes)
 }
@@ -136,60 +174,24 @@ func (sp *Sparrow) sendToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authzHeader := r.Header.Get("Authorization")
-	if len(authzHeader) != 0 {
-		pos := strings.Index(authzHeader, BASIC_AUTHZ_PREFIX)
-		if pos != 0 {
-			ep := &oauth.ErrorResp{}
-			ep.Desc = "Unsupported authorization type, only Basic is supported"
-			ep.Err = oauth.ERR_INVALID_REQUEST
-			sendOauthError(w, r, "", ep)
-			return
-		}
-
-		decodedSecret, err := utils.B64Decode(authzHeader[len(BASIC_AUTHZ_PREFIX):])
-		if err != nil {
-			ep := &oauth.ErrorResp{}
-			ep.Desc = "Failed to decode authorization header"
-			ep.Err = oauth.ERR_INVALID_REQUEST
-			sendOauthError(w, r, "", ep)
-			return
-		}
-
-		idSecretPair := string(decodedSecret)
-		tokens := strings.Split(idSecretPair, ":")
-		if len(tokens) != 2 {
-			ep := &oauth.ErrorResp{}
-			ep.Desc = "Invalid authorization header"
-			ep.Err = oauth.ERR_INVALID_REQUEST
-			sendOauthError(w, r, "", ep)
-			return
-		}
-
-		atr.ClientId = tokens[0]
-		atr.Secret = tokens[1]
+	cl, pr, ep := authenticateClient(r, sp, atr.ClientId, atr.Secret)
+	if ep != nil {
+		sendOauthError(w, r, "", ep)
+		return
 	}
 
-	invalidCreds := &oauth.ErrorResp{}
-	invalidCreds.Desc = "Invalid client ID or secret"
-	invalidCreds.Err = oauth.ERR_INVALID_REQUEST
-
-	var cl *oauth.Client
-
-	pr, _ := getPrFromParam(r, sp)
-	if pr != nil {
-		cl = pr.GetClientById(atr.ClientId)
+	if atr.GrantType == oauth.REFRESH_TOKEN {
+		sp.refreshAccessToken(w, r, atr, cl, pr)
+		return
 	}
 
-	if cl == nil {
-		log.Debugf("Client not found with the id %s", atr.ClientId)
-		sendOauthError(w, r, "", invalidCreds)
+	if atr.GrantType == oauth.CLIENT_CRED {
+		sp.sendClientToken(w, r, atr, cl, pr)
 		return
 	}
 
-	if atr.Secret != cl.Oauth.Secret {
-		log.Debugf("Invalid secret of the client %s [%s != %s]", atr.ClientId, atr.Secret, cl.Oauth.Secret)
-		sendOauthError(w, r, "", invalidCreds)
+	if atr.GrantType == oauth.DEVICE_CODE {
+		sp.sendDeviceToken(w, r, atr, cl, pr)
 		return
 	}
 
@@ -242,6 +244,23 @@ func (sp *Sparrow) sendToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ac.Pkce != nil {
+		if !ac.Pkce.verify(atr.CodeVerifier) {
+			ep := &oauth.ErrorResp{}
+			ep.Desc = "Invalid code_verifier"
+			ep.Err = oauth.ERR_INVALID_GRANT
+			sendOauthError(w, r, "", ep)
+			return
+		}
+	} else if len(atr.CodeVerifier) != 0 || cl.Oauth.Public {
+		// section 4.5 of RFC 7636, the code was issued without a challenge
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Invalid code, it was not issued with a code_challenge"
+		ep.Err = oauth.ERR_INVALID_GRANT
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
 	go pr.StoreGrantCodeId(ac.CreatedAt, ac.IvAsId)
 
 	session, err := prv.GenSessionForUserId(ac.UserId)
@@ -252,20 +271,147 @@ func (sp *Sparrow) sendToken(w http.ResponseWriter, r *http.Request) {
 		sendOauthError(w, r, "", ep)
 		return
 	}
+	session.Ito = cl.Id
+	session.AuthTime = ac.AuthTime
+	session.Amr = ac.Amr
+	granted := oauth.ParseScope(ac.Scope)
+	prv.NarrowSession(session, granted)
 
-	prv.StoreOauthSession(session)
+	err = prv.StoreOauthSession(session)
+	if err != nil {
+		sendOauthError(w, r, "", storeTokenError(err, ""))
+		return
+	}
 
 	tresp := &oauth.AccessTokenResp{}
 	tresp.AcToken = session.Jti
 	//tresp.ExpiresIn = session.Exp // will be same as the Exp value present in token
 	tresp.TokenType = "Bearer"
+	tresp.Scope = session.Scope
 
 	if ac.CType == OIDC {
-		idt := createIdToken(sp, session, cl, pr)
-		strIdt := oauth.ToJwt(idt, sp.srvConf.PrivKey)
+		idt := createIdToken(sp, r, session, cl, pr, granted)
+		strIdt := oauth.ToJwt(idt, pr.SigningKey())
 		tresp.IdToken = strIdt
 	}
 
+	if cl.Oauth.RefreshTokenValidity > 0 {
+		rt := oauth.NewRefreshToken(cl, session.Sub, session.Jti, ac.CType == OIDC)
+		rt.Scope = ac.Scope
+		rt.AuthTime = ac.AuthTime
+		rt.Amr = ac.Amr
+		pr.StoreRefreshToken(rt)
+		tresp.RefreshToken = rt.Id
+	}
+
+	writeTokenResp(w, tresp)
+}
+
+// Exchanges a refresh token for a new access token and a new refresh token, section 6 of RFC 6749.
+// The used refresh token can never be used again, reusing it revokes all the tokens of its family.
+func (sp *Sparrow) refreshAccessToken(w http.ResponseWriter, r *http.Request, atr *oauth.AccessTokenReq, cl *oauth.Client, pr *provider.Provider) {
+	invalidGrant := &oauth.ErrorResp{}
+	invalidGrant.Desc = "Invalid refresh token"
+	invalidGrant.Err = oauth.ERR_INVALID_GRANT
+
+	if cl.Oauth.RefreshTokenValidity <= 0 {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Client is not allowed to use refresh tokens"
+		ep.Err = oauth.ERR_UNAUTHORIZED_CLIENT
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	rt, reused := pr.UseRefreshToken(atr.RefreshToken, cl.Id)
+	if rt == nil {
+		log.Debugf("refresh token %s of the client %s not found", atr.RefreshToken, cl.Id)
+		sendOauthError(w, r, "", invalidGrant)
+		return
+	}
+
+	if reused {
+		log.Debugf("refresh token %s was reused, revoking all the tokens of the family %s", rt.Id, rt.FamilyId)
+		pr.RevokeRefreshTokenFamily(rt.FamilyId)
+		sendOauthError(w, r, "", invalidGrant)
+		return
+	}
+
+	if rt.IsExpired() {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Expired refresh token"
+		ep.Err = oauth.ERR_INVALID_GRANT
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	// the session is generated again to reflect the current roles of the user
+	session, err := pr.GenSessionForUserId(rt.UserId)
+	if err != nil {
+		// the user was either deleted or deactivated, none of the tokens of the family can be used anymore
+		log.Debugf("failed to generate the session of the user %s using refresh token, revoking all the tokens of the family %s [%s]", rt.UserId, rt.FamilyId, err)
+		pr.RevokeRefreshTokenFamily(rt.FamilyId)
+		sendOauthError(w, r, "", invalidGrant)
+		return
+	}
+	session.Ito = cl.Id
+	// the ID token carries the details of the original authentication
+	session.AuthTime = rt.AuthTime
+	session.Amr = rt.Amr
+	granted := oauth.ParseScope(rt.Scope)
+	pr.NarrowSession(session, granted)
+
+	err = pr.StoreOauthSession(session)
+	if err != nil {
+		sendOauthError(w, r, "", storeTokenError(err, ""))
+		return
+	}
+
+	next := rt.Next(cl, session.Jti)
+	pr.StoreRefreshToken(next)
+
+	tresp := &oauth.AccessTokenResp{}
+	tresp.AcToken = session.Jti
+	tresp.RefreshToken = next.Id
+	tresp.TokenType = "Bearer"
+	tresp.Scope = session.Scope
+
+	if rt.OpenId {
+		idt := createIdToken(sp, r, session, cl, pr, granted)
+		tresp.IdToken = oauth.ToJwt(idt, pr.SigningKey())
+	}
+
+	writeTokenResp(w, tresp)
+}
+
+// Issues an access token to the client itself, section 4.4 of RFC 6749. The session of the token
+// holds the roles assigned to the client. Neither a refresh token nor an ID token is issued.
+func (sp *Sparrow) sendClientToken(w http.ResponseWriter, r *http.Request, atr *oauth.AccessTokenReq, cl *oauth.Client, pr *provider.Provider) {
+	if cl.Oauth.Public || len(cl.ServiceGroupIds) == 0 {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Client is not allowed to use the client_credentials grant"
+		ep.Err = oauth.ERR_UNAUTHORIZED_CLIENT
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	session := pr.GenSessionForClient(cl)
+	pr.NarrowSession(session, pr.GrantScopes(cl, oauth.ParseScope(atr.Scope)))
+	err := pr.StoreOauthSession(session)
+	if err != nil {
+		sendOauthError(w, r, "", storeTokenError(err, ""))
+		return
+	}
+
+	log.Debugf("issued access token to the client %s using client credentials", cl.Id)
+	tresp := &oauth.AccessTokenResp{}
+	tresp.AcToken = session.Jti
+	tresp.TokenType = "Bearer"
+	tresp.Scope = session.Scope
+
+	writeTokenResp(w, tresp)
+}
+
+func writeTokenResp(w http.ResponseWriter, tresp *oauth.AccessTokenResp) {
 	headers := w.Header()
 	headers.Add("Cache-Control", "no-store")
 	headers.Add("Pragma", "no-cache")
@@ -273,45 +419,176 @@ func (sp *Sparrow) sendToken(w http.ResponseWriter, r *http.Request) {
 	w.Write(tresp.Serialize())
 }
 
-func sendOauthCode(sp *Sparrow, w http.ResponseWriter, r *http.Request, af *authFlow, areq *oauth.AuthorizationReq, cl *oauth.Client) {
-	tmpUri := cl.Oauth.RedUri
-	// send code to the redirect URI
-	if cl.Oauth.HasQueryInUri {
-		tmpUri += "&code="
-	} else {
-		tmpUri += "?code="
-	}
+// Sends the error of a failed client authentication to the endpoints which are not part of the code flow
+func sendClientAuthError(w http.ResponseWriter, ep *oauth.ErrorResp) {
+	w.Header().Add("WWW-Authenticate", "Basic")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(ep.Serialize())
+}
 
-	cType := OAuth2
-	if _, ok := areq.Scopes["openid"]; ok {
-		cType = OIDC
+// Records the failed client authentication in the audit log of the domain addressed by the request
+func logClientAuthFailure(sp *Sparrow, r *http.Request, operation string, ep *oauth.ErrorResp) {
+	pr, _ := getPrFromParam(r, sp)
+	if pr == nil {
+		return
 	}
 
-	ttl := time.Now()
-	code := newOauthCode(cl, ttl, af.UserId, af.DomainCode, cType)
-	tmpUri += url.QueryEscape(code)
+	clientId := r.Form.Get("client_id")
+	if id, _, ok := r.BasicAuth(); ok {
+		clientId = id
+	}
 
-	state := r.Form.Get("state")
+	pr.Al.LogClientAuthFailure(clientId, utils.GetRemoteAddr(r), operation, ep.Desc)
+}
 
-	if len(state) > 0 {
-		tmpUri += "&state=" + state
-	}
+// Authenticates the client using the credentials present in the Basic authorization header, falls back to the given
+// credentials if the header is absent. A client configured with the private_key_jwt method authenticates using a
+// signed assertion instead, RFC 7523. The secret of a public client is not verified, public clients cannot keep
+// secrets and the code verifier authenticates them while exchanging the code.
+func authenticateClient(r *http.Request, sp *Sparrow, clientId string, secret string) (cl *oauth.Client, pr *provider.Provider, ep *oauth.ErrorResp) {
+	authMethod := oauth.AUTH_METHOD_POST
+	authzHeader := r.Header.Get("Authorization")
+	if len(authzHeader) != 0 {
+		pos := strings.Index(authzHeader, BASIC_AUTHZ_PREFIX)
+		if pos != 0 {
+			ep := &oauth.ErrorResp{}
+			ep.Desc = "Unsupported authorization type, only Basic is supported"
+			ep.Err = oauth.ERR_INVALID_REQUEST
+			return nil, nil, ep
+		}
 
-	// delete the authflow cookie
-	setAuthFlow(sp, nil, w)
-	http.Redirect(w, r, tmpUri, http.StatusFound)
+		decodedSecret, err := utils.B64Decode(authzHeader[len(BASIC_AUTHZ_PREFIX):])
+		if err != nil {
+			ep := &oauth.ErrorResp{}
+			ep.Desc = "Failed to decode authorization header"
+			ep.Err = oauth.ERR_INVALID_REQUEST
+			return nil, nil, ep
+		}
 
-	// ignore the received redirect URI
-	/*
-		if cl.RedUri != areq.RedUri {
+		idSecretPair := string(decodedSecret)
+		tokens := strings.Split(idSecretPair, ":")
+		if len(tokens) != 2 {
 			ep := &oauth.ErrorResp{}
-			ep.Desc = "Mismatching redirect URI " + areq.RedUri
+			ep.Desc = "Invalid authorization header"
 			ep.Err = oauth.ERR_INVALID_REQUEST
-			ep.State = areq.State
-			sendOauthError(w, r, areq, ep)
-			return
+			return nil, nil, ep
 		}
-	*/
+
+		clientId = tokens[0]
+		secret = tokens[1]
+		authMethod = oauth.AUTH_METHOD_BASIC
+	}
+
+	assertionType := r.Form.Get("client_assertion_type")
+	assertion := r.Form.Get("client_assertion")
+	if len(assertionType) != 0 || len(assertion) != 0 {
+		ep := &oauth.ErrorResp{Err: oauth.ERR_INVALID_REQUEST}
+		if authMethod == oauth.AUTH_METHOD_BASIC {
+			ep.Desc = "Only one client authentication method can be used"
+			return nil, nil, ep
+		}
+
+		if assertionType != oauth.CLIENT_ASSERTION_TYPE_JWT || len(assertion) == 0 {
+			ep.Desc = "Unsupported client_assertion_type or missing client_assertion"
+			return nil, nil, ep
+		}
+
+		authMethod = oauth.AUTH_METHOD_PRIVATE_KEY_JWT
+		// the client_id parameter is optional, section 4.2 of RFC 7521
+		if len(clientId) == 0 {
+			clientId = oauth.AssertionSubject(assertion)
+		}
+	}
+
+	invalidCreds := &oauth.ErrorResp{}
+	invalidCreds.Desc = "Invalid client ID or secret"
+	invalidCreds.Err = oauth.ERR_INVALID_REQUEST
+
+	pr, _ = getPrFromParam(r, sp)
+	if pr != nil {
+		cl = pr.GetClientById(clientId)
+	}
+
+	if cl == nil || cl.Oauth == nil {
+		log.Debugf("Client not found with the id %s", clientId)
+		return nil, nil, invalidCreds
+	}
+
+	if cl.Oauth.Public {
+		return cl, pr, nil
+	}
+
+	if !cl.Oauth.AllowsAuthMethod(authMethod) {
+		log.Debugf("The client %s is not allowed to authenticate using the method %s", clientId, authMethod)
+		return nil, nil, invalidCreds
+	}
+
+	if authMethod == oauth.AUTH_METHOD_PRIVATE_KEY_JWT {
+		baseUrl := sp.baseUrl(r)
+		// the assertion can be addressed to the issuer, the token endpoint or the endpoint receiving it
+		audiences := []string{baseUrl + "/" + pr.Name, baseUrl + OAUTH_BASE + "/token", baseUrl + r.URL.Path}
+		jti, exp, err := oauth.VerifyClientAssertion(assertion, cl, audiences)
+		if err != nil {
+			log.Debugf("Invalid assertion of the client %s %s", clientId, err)
+			return nil, nil, invalidCreds
+		}
+
+		if !pr.UseClientAssertion(cl.Id, jti, exp) {
+			log.Debugf("The assertion %s of the client %s was replayed", jti, clientId)
+			return nil, nil, invalidCreds
+		}
+
+		return cl, pr, nil
+	}
+
+	status, exp := cl.Oauth.VerifySecret(secret, time.Now().Unix())
+	if status != oauth.SECRET_INVALID {
+		pr.WarnClientSecretExpiry(cl, utils.GetRemoteAddr(r), exp)
+	}
+
+	if status != oauth.SECRET_VALID {
+		log.Debugf("Invalid or expired secret of the client %s", clientId)
+		return nil, nil, invalidCreds
+	}
+
+	if cl.Oauth.HasPlainSecret() {
+		if err := pr.HashPlainClientSecret(cl, secret, utils.GetRemoteAddr(r)); err != nil {
+			log.Warningf("Failed to hash the secret of the client %s [%s]", clientId, err)
+		}
+	}
+
+	return cl, pr, nil
+}
+
+// the data of the page that POSTs the authorization response to the client
+type formPost struct {
+	Action string
+	Params url.Values
+}
+
+// Sends the parameters of the authorization response to the redirect URI of the client using the
+// given response mode. The form_post mode is defined in OAuth 2.0 Form Post Response Mode.
+func sendAuthzResp(sp *Sparrow, w http.ResponseWriter, r *http.Request, cl *oauth.Client, respMode string, params url.Values) {
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-cache")
+
+	switch respMode {
+	case oauth.RESP_MODE_FORM_POST:
+		headers.Add("Content-Type", "text/html; charset=utf-8")
+		sp.templates["form_post.html"].Execute(w, &formPost{Action: cl.Oauth.RedUri, Params: params})
+
+	case oauth.RESP_MODE_FRAGMENT:
+		http.Redirect(w, r, cl.Oauth.RedUri+"#"+params.Encode(), http.StatusFound)
+
+	default:
+		tmpUri := cl.Oauth.RedUri
+		if cl.Oauth.HasQueryInUri {
+			tmpUri += "&"
+		} else {
+			tmpUri += "?"
+		}
+		http.Redirect(w, r, tmpUri+params.Encode(), http.StatusFound)
+	}
 }
 
 func getAuthFlow(r *http.Request, sp *Sparrow) *authFlow {
@@ -392,6 +669,19 @@ func setAuthFlow(sp *Sparrow, af *authFlow, w http.ResponseWriter) {
 	http.SetCookie(w, ck)
 }
 
+// builds the error response sent when the issued token could not be stored
+func storeTokenError(err error, state string) *oauth.ErrorResp {
+	ep := &oauth.ErrorResp{}
+	ep.Desc = "Failed to store the token"
+	if se, ok := err.(*base.ScimError); ok {
+		ep.Desc += " - " + se.Detail
+	}
+	ep.Err = oauth.ERR_ACCESS_DENIED
+	ep.State = state
+
+	return ep
+}
+
 func sendOauthError(w http.ResponseWriter, r *http.Request, redUri string, err error) {
 	ep, ok := err.(*oauth.ErrorResp)
 	if ok {
@@ -7,7 +7,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"sparrow/conf"
 	"sparrow/oauth"
+	"sparrow/provider"
 	"sparrow/utils"
 	"testing"
 	"time"
@@ -30,7 +32,8 @@ func TestCodeGeneration(t *testing.T) {
 	cl.Oauth.Secret = utils.NewRandShaStr()
 	cl.Oauth.ServerSecret, _ = hex.DecodeString(utils.NewRandShaStr())
 
-	code := newOauthCode(cl, ttl, id, domCode, OAuth2)
+	authTime := ttl.Unix() - 60
+	code := newOauthCode(cl, ttl, id, domCode, OAuth2, nil, "", authTime, []string{oauth.AMR_PWD, oauth.AMR_OTP})
 	fmt.Println(code)
 
 	ac := decryptOauthCode(code, cl)
@@ -47,6 +50,14 @@ func TestCodeGeneration(t *testing.T) {
 		t.Errorf("Decrypted domain code does not match encrypted one %s != %s", domCode, ac.DomainCode)
 	}
 
+	if ac.Pkce != nil {
+		t.Errorf("code challenge must not be present in a code generated without PKCE")
+	}
+
+	if ac.AuthTime != authTime || len(ac.Amr) != 2 || ac.Amr[0] != oauth.AMR_PWD || ac.Amr[1] != oauth.AMR_OTP {
+		t.Errorf("Decrypted authentication details do not match encrypted ones %d %v", ac.AuthTime, ac.Amr)
+	}
+
 	codeSlice := []byte(code)
 	fmt.Println(code[0] - 1)
 	codeSlice[0] = code[0] - 1
@@ -56,6 +67,84 @@ func TestCodeGeneration(t *testing.T) {
 	}
 }
 
+func TestPkce(t *testing.T) {
+	cl := &oauth.Client{Id: utils.GenUUID()}
+	cl.Oauth = &oauth.ClientOauthConf{}
+	cl.Oauth.Secret = utils.NewRandShaStr()
+	cl.Oauth.ServerSecret, _ = hex.DecodeString(utils.NewRandShaStr())
+
+	// the example from appendix B of RFC 7636
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	areq := &oauth.AuthorizationReq{CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeMethod: "S256"}
+	pc, err := parsePkceChallenge(areq, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := newOauthCode(cl, time.Now(), cl.Id, "abcdefgh", OAuth2, pc, "", 0, nil)
+	ac := decryptOauthCode(code, cl)
+	if ac.Pkce == nil || ac.Pkce.Method != pkce_s256 {
+		t.Fatalf("code challenge is missing in the decrypted code")
+	}
+
+	if !ac.Pkce.verify(verifier) {
+		t.Errorf("failed to verify the code verifier")
+	}
+
+	if ac.Pkce.verify(verifier[1:] + "a") {
+		t.Errorf("an invalid code verifier must not be accepted")
+	}
+
+	// plain is not allowed by default
+	areq = &oauth.AuthorizationReq{CodeChallenge: verifier}
+	_, err = parsePkceChallenge(areq, cl)
+	if err == nil {
+		t.Errorf("plain code challenge method must not be allowed by default")
+	}
+
+	cl.Oauth.AllowPlainPkce = true
+	pc, err = parsePkceChallenge(areq, cl)
+	if err != nil || !pc.verify(verifier) {
+		t.Errorf("failed to verify the plain code challenge %s", err)
+	}
+
+	cl.Oauth.Public = true
+	_, err = parsePkceChallenge(&oauth.AuthorizationReq{}, cl)
+	if err == nil {
+		t.Errorf("public clients must send a code challenge")
+	}
+}
+
+func TestCodeWithScopes(t *testing.T) {
+	cl := &oauth.Client{Id: utils.GenUUID()}
+	cl.Oauth = &oauth.ClientOauthConf{}
+	cl.Oauth.Secret = utils.NewRandShaStr()
+	cl.Oauth.ServerSecret, _ = hex.DecodeString(utils.NewRandShaStr())
+
+	scopes := []string{"", "openid", "openid profile email phone address groups"}
+	for _, scope := range scopes {
+		code := newOauthCode(cl, time.Now(), cl.Id, "abcdefgh", OIDC, nil, scope, 0, nil)
+		ac := decryptOauthCode(code, cl)
+		if ac == nil || ac.Scope != scope || ac.UserId != cl.Id {
+			t.Errorf("failed to decrypt the code issued for the scopes '%s'", scope)
+		}
+	}
+
+	granted := oauth.ParseScope("profile  openid")
+	if granted.String() != "openid profile" {
+		t.Errorf("invalid scopes %s", granted.String())
+	}
+
+	pr := &provider.Provider{Config: conf.DefaultDomainConfig()}
+	if !pr.IsClaimReleased("given_name", granted) || !pr.IsClaimReleased("employeeNumber", granted) {
+		t.Errorf("the claims of the granted scopes must be released")
+	}
+
+	if pr.IsClaimReleased("email", granted) {
+		t.Errorf("the claims of the scopes which were not granted must not be released")
+	}
+}
+
 func TestBitFlags(t *testing.T) {
 	af := &authFlow{}
 	yes := true
@@ -86,3 +175,21 @@ func TestBitFlags(t *testing.T) {
 		t.Error("oauth flag was not set")
 	}
 }
+
+func TestAuthFlowAmr(t *testing.T) {
+	af := &authFlow{}
+	af.SetPasswordVerified(true)
+	if amr := af.Amr(); len(amr) != 1 || amr[0] != oauth.AMR_PWD {
+		t.Errorf("invalid amr %v of the password login", amr)
+	}
+
+	af.SetTfaVerified(true)
+	if amr := af.Amr(); len(amr) != 2 || amr[1] != oauth.AMR_OTP {
+		t.Errorf("invalid amr %v of the TOTP login", amr)
+	}
+
+	af.SetWebauthnVerified(true)
+	if amr := af.Amr(); len(amr) != 1 || amr[0] != oauth.AMR_HWK {
+		t.Errorf("invalid amr %v of the security key login", amr)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+	"strings"
+)
+
+const WELL_KNOWN_OIDC_CONF = "/.well-known/openid-configuration"
+
+// Serves the OpenID Connect discovery document of a domain. The domain is either present in
+// the path, as the discovery document is located relative to the issuer, or resolved using the host.
+func (sp *Sparrow) serveOidcConf(w http.ResponseWriter, r *http.Request) {
+	pr := sp.oidcDomain(w, r)
+	if pr == nil {
+		return
+	}
+
+	baseUrl := sp.baseUrl(r)
+	md := &oauth.ProviderMetadata{}
+	md.Issuer = baseUrl + "/" + pr.Name // must be same as the iss claim set in createIdToken()
+	md.AuthzEndpoint = baseUrl + OAUTH_BASE + "/authorize/" + pr.Name
+	md.TokenEndpoint = baseUrl + OAUTH_BASE + "/token/" + pr.Name
+	md.IntrospectionEndpoint = baseUrl + OAUTH_BASE + "/introspect/" + pr.Name
+	md.RevocationEndpoint = baseUrl + OAUTH_BASE + "/revoke/" + pr.Name
+	md.DeviceAuthzEndpoint = baseUrl + OAUTH_BASE + "/device_authorization/" + pr.Name
+	md.RegistrationEndpoint = baseUrl + OAUTH_BASE + "/register/" + pr.Name
+	md.UserinfoEndpoint = baseUrl + OAUTH_BASE + "/userinfo/" + pr.Name
+	md.JwksUri = baseUrl + OAUTH_BASE + "/jwks/" + pr.Name
+	md.RespTypes = []string{"code", "token", "id_token", "id_token token", "code id_token", "code token", "code id_token token"}
+	md.GrantTypes = []string{oauth.AUTHORIZATION_CODE, oauth.IMPLICIT, oauth.REFRESH_TOKEN, oauth.CLIENT_CRED, oauth.DEVICE_CODE}
+	md.SubjectTypes = []string{"public"}
+	md.IdTokenSigningAlgs = []string{pr.SigningKey().Alg}
+	md.UserinfoSigningAlgs = md.IdTokenSigningAlgs
+	for _, sc := range pr.Config.Oauth.Scopes {
+		md.Scopes = append(md.Scopes, sc.Name)
+	}
+	md.Claims = oidcClaims(pr)
+	md.TokenEndpointAuthMethds = []string{oauth.AUTH_METHOD_BASIC, oauth.AUTH_METHOD_POST, oauth.AUTH_METHOD_PRIVATE_KEY_JWT, oauth.AUTH_METHOD_NONE}
+	md.TokenEndpointAuthAlgs = oauth.ClientAssertionSigningAlgs
+	md.ResponseModes = []string{oauth.RESP_MODE_QUERY, oauth.RESP_MODE_FRAGMENT, oauth.RESP_MODE_FORM_POST}
+	md.CodeChallengeMethods = codeChallengeMethods(pr)
+	md.AcrValues = oauth.SupportedAcrValues
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
+
+// Serves the JWKS document containing the keys used for signing the tokens issued by a domain
+func (sp *Sparrow) serveJwks(w http.ResponseWriter, r *http.Request) {
+	pr := sp.oidcDomain(w, r)
+	if pr == nil {
+		return
+	}
+
+	jwks, err := pr.Jwks()
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
+
+// Returns the provider of the domain present in the path or mapped to the host of the request,
+// writes 404 status when the domain is not found or disabled
+func (sp *Sparrow) oidcDomain(w http.ResponseWriter, r *http.Request) *provider.Provider {
+	domain := mux.Vars(r)["domain"]
+	if len(domain) == 0 {
+		domain = sp.domainOfHost(r)
+	}
+
+	pr := sp.providers[strings.ToLower(domain)]
+	if pr == nil || pr.IsDisabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return pr
+}
+
+// Returns the PKCE code challenge methods accepted by the domain, plain is
+// accepted only if at least one of the clients is allowed to use it
+func codeChallengeMethods(pr *provider.Provider) []string {
+	methods := []string{"S256"}
+	for _, cl := range pr.GetAllClients() {
+		if cl.Oauth != nil && cl.Oauth.AllowPlainPkce {
+			methods = append(methods, "plain")
+			break
+		}
+	}
+
+	return methods
+}
+
+// Returns the names of the claims that may appear in the ID tokens issued by the domain
+func oidcClaims(pr *provider.Provider) []string {
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "jti", "nonce", "d", "auth_time", "acr", "amr"}
+	present := make(map[string]bool)
+	for _, c := range claims {
+		present[c] = true
+	}
+
+	for _, cl := range pr.GetAllClients() {
+		if cl.Oauth == nil {
+			continue
+		}
+
+		for _, at := range cl.Oauth.Attributes {
+			if !present[at.Name] {
+				present[at.Name] = true
+				claims = append(claims, at.Name)
+			}
+		}
+	}
+
+	return claims
+}
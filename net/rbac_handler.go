@@ -0,0 +1,125 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"sparrow/base"
+	"sparrow/provider"
+	"strings"
+)
+
+type roleHierarchyResp struct {
+	Hierarchy   []*base.RoleNode         `json:"hierarchy"`
+	Permissions []*base.PermissionOrigin `json:"permissions"`
+}
+
+// Serves the resolved role hierarchy and the origins of the permissions of either a group(groupId parameter)
+// or a user(userId parameter)
+func (sp *Sparrow) handleRoleHierarchy(w http.ResponseWriter, r *http.Request) {
+	opCtx, err := createOpCtx(r, sp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, ok := opCtx.Session.Roles[provider.SystemGroupId]; !ok {
+		err := base.NewForbiddenError("Insufficient access privileges, only users belonging to System group can view the role hierarchy")
+		writeError(w, err)
+		return
+	}
+
+	pr := sp.providers[opCtx.Session.Domain]
+
+	r.ParseForm()
+	groupId := strings.TrimSpace(r.Form.Get("groupId"))
+	userId := strings.TrimSpace(r.Form.Get("userId"))
+
+	resp := roleHierarchyResp{}
+	if len(groupId) != 0 {
+		node, err := pr.GetRoleHierarchy(groupId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp.Hierarchy = []*base.RoleNode{node}
+		resp.Permissions, _ = pr.ExplainGroupPermissions(groupId)
+	} else if len(userId) != 0 {
+		user, err := pr.GetUserById(userId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		resp.Hierarchy = make([]*base.RoleNode, 0)
+		groups := user.GetAttr("groups")
+		if groups != nil {
+			for _, subAtMap := range groups.GetComplexAt().SubAts {
+				gAt := subAtMap["value"]
+				if gAt == nil {
+					continue
+				}
+				node, err := pr.GetRoleHierarchy(gAt.Values[0].(string))
+				if err == nil {
+					resp.Hierarchy = append(resp.Hierarchy, node)
+				}
+			}
+		}
+		resp.Permissions, _ = pr.ExplainUserPermissions(userId)
+	} else {
+		writeError(w, base.NewBadRequestError("either groupId or userId parameter is required"))
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
+
+// Serves the result of checking whether a subject(subject parameter, the ID of a user) can perform
+// an operation(op parameter) on a resourcetype(resourceType parameter) or on a resource(resourceId parameter)
+func (sp *Sparrow) handlePermissionCheck(w http.ResponseWriter, r *http.Request) {
+	opCtx, err := createOpCtx(r, sp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, ok := opCtx.Session.Roles[provider.SystemGroupId]; !ok {
+		err := base.NewForbiddenError("Insufficient access privileges, only users belonging to System group can check the permissions of a subject")
+		writeError(w, err)
+		return
+	}
+
+	pr := sp.providers[opCtx.Session.Domain]
+
+	r.ParseForm()
+	subject := strings.TrimSpace(r.Form.Get("subject"))
+	op := strings.ToLower(strings.TrimSpace(r.Form.Get("op")))
+	rtName := strings.TrimSpace(r.Form.Get("resourceType"))
+	resId := strings.TrimSpace(r.Form.Get("resourceId"))
+
+	if len(subject) == 0 || len(op) == 0 || len(rtName) == 0 {
+		writeError(w, base.NewBadRequestError("subject, op and resourceType parameters are required"))
+		return
+	}
+
+	pc, err := pr.CheckPermission(subject, op, rtName, resId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data, err := json.Marshal(pc)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+	"sparrow/utils"
+)
+
+// Serves the dynamic client registration requests of RFC 7591. The request must carry an initial access
+// token, an access token issued by the domain whose session is allowed to create Applications.
+func (sp *Sparrow) registerClient(w http.ResponseWriter, r *http.Request) {
+	pr, token := sp.parseBearerToken(w, r)
+	if pr == nil {
+		return
+	}
+
+	session := pr.GetOauthSession(token)
+	if session == nil || session.IsExpired() || pr.IsRevokedSession(nil, session.Jti) {
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid initial access token")
+		return
+	}
+
+	md := parseClientMetadata(w, r)
+	if md == nil {
+		return
+	}
+
+	opCtx := &base.OpContext{Session: session, ClientIP: utils.GetRemoteAddr(r), Endpoint: r.URL.Path}
+	cl, secret, regToken, err := pr.RegisterClient(md, opCtx)
+	if err != nil {
+		if se, ok := err.(*base.ScimError); ok && se.Code() == http.StatusForbidden {
+			sendBearerError(w, http.StatusForbidden, "insufficient_scope", "The initial access token is not allowed to register clients")
+			return
+		}
+
+		ep := &oauth.ErrorResp{Err: oauth.ERR_INVALID_CLIENT_METADATA, Desc: err.Error()}
+		sendTokenError(w, ep)
+		return
+	}
+
+	resp := oauth.NewClientMetadata(cl)
+	if resp.TokenEndpointAuthMethod != oauth.AUTH_METHOD_NONE && resp.TokenEndpointAuthMethod != oauth.AUTH_METHOD_PRIVATE_KEY_JWT {
+		resp.ClientSecret = secret
+	}
+	resp.RegistrationAccessToken = regToken
+	resp.RegistrationClientUri = sp.baseUrl(r) + OAUTH_BASE + "/register/" + pr.Name + "/" + cl.Id
+	writeClientMetadata(w, http.StatusCreated, resp)
+}
+
+// Serves the client configuration endpoint of RFC 7592 for reading, updating and
+// deleting a registered client using its registration access token
+func (sp *Sparrow) manageClient(w http.ResponseWriter, r *http.Request) {
+	pr, token := sp.parseBearerToken(w, r)
+	if pr == nil {
+		return
+	}
+
+	clientId := mux.Vars(r)["clientId"]
+	clientIP := utils.GetRemoteAddr(r)
+	// section 2, an invalid token and an unknown client are not distinguished
+	cl := pr.GetRegisteredClient(clientId, token)
+	if cl == nil || cl.Oauth == nil {
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid registration access token")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeClientMetadata(w, http.StatusOK, sp.registeredClientMetadata(r, pr, cl))
+
+	case http.MethodPut:
+		md := parseClientMetadata(w, r)
+		if md == nil {
+			return
+		}
+
+		if md.ClientId != cl.Id {
+			ep := &oauth.ErrorResp{Err: oauth.ERR_INVALID_REQUEST, Desc: "The client_id does not match"}
+			sendTokenError(w, ep)
+			return
+		}
+
+		cl, err := pr.UpdateRegisteredClient(clientId, token, md, clientIP)
+		if err != nil {
+			ep := &oauth.ErrorResp{Err: oauth.ERR_INVALID_CLIENT_METADATA, Desc: err.Error()}
+			sendTokenError(w, ep)
+			return
+		}
+
+		log.Debugf("updated the registered client %s", cl.Id)
+		writeClientMetadata(w, http.StatusOK, sp.registeredClientMetadata(r, pr, cl))
+
+	case http.MethodDelete:
+		err := pr.DeleteRegisteredClient(clientId, token, clientIP)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		log.Debugf("deleted the registered client %s", clientId)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (sp *Sparrow) registeredClientMetadata(r *http.Request, pr *provider.Provider, cl *oauth.Client) *oauth.ClientMetadata {
+	md := oauth.NewClientMetadata(cl)
+	md.RegistrationClientUri = sp.baseUrl(r) + OAUTH_BASE + "/register/" + pr.Name + "/" + cl.Id
+	return md
+}
+
+// Parses and validates the client metadata present in the body of the request,
+// sends the error response and returns nil if the metadata is invalid
+func parseClientMetadata(w http.ResponseWriter, r *http.Request) *oauth.ClientMetadata {
+	defer r.Body.Close()
+	md := &oauth.ClientMetadata{}
+	err := json.NewDecoder(r.Body).Decode(md)
+	if err != nil {
+		ep := &oauth.ErrorResp{Err: oauth.ERR_INVALID_CLIENT_METADATA, Desc: "Invalid client metadata"}
+		sendTokenError(w, ep)
+		return nil
+	}
+
+	ep := md.Validate()
+	if ep != nil {
+		log.Debugf(ep.Desc)
+		sendTokenError(w, ep)
+		return nil
+	}
+
+	return md
+}
+
+func writeClientMetadata(w http.ResponseWriter, status int, md *oauth.ClientMetadata) {
+	data, err := json.Marshal(md)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-store")
+	headers.Add("Pragma", "no-cache")
+	headers.Add("Content-Type", JSON_TYPE)
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -49,7 +49,7 @@ func processEvent(event repl.ReplicationEvent, serverId uint16, sp *Sparrow) err
 	var err error
 	pr := sp.dcPrvMap[event.DomainCode]
 	// the provider might have been de-activated on this server
-	if pr == nil && event.Type != repl.NEW_DOMAIN {
+	if pr == nil && !isDomainLifecycleEvent(event.Type) {
 		msg := fmt.Sprintf("provider with domain code %s is not active", event.DomainCode)
 		log.Debugf(msg)
 		return base.NewNotFoundError(msg)
@@ -99,14 +99,35 @@ func processEvent(event repl.ReplicationEvent, serverId uint16, sp *Sparrow) err
 		// nil context is interpreted as replication context, a special case unlike all other events
 		pr.DeleteReplSsoSessionById(event.DeletedSessionId, event.SsoSession, true)
 
+	case repl.STORE_REFRESH_TOKEN:
+		pr.StoreReplRefreshToken(event.RefreshToken)
+
+	case repl.REVOKE_REFRESH_TOKEN_FAMILY:
+		pr.RevokeReplRefreshTokenFamily(event.RevokedFamilyId)
+
+	case repl.STORE_DEVICE_GRANT:
+		pr.StoreReplDeviceGrant(event.DeviceGrant)
+
+	case repl.DELETE_DEVICE_GRANT:
+		pr.DeleteReplDeviceGrant(event.DeviceCode)
+
+	case repl.USE_CLIENT_ASSERTION:
+		pr.UseReplClientAssertion(event.ClientId, event.AssertionId, event.AssertionExp)
+
+	case repl.STORE_SIGNING_KEYS:
+		err = pr.MergeReplSigningKeys(event.Data)
+
 	case repl.NEW_DOMAIN:
-		sp.createDomain(event.NewDomainName)
+		err = sp.createDomain(event.NewDomainName, event.TemplateDomain)
 
 	case repl.DELETE_DOMAIN:
-		// TODO add safety checks for a clean removal
-		delete(sp.providers, event.DomainCode)
-		pr.Close()
-		// delete or move the files to a stash dir
+		err = sp.deleteDomain(event.DomainName)
+
+	case repl.DISABLE_DOMAIN, repl.ENABLE_DOMAIN:
+		err = sp.setDomainDisabled(event.DomainName, event.Type == repl.DISABLE_DOMAIN)
+
+	case repl.RENAME_DOMAIN:
+		err = sp.renameDomain(event.DomainName, event.NewDomainName)
 
 	case repl.REPLACE_AUTHDATA:
 		dec := gob.NewDecoder(bytes.NewBuffer(event.Data))
@@ -132,6 +153,16 @@ func processEvent(event repl.ReplicationEvent, serverId uint16, sp *Sparrow) err
 	return nil // no error must be returned from here, either consume the event or discard it
 }
 
+// domain lifecycle events are not associated with the provider of the domain code present in the event
+func isDomainLifecycleEvent(dt repl.DataType) bool {
+	switch dt {
+	case repl.NEW_DOMAIN, repl.DELETE_DOMAIN, repl.DISABLE_DOMAIN, repl.ENABLE_DOMAIN, repl.RENAME_DOMAIN:
+		return true
+	}
+
+	return false
+}
+
 func parseServerIdPeer(w http.ResponseWriter, r *http.Request, sp *Sparrow) (uint16, *repl.ReplicationPeer, error) {
 	serverId, err := strconv.Atoi(r.Header.Get(repl.HEADER_X_FROM_PEER_ID))
 	if err != nil {
@@ -0,0 +1,58 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"net/http"
+	"sparrow/oauth"
+	"sparrow/utils"
+)
+
+// Serves the token revocation requests of RFC 7009. A client can only revoke the tokens issued to it,
+// revoking a refresh token revokes all the tokens of its family including the access tokens issued
+// along with them. As per section 2.2 the response is same whether the token was revoked or not.
+func (sp *Sparrow) revokeToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOauthError(w, r, "", err)
+		return
+	}
+
+	cl, pr, ep := authenticateClient(r, sp, r.Form.Get("client_id"), r.Form.Get("client_secret"))
+	if ep != nil {
+		logClientAuthFailure(sp, r, "RevokeToken", ep)
+		sendClientAuthError(w, ep)
+		return
+	}
+
+	token := r.Form.Get("token")
+	if len(token) == 0 {
+		ep := &oauth.ErrorResp{}
+		ep.Desc = "Missing token"
+		ep.Err = oauth.ERR_INVALID_REQUEST
+		sendOauthError(w, r, "", ep)
+		return
+	}
+
+	tokenType := ""
+	sub := ""
+	// the token_type_hint is not used, both kinds of tokens are looked up by their IDs
+	if rt := pr.GetRefreshToken(token); rt != nil && rt.ClientId == cl.Id {
+		pr.RevokeRefreshTokenFamily(rt.FamilyId)
+		tokenType = "refresh_token"
+		sub = rt.UserId
+	} else if session := pr.GetOauthSession(token); session != nil && session.Ito == cl.Id {
+		pr.RevokeOauthSession(nil, session.Jti)
+		tokenType = "access_token"
+		sub = session.Sub
+	}
+
+	if len(tokenType) > 0 {
+		log.Debugf("client %s revoked the %s of %s", cl.Id, tokenType, sub)
+	}
+
+	pr.Al.LogRevokeToken(cl, utils.GetRemoteAddr(r), tokenType, sub)
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
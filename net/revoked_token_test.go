@@ -0,0 +1,44 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sparrow/provider"
+	"testing"
+)
+
+func TestScimRequestWithRevokedToken(t *testing.T) {
+	home := "/tmp/revoked_token_test"
+	os.RemoveAll(home)
+	defer os.RemoveAll(home)
+
+	sp := NewSparrowServer(home, "")
+	pr := sp.providers[sp.srvConf.DefaultDomain]
+
+	session, err := pr.GenSessionForUserId(provider.AdminUserId)
+	if err != nil {
+		t.Fatalf("failed to generate the session of the admin user %s", err)
+	}
+	pr.StoreOauthSession(session)
+
+	sendGet := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/v2/Users/"+provider.AdminUserId, nil)
+		r.Header.Set("Authorization", "Bearer "+session.Jti)
+		w := httptest.NewRecorder()
+		sp.handleResRequest(w, r)
+		return w.Code
+	}
+
+	if code := sendGet(); code != http.StatusOK {
+		t.Fatalf("expected status %d with a valid token but received %d", http.StatusOK, code)
+	}
+
+	pr.RevokeOauthSession(nil, session.Jti)
+	if code := sendGet(); code != http.StatusForbidden {
+		t.Errorf("expected status %d with a revoked token but received %d", http.StatusForbidden, code)
+	}
+}
@@ -29,8 +29,10 @@ import (
 	"sparrow/repl"
 	"sparrow/schema"
 	"sparrow/utils"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var DEFAULT_SRV_CONF string = `{
@@ -98,6 +100,7 @@ func NewSparrowServer(homeDir string, overrideConf string) *Sparrow {
 	sp.peers = sp.rl.GetReplicationPeers()
 
 	sp.loadProviders(sc.DomainsDir)
+	go sp.purgeStashedDomains()
 
 	cwd, _ := os.Getwd()
 	fmt.Println("Current working directory: ", cwd)
@@ -234,6 +237,12 @@ func initHome(srvHome string, overrideConf string) *conf.ServerConf {
 
 	sc.ControllerDomain = strings.ToLower(sc.ControllerDomain)
 
+	hostDomains := make(map[string]string)
+	for host, domain := range sc.HostDomains {
+		hostDomains[strings.ToLower(host)] = strings.ToLower(domain)
+	}
+	sc.HostDomains = hostDomains
+
 	// parse the certificate and privatekey
 	pb, absFilePath, err := pemDecode(srvConfDir, sc.CertFile)
 	if err == nil {
@@ -266,6 +275,14 @@ func initHome(srvHome string, overrideConf string) *conf.ServerConf {
 	log.Debugf("Checking server domains directory %s", sc.DomainsDir)
 	utils.CheckAndCreate(sc.DomainsDir)
 
+	sc.StashDir = filepath.Join(srvHome, "stash")
+	log.Debugf("Checking server stash directory %s", sc.StashDir)
+	utils.CheckAndCreate(sc.StashDir)
+
+	if sc.DomainStashTtl <= 0 {
+		sc.DomainStashTtl = 7 * 24 * 3600 // 7 days
+	}
+
 	skipCertCheck := false
 	if sc.SkipPeerCertCheck {
 		skipCertCheck = true
@@ -350,18 +367,30 @@ func (sp *Sparrow) loadProviders(domainsDir string) {
 }
 
 func (sp *Sparrow) createDefaultDomain() {
-	err := sp.createDomain("example.com")
+	err := sp.createDomain("example.com", "")
 	if err != nil {
 		panic(err)
 	}
 }
 
-func (sp *Sparrow) createDomain(domainName string) error {
+// Creates a new domain. If the name of a template domain is given then the schemas, resourcetypes,
+// LDAP and HTML templates and the configuration of the template domain will be copied into the new domain.
+func (sp *Sparrow) createDomain(domainName string, templateDomain string) (err error) {
 	domainName = strings.ToLower(domainName)
 	domainName = strings.TrimSpace(domainName)
 	log.Infof("Creating domain %s", domainName)
 	sc := sp.srvConf
 
+	var tmplPr *provider.Provider
+	if len(templateDomain) > 0 {
+		tmplPr = sp.providers[templateDomain]
+		if tmplPr == nil {
+			msg := fmt.Sprintf("template domain %s does not exist", templateDomain)
+			log.Debugf(msg)
+			return errors.New(msg)
+		}
+	}
+
 	domainDir := filepath.Join(sc.DomainsDir, domainName)
 	fi, _ := os.Stat(domainDir)
 	if fi != nil {
@@ -374,6 +403,15 @@ func (sp *Sparrow) createDomain(domainName string) error {
 		return err
 	}
 
+	if tmplPr != nil {
+		err = copyTemplateDomain(tmplPr, layout)
+		if err != nil {
+			log.Warningf("failed to copy the template domain %s [%s]", templateDomain, err)
+			os.RemoveAll(domainDir)
+			return err
+		}
+	}
+
 	writeSchemas(layout.SchemaDir)
 
 	writeResourceTypes(layout.ResTypesDir)
@@ -399,6 +437,204 @@ func (sp *Sparrow) createDomain(domainName string) error {
 	return nil
 }
 
+// Copies the schemas, resourcetypes, LDAP and HTML templates and the configuration of the template domain
+func copyTemplateDomain(tmplPr *provider.Provider, layout *provider.Layout) (err error) {
+	defer func() {
+		e := recover()
+		if e != nil {
+			var ok bool
+			if err, ok = e.(error); !ok {
+				err = fmt.Errorf("%v", e)
+			}
+		}
+	}()
+
+	tmplLayout := tmplPr.Layout()
+	copyDir(tmplLayout.SchemaDir, layout.SchemaDir)
+	copyDir(tmplLayout.ResTypesDir, layout.ResTypesDir)
+	copyDir(tmplLayout.LdapTmplDir, layout.LdapTmplDir)
+	copyDir(tmplLayout.TmplDir, layout.TmplDir)
+
+	data, err := json.MarshalIndent(tmplPr.Config, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	var dc conf.DomainConfig
+	err = json.Unmarshal(data, &dc)
+	if err != nil {
+		return err
+	}
+
+	dc.Disabled = false
+	data, _ = json.MarshalIndent(dc, "", "    ")
+	return ioutil.WriteFile(filepath.Join(layout.ConfDir, "domain.json"), data, utils.FILE_PERM)
+}
+
+// Deletes the domain by closing its provider and moving the domain's directory to the stash directory.
+// The stashed data will be purged after the configured DomainStashTtl.
+func (sp *Sparrow) deleteDomain(domainName string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	pr, err := sp.getManagedDomain(domainName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Deleting domain %s", domainName)
+	delete(sp.providers, domainName)
+	delete(sp.dcPrvMap, pr.DomainCode())
+	pr.Close()
+
+	if sp.srvConf.DefaultDomain == domainName {
+		sp.srvConf.DefaultDomain = sp.srvConf.ControllerDomain
+	}
+
+	sc := sp.srvConf
+	domainDir := filepath.Join(sc.DomainsDir, domainName)
+	stashDir := filepath.Join(sc.StashDir, fmt.Sprintf("%s-%d", domainName, time.Now().Unix()))
+	err = os.Rename(domainDir, stashDir)
+	if err != nil {
+		log.Warningf("failed to move the directory of the deleted domain %s to the stash %s [%s]", domainName, stashDir, err)
+		return base.NewInternalserverError(err.Error())
+	}
+
+	log.Infof("Moved the data of the deleted domain %s to %s", domainName, stashDir)
+	return nil
+}
+
+// Disables or enables the domain. The data of a disabled domain is retained
+// but all logins and API calls are rejected.
+func (sp *Sparrow) setDomainDisabled(domainName string, disabled bool) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	pr, err := sp.getManagedDomain(domainName)
+	if err != nil {
+		return err
+	}
+
+	sp.dconfUpdateMutex.Lock()
+	defer sp.dconfUpdateMutex.Unlock()
+
+	if pr.IsDisabled() == disabled {
+		return nil
+	}
+
+	log.Infof("Setting the disabled state of domain %s to %t", domainName, disabled)
+	err = pr.SetDisabled(disabled)
+	if err != nil {
+		return base.NewInternalserverError(err.Error())
+	}
+
+	return nil
+}
+
+// Renames the domain by closing its provider, renaming the domain's directory and reloading it.
+// All the tokens and sessions issued under the old name will no longer be valid.
+func (sp *Sparrow) renameDomain(domainName string, newName string) error {
+	domainName = strings.ToLower(strings.TrimSpace(domainName))
+	newName = strings.ToLower(strings.TrimSpace(newName))
+	pr, err := sp.getManagedDomain(domainName)
+	if err != nil {
+		return err
+	}
+
+	if len(newName) == 0 {
+		return base.NewBadRequestError("new name of the domain is missing")
+	}
+
+	sc := sp.srvConf
+	newDir := filepath.Join(sc.DomainsDir, newName)
+	fi, _ := os.Stat(newDir)
+	if fi != nil || sp.providers[newName] != nil {
+		return base.NewConflictError(fmt.Sprintf("domain %s already exists", newName))
+	}
+
+	log.Infof("Renaming domain %s to %s", domainName, newName)
+	delete(sp.providers, domainName)
+	delete(sp.dcPrvMap, pr.DomainCode())
+	pr.Close()
+
+	err = os.Rename(filepath.Join(sc.DomainsDir, domainName), newDir)
+	if err != nil {
+		log.Warningf("failed to rename the directory of domain %s [%s]", domainName, err)
+		// the directory is still intact, load the provider again
+		newDir = filepath.Join(sc.DomainsDir, domainName)
+		newName = domainName
+	}
+
+	layout, lErr := provider.NewLayout(newDir, false)
+	if lErr != nil {
+		return base.NewInternalserverError(lErr.Error())
+	}
+
+	prv, lErr := provider.NewProvider(layout, sc, sp.peers)
+	if lErr != nil {
+		return base.NewInternalserverError(lErr.Error())
+	}
+
+	sp.providers[layout.Name()] = prv
+	sp.dcPrvMap[prv.DomainCode()] = prv
+
+	if err != nil {
+		return base.NewInternalserverError(err.Error())
+	}
+
+	if sc.DefaultDomain == domainName {
+		sc.DefaultDomain = newName
+	}
+
+	return nil
+}
+
+// Returns the provider of the given domain if it exists and can be managed using the lifecycle operations.
+// The controller domain is never allowed to be deleted, disabled or renamed.
+func (sp *Sparrow) getManagedDomain(domainName string) (*provider.Provider, error) {
+	if domainName == sp.srvConf.ControllerDomain {
+		return nil, base.NewForbiddenError("controller domain cannot be deleted, disabled or renamed")
+	}
+
+	pr := sp.providers[domainName]
+	if pr == nil {
+		return nil, base.NewNotFoundError(fmt.Sprintf("No domain '%s' found", domainName))
+	}
+
+	return pr, nil
+}
+
+// Periodically removes the data of deleted domains whose stash TTL has expired
+func (sp *Sparrow) purgeStashedDomains() {
+	sc := sp.srvConf
+	for {
+		files, err := ioutil.ReadDir(sc.StashDir)
+		if err != nil {
+			log.Warningf("failed to read the stash directory %s [%s]", sc.StashDir, err)
+		}
+
+		now := time.Now().Unix()
+		for _, f := range files {
+			name := f.Name()
+			pos := strings.LastIndex(name, "-")
+			if !f.IsDir() || pos <= 0 {
+				continue
+			}
+
+			deletedAt, err := strconv.ParseInt(name[pos+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if (now - deletedAt) >= int64(sc.DomainStashTtl) {
+				log.Infof("purging the stashed data of deleted domain %s", name[:pos])
+				err = os.RemoveAll(filepath.Join(sc.StashDir, name))
+				if err != nil {
+					log.Warningf("failed to purge the stashed domain data %s [%s]", name, err)
+				}
+			}
+		}
+
+		time.Sleep(1 * time.Hour)
+	}
+}
+
 func copyDir(src, dest string) {
 	dir, err := os.Open(src)
 	if err != nil {
@@ -494,6 +730,10 @@ func writeDefaultHtmlTemplates(tmplDir string) {
 	samlResponseTmpl := filepath.Join(tmplDir, "saml_response.html")
 	writeFile(samlResponseTmpl, saml_response_html)
 
+	// form_post.html
+	formPostTmpl := filepath.Join(tmplDir, "form_post.html")
+	writeFile(formPostTmpl, form_post_html)
+
 	// totp-register.html
 	totpRegisterTmpl := filepath.Join(tmplDir, "totp-register.html")
 	writeFile(totpRegisterTmpl, totp_register_html)
@@ -509,6 +749,10 @@ func writeDefaultHtmlTemplates(tmplDir string) {
 	// webauthn.html
 	webauthnTmpl := filepath.Join(tmplDir, "webauthn.html")
 	writeFile(webauthnTmpl, webauthn_html)
+
+	// device-verification.html
+	deviceTmpl := filepath.Join(tmplDir, "device-verification.html")
+	writeFile(deviceTmpl, device_verification_html)
 }
 
 func writeFile(name string, content string) {
@@ -0,0 +1,42 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/provider"
+)
+
+type domainUsage struct {
+	Limits *conf.LimitsConfig    `json:"limits"`
+	Usage  *provider.DomainStats `json:"usage"`
+}
+
+func (sp *Sparrow) handleDomainUsage(w http.ResponseWriter, r *http.Request) {
+	opCtx, err := createOpCtx(r, sp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, ok := opCtx.Session.Roles[provider.SystemGroupId]; !ok {
+		err := base.NewForbiddenError("Insufficient access privileges, only users belonging to System group can view the usage")
+		writeError(w, err)
+		return
+	}
+
+	pr := sp.providers[opCtx.Session.Domain]
+	log.Debugf("serving usage of the domain %s", pr.Name)
+
+	du := domainUsage{Limits: pr.Config.Limits, Usage: pr.Stats()}
+	data, err := json.Marshal(du)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
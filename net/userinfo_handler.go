@@ -0,0 +1,118 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+package net
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/provider"
+	"strings"
+)
+
+// Serves the UserInfo requests of section 5.3 of OpenID Connect Core. The claims are evaluated using
+// the attribute mappings of the client to which the access token was issued, and only the claims of
+// the granted scopes are released. The response is a signed JWT if the client is configured for it.
+func (sp *Sparrow) serveUserinfo(w http.ResponseWriter, r *http.Request) {
+	pr, token := sp.parseBearerToken(w, r)
+	if pr == nil {
+		return
+	}
+
+	session := pr.GetOauthSession(token)
+	if session == nil || session.IsExpired() || pr.IsRevokedSession(nil, session.Jti) {
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return
+	}
+
+	granted := oauth.ParseScope(session.Scope)
+	if !granted.Has(oauth.SCOPE_OPENID) {
+		sendBearerError(w, http.StatusForbidden, "insufficient_scope", "The access token was not issued for the openid scope")
+		return
+	}
+
+	cl := pr.GetClientById(session.Ito)
+	if cl == nil || cl.Oauth == nil {
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return
+	}
+
+	user, err := pr.GetUserById(session.Sub)
+	if err != nil {
+		log.Debugf("could not find the user %s of the access token [%s]", session.Sub, err)
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	for _, ssoAt := range cl.Oauth.Attributes {
+		if pr.IsClaimReleased(ssoAt.Name, granted) {
+			ssoAt.GetValueInto(user, claims)
+		}
+	}
+
+	// must be same as the sub claim of the ID token, see createIdToken()
+	if _, ok := claims["sub"]; !ok {
+		claims["sub"] = session.Sub
+	}
+
+	headers := w.Header()
+	headers.Add("Cache-Control", "no-store")
+	headers.Add("Pragma", "no-cache")
+
+	if cl.Oauth.SignUserinfo {
+		claims["iss"] = sp.baseUrl(r) + "/" + session.Domain
+		claims["aud"] = cl.Id
+		headers.Add("Content-Type", "application/jwt")
+		w.Write([]byte(oauth.ToJwt(claims, pr.SigningKey())))
+		return
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		writeError(w, base.NewInternalserverError(err.Error()))
+		return
+	}
+
+	writeJson(w, data)
+}
+
+// Returns the provider and the bearer token sent in the Authorization header or in the
+// form, as per section 2 of RFC 6750. An error is sent if there is no token.
+func (sp *Sparrow) parseBearerToken(w http.ResponseWriter, r *http.Request) (pr *provider.Provider, token string) {
+	authzHeader := r.Header.Get("Authorization")
+	if len(authzHeader) > 7 && strings.EqualFold(authzHeader[:7], "Bearer ") {
+		token = strings.TrimSpace(authzHeader[7:])
+	} else if r.Method == http.MethodPost {
+		r.ParseForm()
+		token = r.PostForm.Get("access_token")
+	}
+
+	if len(token) == 0 {
+		w.Header().Add("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, ""
+	}
+
+	if domain := mux.Vars(r)["domain"]; len(domain) > 0 {
+		pr = sp.providers[strings.ToLower(domain)]
+	} else {
+		pr, _ = getPrFromParam(r, sp)
+	}
+
+	if pr == nil || pr.IsDisabled() {
+		sendBearerError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+		return nil, ""
+	}
+
+	return pr, token
+}
+
+func sendBearerError(w http.ResponseWriter, status int, errCode string, desc string) {
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s", error_description="%s"`, errCode, desc))
+	w.WriteHeader(status)
+}
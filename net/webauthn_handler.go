@@ -158,7 +158,7 @@ func (sp *Sparrow) sendWebauthnAuthReq(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, domain := sp.splitUsernameAndDomain(username)
+	username, domain := sp.splitUsernameAndDomain(username, r)
 
 	pr := sp.providers[domain]
 	if pr == nil {
@@ -223,10 +223,21 @@ func (sp *Sparrow) webauthnVerifyCred(w http.ResponseWriter, r *http.Request) {
 	af.SetPasswordVerified(true)
 	af.SetTfaVerified(true)
 	af.SetTfaRequired(false)
+	af.SetWebauthnVerified(true)
 	//setSessionCookie(sp, user, af, pr, w, r, params)
 	session := pr.GenSessionForUser(user)
+	session.AuthTime = session.Iat
+	session.Amr = af.Amr()
 	pr.StoreSsoSession(session)
 	setSsoCookie(pr, session, w)
+
+	// the oauth flow is resumed after the redirect, see redirectAfterAuth()
+	if af.FromOauth() {
+		af.UserId = user.GetId()
+		af.DomainCode = pr.DomainCode()
+		af.markLoginSuccessful()
+		setAuthFlow(sp, af, w)
+	}
 	w.Write([]byte("/redirect"))
 }
 
@@ -0,0 +1,79 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"strings"
+)
+
+// the authentication method references of RFC 8176 used by the server
+const (
+	AMR_PWD = "pwd" // password
+	AMR_OTP = "otp" // TOTP
+	AMR_HWK = "hwk" // security key, WebAuthn
+)
+
+// the authentication context class references, a class is satisfied by the methods of the classes above it
+const (
+	ACR_PASSWORD = "urn:sparrow:acr:password"
+	ACR_TOTP     = "urn:sparrow:acr:totp"
+	ACR_WEBAUTHN = "urn:sparrow:acr:webauthn"
+)
+
+// the supported ACRs, in the increasing order of their strength
+var SupportedAcrValues = []string{ACR_PASSWORD, ACR_TOTP, ACR_WEBAUTHN}
+
+// Returns the strength of the ACR, -1 if the ACR is not supported
+func acrLevel(acr string) int {
+	for i, v := range SupportedAcrValues {
+		if v == acr {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Returns the ACR achieved by authenticating using the given methods, empty if no method is known
+func AcrOf(amr []string) string {
+	acr := ""
+	for _, m := range amr {
+		switch m {
+		case AMR_HWK:
+			return ACR_WEBAUTHN
+		case AMR_OTP:
+			acr = ACR_TOTP
+		case AMR_PWD:
+			if len(acr) == 0 {
+				acr = ACR_PASSWORD
+			}
+		}
+	}
+
+	return acr
+}
+
+// Returns the ACR the user must satisfy for the given acr_values parameter. The values are the
+// acceptable ACRs, hence the weakest of the supported values is returned. Returns an empty
+// string if none of the values is supported.
+func RequiredAcr(acrValues string) string {
+	required := ""
+	for _, v := range strings.Fields(acrValues) {
+		level := acrLevel(v)
+		if level >= 0 && (len(required) == 0 || level < acrLevel(required)) {
+			required = v
+		}
+	}
+
+	return required
+}
+
+// Returns true if the authentication using the given methods satisfies the required ACR
+func SatisfiesAcr(amr []string, acr string) bool {
+	if len(acr) == 0 {
+		return true
+	}
+
+	return acrLevel(AcrOf(amr)) >= acrLevel(acr)
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"testing"
+)
+
+func TestAcr(t *testing.T) {
+	if AcrOf([]string{AMR_PWD}) != ACR_PASSWORD || AcrOf([]string{AMR_PWD, AMR_OTP}) != ACR_TOTP || AcrOf([]string{AMR_HWK}) != ACR_WEBAUTHN {
+		t.Errorf("invalid ACR of the authentication methods")
+	}
+
+	if AcrOf(nil) != "" {
+		t.Errorf("ACR must be empty when the authentication methods are unknown")
+	}
+
+	if RequiredAcr("") != "" || RequiredAcr("urn:unknown") != "" {
+		t.Errorf("no ACR must be required when none of the values is supported")
+	}
+
+	// the weakest of the acceptable values is required
+	if acr := RequiredAcr(ACR_WEBAUTHN + " urn:unknown " + ACR_TOTP); acr != ACR_TOTP {
+		t.Errorf("invalid required ACR %s", acr)
+	}
+
+	if !SatisfiesAcr([]string{AMR_PWD}, "") || SatisfiesAcr(nil, ACR_PASSWORD) {
+		t.Errorf("invalid check of an absent ACR")
+	}
+
+	if SatisfiesAcr([]string{AMR_PWD}, ACR_TOTP) || !SatisfiesAcr([]string{AMR_PWD, AMR_OTP}, ACR_TOTP) || !SatisfiesAcr([]string{AMR_HWK}, ACR_TOTP) {
+		t.Errorf("TOTP ACR must only be satisfied by TOTP or a security key")
+	}
+
+	if SatisfiesAcr([]string{AMR_PWD, AMR_OTP}, ACR_WEBAUTHN) {
+		t.Errorf("WebAuthn ACR must only be satisfied by a security key")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RESP_MODE_QUERY     = "query"
+	RESP_MODE_FRAGMENT  = "fragment"
+	RESP_MODE_FORM_POST = "form_post"
+)
+
+// the values of the prompt parameter, section 3.1.2.1 of OpenID Connect core
+const (
+	PROMPT_NONE    = "none"
+	PROMPT_LOGIN   = "login"
+	PROMPT_CONSENT = "consent"
+)
+
+// the supported response types in their normalized form, the code flow, the implicit flow and the
+// hybrid flow as defined in OAuth 2.0 Multiple Response Type Encoding Practices
+var supportedRespTypes = map[string]bool{
+	"code":                true,
+	"token":               true,
+	"id_token":            true,
+	"id_token token":      true,
+	"code id_token":       true,
+	"code token":          true,
+	"code id_token token": true,
+}
+
+// Returns the response type with its values sorted, the order of the values is not significant
+func normalizeRespType(respType string) string {
+	values := strings.Fields(respType)
+	sort.Strings(values)
+	return strings.Join(values, " ")
+}
+
+// Returns true if the response_type contains the given value
+func (areq *AuthorizationReq) HasRespType(value string) bool {
+	for _, v := range strings.Fields(areq.RespType) {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the request uses either the implicit or the hybrid flow, i.e a token is
+// sent from the authorization endpoint
+func (areq *AuthorizationReq) IsImplicitOrHybrid() bool {
+	return areq.HasRespType("token") || areq.HasRespType("id_token")
+}
+
+// Returns true if the prompt parameter contains the given value
+func (areq *AuthorizationReq) HasPrompt(value string) bool {
+	for _, v := range strings.Fields(areq.Prompt) {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the value of the max_age parameter, -1 if the parameter is absent or invalid
+func (areq *AuthorizationReq) MaxAgeSecs() int64 {
+	maxAge, err := strconv.ParseInt(areq.MaxAge, 10, 64)
+	if err != nil || maxAge < 0 {
+		return -1
+	}
+
+	return maxAge
+}
+
+// Returns the response mode, the default is query for the code flow and fragment for the others
+func (areq *AuthorizationReq) RespMode() string {
+	if len(areq.ResponseMode) != 0 {
+		return areq.ResponseMode
+	}
+
+	if areq.IsImplicitOrHybrid() {
+		return RESP_MODE_FRAGMENT
+	}
+
+	return RESP_MODE_QUERY
+}
+
+// Computes the value of the at_hash and c_hash claims of an ID token, the base64url encoded left-most
+// half of the hash of the value. The hash algorithm is the one used by the signing algorithm of the
+// ID token, Ed25519 uses SHA-512.
+func HalfHash(value string, alg string) string {
+	var sum []byte
+	if alg == "EdDSA" {
+		s := sha512.Sum512([]byte(value))
+		sum = s[:]
+	} else {
+		s := sha256.Sum256([]byte(value))
+		sum = s[:]
+	}
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
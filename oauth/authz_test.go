@@ -0,0 +1,89 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"testing"
+)
+
+func TestValidateAuthReq(t *testing.T) {
+	areq := &AuthorizationReq{ClientId: "client1", RespType: "token id_token", Scopes: ParseScope("openid")}
+	ep := ValidateAuthReq(areq)
+	if ep == nil || ep.Err != ERR_INVALID_REQUEST {
+		t.Errorf("nonce must be required in the implicit flow")
+	}
+
+	areq.Nonce = "n-0S6_WzA2Mj"
+	if ep = ValidateAuthReq(areq); ep != nil {
+		t.Errorf("unexpected error %s", ep.Desc)
+	}
+
+	if areq.RespMode() != RESP_MODE_FRAGMENT {
+		t.Errorf("fragment must be the default response mode of the implicit flow")
+	}
+
+	areq.ResponseMode = RESP_MODE_QUERY
+	if ep = ValidateAuthReq(areq); ep == nil {
+		t.Errorf("query response mode must not be allowed in the implicit flow")
+	}
+
+	areq.ResponseMode = RESP_MODE_FORM_POST
+	if ep = ValidateAuthReq(areq); ep != nil {
+		t.Errorf("unexpected error %s", ep.Desc)
+	}
+
+	areq = &AuthorizationReq{ClientId: "client1", RespType: "code", Scopes: ParseScope("openid")}
+	if ep = ValidateAuthReq(areq); ep != nil || areq.RespMode() != RESP_MODE_QUERY {
+		t.Errorf("nonce must not be required in the code flow and the default response mode must be query")
+	}
+
+	areq.RespType = "code code"
+	if ep = ValidateAuthReq(areq); ep == nil || ep.Err != ERR_UNSUPPORTED_RESPONSE_TYPE {
+		t.Errorf("invalid response type must be rejected")
+	}
+
+	areq = &AuthorizationReq{ClientId: "client1", RespType: "code", Prompt: "none login"}
+	if ep = ValidateAuthReq(areq); ep == nil || ep.Err != ERR_INTERACTION_REQUIRED {
+		t.Errorf("prompt none must not be allowed with other values")
+	}
+
+	areq.Prompt = "consent none"
+	if ep = ValidateAuthReq(areq); ep == nil || ep.Err != ERR_CONSENT_REQUIRED {
+		t.Errorf("prompt none must not be allowed with consent")
+	}
+
+	areq.Prompt = "login consent"
+	if ep = ValidateAuthReq(areq); ep != nil || !areq.HasPrompt(PROMPT_CONSENT) || areq.HasPrompt(PROMPT_NONE) {
+		t.Errorf("failed to validate the prompt")
+	}
+
+	if areq.MaxAgeSecs() != -1 {
+		t.Errorf("max_age must be -1 when absent")
+	}
+
+	for _, maxAge := range []string{"-1", "1h", "1.5"} {
+		areq.MaxAge = maxAge
+		if ep = ValidateAuthReq(areq); ep == nil {
+			t.Errorf("invalid max_age %s must be rejected", maxAge)
+		}
+	}
+
+	areq.MaxAge = "0"
+	if ep = ValidateAuthReq(areq); ep != nil || areq.MaxAgeSecs() != 0 {
+		t.Errorf("max_age zero must be accepted")
+	}
+}
+
+func TestHalfHash(t *testing.T) {
+	// the examples from appendix A of OpenID Connect Core 1.0
+	atHash := HalfHash("jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y", "RS256")
+	if atHash != "77QmUPtjPfzWtF2AnpK9RQ" {
+		t.Errorf("invalid at_hash %s", atHash)
+	}
+
+	cHash := HalfHash("Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk", "RS256")
+	if cHash != "LDktKdoQak3Pk0cnXxCltA" {
+		t.Errorf("invalid c_hash %s", cHash)
+	}
+}
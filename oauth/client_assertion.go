@@ -0,0 +1,221 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"time"
+)
+
+const CLIENT_ASSERTION_TYPE_JWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// the maximum life time of a client assertion in seconds, the IDs of the used
+// assertions are remembered till they expire for detecting the replays
+const MAX_CLIENT_ASSERTION_LIFE = 5 * 60
+
+// the algorithms accepted for signing the client assertions, the HMAC algorithms are
+// not accepted as the client secret is not a key shared with the client
+var ClientAssertionSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Returns true if the client is allowed to authenticate at the token endpoint using the given method. The
+// clients without a configured method can use either of the secret methods, as they did before.
+func (oc *ClientOauthConf) AllowsAuthMethod(method string) bool {
+	if len(oc.TokenEndpointAuthMethod) == 0 {
+		return method == AUTH_METHOD_BASIC || method == AUTH_METHOD_POST
+	}
+
+	return method == oc.TokenEndpointAuthMethod
+}
+
+// Parses the JWKS of a client, the keys are stored inline in the Application
+func ParseJwks(data string) (*JwkSet, error) {
+	jwks := &JwkSet{}
+	err := json.Unmarshal([]byte(data), jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jwks.Keys) == 0 {
+		return nil, fmt.Errorf("no keys are present in the JWKS")
+	}
+
+	for _, jwk := range jwks.Keys {
+		if jwk == nil {
+			return nil, fmt.Errorf("invalid key in the JWKS")
+		}
+		_, err = jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jwks, nil
+}
+
+// Returns the key with the given ID, the only key present in the set is returned if the ID is empty
+func (jwks *JwkSet) Find(kid string) *Jwk {
+	if len(kid) == 0 {
+		if len(jwks.Keys) == 1 {
+			return jwks.Keys[0]
+		}
+		return nil
+	}
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid == kid {
+			return jwk
+		}
+	}
+
+	return nil
+}
+
+// Returns the public key represented by the JWK, the reverse of NewJwk()
+func (jwk *Jwk) PublicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("invalid modulus of the RSA key %s", jwk.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent of the RSA key %s", jwk.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s of the EC key %s", jwk.Crv, jwk.Kid)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid coordinates of the EC key %s", jwk.Kid)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("the point of the EC key %s is not on the curve", jwk.Kid)
+		}
+		return pub, nil
+
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid or unsupported OKP key %s", jwk.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// Returns the subject of the assertion without verifying it, the client_id
+// parameter is optional when the client authenticates using an assertion
+func AssertionSubject(assertion string) string {
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(assertion, claims)
+	if err != nil {
+		return ""
+	}
+
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+// Verifies the assertion a client sent for authenticating itself, sections 3 and 3.1 of RFC 7523. The
+// assertion must be signed using one of the keys present in the JWKS of the client and must be addressed
+// to one of the given audiences. Returns the ID and expiration time of the assertion for detecting replays.
+func VerifyClientAssertion(assertion string, cl *Client, audiences []string) (jti string, exp int64, err error) {
+	if cl.Oauth.Jwks == nil {
+		return "", 0, fmt.Errorf("no JWKS is registered for the client %s", cl.Id)
+	}
+
+	keyFunc := func(jt *jwt.Token) (interface{}, error) {
+		kid, _ := jt.Header["kid"].(string)
+		jwk := cl.Oauth.Jwks.Find(kid)
+		if jwk == nil {
+			return nil, fmt.Errorf("key '%s' is not found in the JWKS of the client", kid)
+		}
+
+		// the signing method checks the type of the key, the algorithm is checked if the key is restricted to one
+		if len(jwk.Alg) != 0 && jwk.Alg != jt.Method.Alg() {
+			return nil, fmt.Errorf("algorithm '%s' does not match with that of the key '%s'", jt.Method.Alg(), kid)
+		}
+
+		return jwk.PublicKey()
+	}
+
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: ClientAssertionSigningAlgs}
+	_, err = parser.ParseWithClaims(assertion, claims, keyFunc)
+	if err != nil {
+		return "", 0, err
+	}
+
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	if iss != cl.Id || sub != cl.Id {
+		return "", 0, fmt.Errorf("the iss and sub claims must be the client ID")
+	}
+
+	if !hasAudience(claims["aud"], audiences) {
+		return "", 0, fmt.Errorf("the assertion is not addressed to this server")
+	}
+
+	jti, _ = claims["jti"].(string)
+	if len(jti) == 0 {
+		return "", 0, fmt.Errorf("missing jti claim")
+	}
+
+	// the parser only checks the expiration time if it is present
+	expClaim, _ := claims["exp"].(float64)
+	exp = int64(expClaim)
+	if exp == 0 {
+		return "", 0, fmt.Errorf("missing exp claim")
+	}
+
+	if exp > time.Now().Unix()+MAX_CLIENT_ASSERTION_LIFE {
+		return "", 0, fmt.Errorf("the assertion is valid for longer than %d seconds", MAX_CLIENT_ASSERTION_LIFE)
+	}
+
+	return jti, exp, nil
+}
+
+// the aud claim is either a string or an array of strings
+func hasAudience(aud interface{}, audiences []string) bool {
+	var values []interface{}
+	switch v := aud.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+
+	for _, v := range values {
+		for _, a := range audiences {
+			if v == a {
+				return true
+			}
+		}
+	}
+
+	return false
+}
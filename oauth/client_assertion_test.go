@@ -0,0 +1,93 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"testing"
+	"time"
+)
+
+func TestVerifyClientAssertion(t *testing.T) {
+	cert, key := createTestCert()
+	jwk, _ := NewJwk(cert, "RS256")
+	data, _ := json.Marshal(&JwkSet{Keys: []*Jwk{jwk}})
+	jwks, err := ParseJwks(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &Client{Id: "client1", Oauth: &ClientOauthConf{TokenEndpointAuthMethod: AUTH_METHOD_PRIVATE_KEY_JWT, Jwks: jwks}}
+	audiences := []string{"https://localhost/oauth2/token"}
+	sk := &SigningKey{Kid: jwk.Kid, Alg: jwk.Alg, Cert: cert, PrivKey: key}
+	newAssertion := func(claims jwt.MapClaims) string {
+		now := time.Now().Unix()
+		all := jwt.MapClaims{"iss": cl.Id, "sub": cl.Id, "aud": audiences[0], "jti": "1", "exp": now + 60}
+		for k, v := range claims {
+			if v == nil {
+				delete(all, k)
+			} else {
+				all[k] = v
+			}
+		}
+		return ToJwt(all, sk)
+	}
+
+	jti, exp, err := VerifyClientAssertion(newAssertion(nil), cl, audiences)
+	if err != nil || jti != "1" || exp == 0 {
+		t.Errorf("failed to verify the assertion %s", err)
+	}
+
+	if AssertionSubject(newAssertion(nil)) != cl.Id {
+		t.Errorf("invalid subject of the assertion")
+	}
+
+	_, _, err = VerifyClientAssertion(newAssertion(jwt.MapClaims{"aud": []interface{}{"x", audiences[0]}}), cl, audiences)
+	if err != nil {
+		t.Errorf("the audience must be found in the array %s", err)
+	}
+
+	invalid := []jwt.MapClaims{
+		{"iss": "client2"},
+		{"aud": "https://localhost/other"},
+		{"jti": nil},
+		{"exp": nil},
+		{"exp": time.Now().Unix() - 10},
+		{"exp": time.Now().Unix() + MAX_CLIENT_ASSERTION_LIFE + 60},
+	}
+
+	for i, claims := range invalid {
+		if _, _, err = VerifyClientAssertion(newAssertion(claims), cl, audiences); err == nil {
+			t.Errorf("assertion with the claims at index %d must be rejected", i)
+		}
+	}
+
+	// signed using a key not present in the JWKS
+	otherCert, otherKey := createTestCert()
+	otherSk := &SigningKey{Kid: jwk.Kid, Alg: "RS256", Cert: otherCert, PrivKey: otherKey}
+	forged := ToJwt(jwt.MapClaims{"iss": cl.Id, "sub": cl.Id, "aud": audiences[0], "jti": "2", "exp": time.Now().Unix() + 60}, otherSk)
+	if _, _, err = VerifyClientAssertion(forged, cl, audiences); err == nil {
+		t.Errorf("assertion signed using an unknown key must be rejected")
+	}
+
+	// the client secret must not be accepted as a key
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": cl.Id, "sub": cl.Id, "aud": audiences[0], "jti": "3", "exp": time.Now().Unix() + 60})
+	str, _ := hmac.SignedString([]byte("secret"))
+	if _, _, err = VerifyClientAssertion(str, cl, audiences); err == nil {
+		t.Errorf("assertion signed using HMAC must be rejected")
+	}
+}
+
+func TestAllowsAuthMethod(t *testing.T) {
+	oc := &ClientOauthConf{}
+	if !oc.AllowsAuthMethod(AUTH_METHOD_BASIC) || !oc.AllowsAuthMethod(AUTH_METHOD_POST) || oc.AllowsAuthMethod(AUTH_METHOD_PRIVATE_KEY_JWT) {
+		t.Errorf("only the secret methods must be allowed by default")
+	}
+
+	oc.TokenEndpointAuthMethod = AUTH_METHOD_PRIVATE_KEY_JWT
+	if oc.AllowsAuthMethod(AUTH_METHOD_BASIC) || !oc.AllowsAuthMethod(AUTH_METHOD_PRIVATE_KEY_JWT) {
+		t.Errorf("only the configured method must be allowed")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto/subtle"
+	"sparrow/utils"
+)
+
+// the results of verifying a client secret
+const (
+	SECRET_INVALID = iota
+	SECRET_VALID
+	SECRET_EXPIRED
+)
+
+// Verifies the given secret against the current secret of the client and, till the end of the overlap
+// window of the last rotation, against the previous secret. Returns the expiration time of the matched
+// secret in seconds since epoch, which is zero if the secret doesn't expire.
+func (oc *ClientOauthConf) VerifySecret(secret string, now int64) (status int, exp int64) {
+	if len(secret) == 0 {
+		return SECRET_INVALID, 0
+	}
+
+	if len(oc.Secret) != 0 && compareSecret(secret, oc.Secret) {
+		if oc.SecretExpiresAt != 0 && oc.SecretExpiresAt <= now {
+			return SECRET_EXPIRED, oc.SecretExpiresAt
+		}
+		return SECRET_VALID, oc.SecretExpiresAt
+	}
+
+	if len(oc.PrevSecret) != 0 && oc.PrevSecretExpiresAt > now && compareSecret(secret, oc.PrevSecret) {
+		return SECRET_VALID, oc.PrevSecretExpiresAt
+	}
+
+	return SECRET_INVALID, 0
+}
+
+// Returns true if the current secret of the client was stored before hashing was introduced.
+// Such a secret is replaced with its hash after the next successful authentication.
+func (oc *ClientOauthConf) HasPlainSecret() bool {
+	return len(oc.Secret) != 0 && !utils.IsPasswordHashed(oc.Secret)
+}
+
+// the secrets stored before hashing was introduced are compared as they are, in constant time
+func compareSecret(secret string, stored string) bool {
+	if !utils.IsPasswordHashed(stored) {
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(stored)) == 1
+	}
+
+	return utils.ComparePassword(secret, stored)
+}
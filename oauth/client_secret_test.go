@@ -0,0 +1,57 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"sparrow/utils"
+	"testing"
+)
+
+func TestVerifySecret(t *testing.T) {
+	now := int64(1000)
+	oc := &ClientOauthConf{}
+	oc.Secret = utils.HashPassword("current", "ssha256")
+	oc.SecretExpiresAt = now + 10
+	oc.PrevSecret = utils.HashPassword("previous", "ssha256")
+	oc.PrevSecretExpiresAt = now + 5
+
+	status, exp := oc.VerifySecret("current", now)
+	if status != SECRET_VALID || exp != oc.SecretExpiresAt {
+		t.Errorf("failed to verify the current secret")
+	}
+
+	status, exp = oc.VerifySecret("previous", now)
+	if status != SECRET_VALID || exp != oc.PrevSecretExpiresAt {
+		t.Errorf("the previous secret must be valid during the overlap")
+	}
+
+	if status, _ = oc.VerifySecret("previous", now+5); status != SECRET_INVALID {
+		t.Errorf("the previous secret must not be valid after the overlap")
+	}
+
+	if status, _ = oc.VerifySecret("current", now+10); status != SECRET_EXPIRED {
+		t.Errorf("the current secret must be expired")
+	}
+
+	for _, secret := range []string{"", "other", oc.Secret} {
+		if status, _ = oc.VerifySecret(secret, now); status != SECRET_INVALID {
+			t.Errorf("the secret '%s' must be rejected", secret)
+		}
+	}
+
+	// a secret stored before hashing was introduced
+	legacy := &ClientOauthConf{Secret: utils.NewRandShaStr()}
+	status, exp = legacy.VerifySecret(legacy.Secret, now)
+	if status != SECRET_VALID || exp != 0 {
+		t.Errorf("failed to verify the unhashed secret")
+	}
+
+	if status, _ = legacy.VerifySecret(legacy.Secret[1:], now); status != SECRET_INVALID {
+		t.Errorf("a prefix of the unhashed secret must be rejected")
+	}
+
+	if !legacy.HasPlainSecret() || oc.HasPlainSecret() {
+		t.Errorf("failed to detect the unhashed secret")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// a JSON Web Key as defined in RFC 7517
+type Jwk struct {
+	Kty     string   `json:"kty"`
+	Use     string   `json:"use"`
+	Alg     string   `json:"alg"`
+	Kid     string   `json:"kid"`
+	N       string   `json:"n,omitempty"`
+	E       string   `json:"e,omitempty"`
+	Crv     string   `json:"crv,omitempty"`
+	X       string   `json:"x,omitempty"`
+	Y       string   `json:"y,omitempty"`
+	X5c     []string `json:"x5c,omitempty"`
+	X5tS256 string   `json:"x5t#S256,omitempty"`
+}
+
+type JwkSet struct {
+	Keys []*Jwk `json:"keys"`
+}
+
+// the OpenID Connect discovery document
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type ProviderMetadata struct {
+	Issuer                  string   `json:"issuer"`
+	AuthzEndpoint           string   `json:"authorization_endpoint"`
+	TokenEndpoint           string   `json:"token_endpoint"`
+	IntrospectionEndpoint   string   `json:"introspection_endpoint"`
+	RevocationEndpoint      string   `json:"revocation_endpoint"`
+	DeviceAuthzEndpoint     string   `json:"device_authorization_endpoint"`
+	RegistrationEndpoint    string   `json:"registration_endpoint"`
+	UserinfoEndpoint        string   `json:"userinfo_endpoint"`
+	JwksUri                 string   `json:"jwks_uri"`
+	RespTypes               []string `json:"response_types_supported"`
+	GrantTypes              []string `json:"grant_types_supported"`
+	SubjectTypes            []string `json:"subject_types_supported"`
+	IdTokenSigningAlgs      []string `json:"id_token_signing_alg_values_supported"`
+	UserinfoSigningAlgs     []string `json:"userinfo_signing_alg_values_supported"`
+	Scopes                  []string `json:"scopes_supported"`
+	Claims                  []string `json:"claims_supported"`
+	TokenEndpointAuthMethds []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthAlgs   []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	ResponseModes           []string `json:"response_modes_supported"`
+	CodeChallengeMethods    []string `json:"code_challenge_methods_supported"`
+	AcrValues               []string `json:"acr_values_supported"`
+}
+
+// Returns the key ID of the given certificate, the ID is the base64url encoded
+// SHA-256 thumbprint of the DER encoded certificate
+func KeyIdOf(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Creates a JWK for verifying the signatures made, using the given algorithm, with the private key of the given certificate
+func NewJwk(cert *x509.Certificate, alg string) (*Jwk, error) {
+	kid := KeyIdOf(cert)
+	jwk := &Jwk{Use: "sig", Alg: alg, Kid: kid, X5tS256: kid}
+	jwk.X5c = []string{base64.StdEncoding.EncodeToString(cert.Raw)}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		// the coordinates must be padded to the size of the curve
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	return jwk, nil
+}
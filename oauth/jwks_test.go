@@ -0,0 +1,185 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestCert() (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "example.com"}}
+	tmpl.NotBefore = time.Now()
+	tmpl.NotAfter = tmpl.NotBefore.Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	return cert, key
+}
+
+func TestJwk(t *testing.T) {
+	cert, key := createTestCert()
+	jwk, err := NewJwk(cert, "RS256")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if jwk.Kty != "RSA" || jwk.Alg != "RS256" || jwk.Kid != KeyIdOf(cert) {
+		t.Errorf("invalid JWK %#v", jwk)
+	}
+
+	if jwk.E != "AQAB" {
+		t.Errorf("expected the exponent AQAB but found %s", jwk.E)
+	}
+
+	sk := &SigningKey{Kid: jwk.Kid, Alg: jwk.Alg, Cert: cert, PrivKey: key}
+	str := ToJwt(jwt.MapClaims{"sub": "1"}, sk)
+	token, err := jwt.Parse(str, func(jt *jwt.Token) (interface{}, error) {
+		if jt.Header["kid"] != jwk.Kid {
+			t.Errorf("kid is missing in the header of the token")
+		}
+		return cert.PublicKey, nil
+	})
+
+	if err != nil || !token.Valid {
+		t.Errorf("failed to verify the token %s", err)
+	}
+}
+
+func TestKeySetAlgorithms(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keyset")
+	defer os.RemoveAll(dir)
+
+	for _, alg := range []string{"RS256", "PS256", "ES256", "EdDSA"} {
+		ks, err := OpenKeySet(filepath.Join(dir, alg+".json"), "example.com", alg, 3600, 600, 600)
+		if err != nil {
+			t.Errorf("failed to open the keyset with algorithm %s %s", alg, err)
+			continue
+		}
+
+		jwks, err := ks.Jwks()
+		if err != nil || len(jwks.Keys) != 1 || jwks.Keys[0].Alg != alg {
+			t.Errorf("invalid JWKS of the keyset with algorithm %s %s", alg, err)
+		}
+
+		str := ToJwt(jwt.MapClaims{"sub": "1"}, ks.Active())
+		token, err := jwt.Parse(str, func(jt *jwt.Token) (interface{}, error) {
+			kid, _ := jt.Header["kid"].(string)
+			return ks.Get(kid).Cert.PublicKey, nil
+		})
+
+		if err != nil || !token.Valid || token.Method.Alg() != alg {
+			t.Errorf("failed to verify the token signed using %s %s", alg, err)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keyset")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	ks, err := OpenKeySet(path, "example.com", "ES256", 100, 10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := ks.Active()
+	start := time.Unix(first.ActivateAt, 0)
+
+	ks.Rotate(start.Add(50 * time.Second))
+	if len(ks.Keys()) != 1 {
+		t.Errorf("the successor must not be published before the pre-publish time")
+	}
+
+	// the successor must be published but not activated
+	ks.Rotate(start.Add(91 * time.Second))
+	keys := ks.Keys()
+	if len(keys) != 2 || keys[1].ActivateAt != first.RetireAt || ks.Active() != first {
+		t.Errorf("the successor was not published before its activation")
+	}
+
+	// the keys must be read back from the file
+	ks, err = OpenKeySet(path, "example.com", "ES256", 100, 10, 50)
+	if err != nil || len(ks.Keys()) != 2 || ks.Get(first.Kid) == nil {
+		t.Errorf("failed to load the keyset %s", err)
+	}
+
+	// the old key must be retained till it expires
+	ks.Rotate(start.Add(149 * time.Second))
+	if ks.Get(first.Kid) == nil {
+		t.Errorf("the replaced key must be retained till it expires")
+	}
+
+	ks.Rotate(start.Add(150 * time.Second))
+	if ks.Get(first.Kid) != nil || len(ks.Keys()) != 1 {
+		t.Errorf("the expired key must be removed")
+	}
+}
+
+func TestKeySetMerge(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "keyset")
+	defer os.RemoveAll(dir)
+
+	// two peers generating their keysets independently
+	ks1, err := OpenKeySet(filepath.Join(dir, "keys1.json"), "example.com", "ES256", 100, 10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks2, err := OpenKeySet(filepath.Join(dir, "keys2.json"), "example.com", "ES256", 100, 10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data1, _ := ks1.Export()
+	data2, _ := ks2.Export()
+	if err = ks1.Merge(data2); err != nil {
+		t.Fatal(err)
+	}
+	if err = ks2.Merge(data1); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ks1.Keys()) != 2 || len(ks2.Keys()) != 2 {
+		t.Errorf("the keys of the peer must be added")
+	}
+
+	if ks1.Active().Kid != ks2.Active().Kid {
+		t.Errorf("both the peers must select the same active key")
+	}
+
+	// merging the same keys again must not add any
+	ks1.Merge(data2)
+	if len(ks1.Keys()) != 2 {
+		t.Errorf("a key present in the keyset must not be added again")
+	}
+
+	// the merged keys must be read back from the file
+	ks1, err = OpenKeySet(filepath.Join(dir, "keys1.json"), "example.com", "ES256", 100, 10, 50)
+	if err != nil || len(ks1.Keys()) != 2 || ks1.Active().Kid != ks2.Active().Kid {
+		t.Errorf("failed to load the merged keyset %s", err)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a key used for signing the tokens issued by a domain, all the times are in seconds since epoch
+type SigningKey struct {
+	Kid        string            `json:"kid"`
+	Alg        string            `json:"alg"`
+	ActivateAt int64             `json:"activateAt"` // the time from which the key is used for signing
+	RetireAt   int64             `json:"retireAt"`   // the time at which the successor of this key gets activated
+	ExpireAt   int64             `json:"expireAt"`   // the time after which the key is no longer published
+	CertDer    []byte            `json:"cert"`       // DER encoded self-signed certificate
+	KeyDer     []byte            `json:"key"`        // PKCS#8 encoded private key
+	Cert       *x509.Certificate `json:"-"`
+	PrivKey    crypto.PrivateKey `json:"-"`
+}
+
+// the set of signing keys of a domain. Keys get rotated on a schedule, a new key gets
+// published prePublishTime seconds before it is used for signing and a replaced key
+// gets published for retentionTime seconds to allow the verification of the tokens it signed
+type KeySet struct {
+	mutex            sync.RWMutex
+	path             string
+	cn               string // the common name used in the certificates
+	alg              string // the algorithm of the keys that will be generated
+	rotationInterval int64
+	prePublishTime   int64
+	retentionTime    int64
+	keys             []*SigningKey // sorted in the order of activation
+}
+
+// Opens the keyset stored in the given file and generates the keys if they are due
+func OpenKeySet(path string, cn string, alg string, rotationInterval int, prePublishTime int, retentionTime int) (ks *KeySet, err error) {
+	ks = &KeySet{path: path, cn: cn, alg: alg}
+	ks.rotationInterval = int64(rotationInterval)
+	ks.prePublishTime = int64(prePublishTime)
+	ks.retentionTime = int64(retentionTime)
+	ks.keys = make([]*SigningKey, 0)
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		ks.keys, err = parseKeys(data)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, err = ks.Rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Removes the expired keys, and generates a key if there is none for signing or if it is
+// time to publish the successor of the active key. Must be called periodically.
+// Returns true if a new key was generated.
+func (ks *KeySet) Rotate(now time.Time) (generated bool, err error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	t := now.Unix()
+	changed := false
+
+	keys := make([]*SigningKey, 0)
+	for _, sk := range ks.keys {
+		if sk.ExpireAt > t {
+			keys = append(keys, sk)
+		} else {
+			log.Debugf("removing the expired signing key %s of %s", sk.Kid, ks.cn)
+			changed = true
+		}
+	}
+
+	var activateAt int64 = -1
+	if len(keys) == 0 || keys[len(keys)-1].RetireAt <= t {
+		// happens when the keyset is created or when the server was
+		// down for longer than the rotation interval
+		activateAt = t
+	} else {
+		last := keys[len(keys)-1]
+		if last.ActivateAt <= t && (last.RetireAt-ks.prePublishTime) <= t {
+			activateAt = last.RetireAt
+		}
+	}
+
+	if activateAt >= 0 {
+		sk, err := ks.newKey(activateAt)
+		if err != nil {
+			return false, err
+		}
+		log.Debugf("generated a new signing key %s for %s, it will be activated at %s", sk.Kid, ks.cn, time.Unix(activateAt, 0))
+		keys = append(keys, sk)
+		changed = true
+		generated = true
+	}
+
+	ks.keys = keys
+
+	if changed {
+		err = ks.save()
+	}
+
+	return generated, err
+}
+
+// Returns the JSON encoded keys, used for replicating the keyset to the peers
+func (ks *KeySet) Export() ([]byte, error) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return json.Marshal(ks.keys)
+}
+
+// Adds the unexpired keys present in the given JSON encoded keys (as returned by Export())
+// of a peer that are not present in this keyset. When the peers generate keys at the same
+// time all of them are retained, the keys are ordered by their activation time and ID so
+// that every peer selects the same active key.
+func (ks *KeySet) Merge(data []byte) error {
+	peerKeys, err := parseKeys(data)
+	if err != nil {
+		return err
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	now := time.Now().Unix()
+	changed := false
+	for _, pk := range peerKeys {
+		if pk.ExpireAt <= now {
+			continue
+		}
+
+		found := false
+		for _, sk := range ks.keys {
+			if sk.Kid == pk.Kid {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			log.Debugf("adding the signing key %s of %s received from a peer", pk.Kid, ks.cn)
+			ks.keys = append(ks.keys, pk)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	sort.SliceStable(ks.keys, func(i, j int) bool {
+		ki := ks.keys[i]
+		kj := ks.keys[j]
+		if ki.ActivateAt == kj.ActivateAt {
+			return ki.Kid < kj.Kid
+		}
+		return ki.ActivateAt < kj.ActivateAt
+	})
+
+	return ks.save()
+}
+
+// Returns the key that must be used for signing
+func (ks *KeySet) Active() *SigningKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	now := time.Now().Unix()
+	var active *SigningKey
+	for _, sk := range ks.keys {
+		if sk.ActivateAt <= now {
+			active = sk
+		}
+	}
+
+	// only possible if the clock is turned back
+	if active == nil && len(ks.keys) > 0 {
+		active = ks.keys[0]
+	}
+
+	return active
+}
+
+// Returns the key with the given ID or nil if there is no such key
+func (ks *KeySet) Get(kid string) *SigningKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, sk := range ks.keys {
+		if sk.Kid == kid {
+			return sk
+		}
+	}
+
+	return nil
+}
+
+// Returns all the published keys including the ones that are yet to be activated
+func (ks *KeySet) Keys() []*SigningKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	keys := make([]*SigningKey, len(ks.keys))
+	copy(keys, ks.keys)
+
+	return keys
+}
+
+// Returns the JWKS document containing all the published keys
+func (ks *KeySet) Jwks() (*JwkSet, error) {
+	jwks := &JwkSet{Keys: make([]*Jwk, 0)}
+	for _, sk := range ks.Keys() {
+		jwk, err := NewJwk(sk.Cert, sk.Alg)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, nil
+}
+
+func (ks *KeySet) newKey(activateAt int64) (*SigningKey, error) {
+	signer, err := generateKey(ks.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	sk := &SigningKey{Alg: ks.alg, ActivateAt: activateAt}
+	sk.RetireAt = activateAt + ks.rotationInterval
+	sk.ExpireAt = sk.RetireAt + ks.retentionTime
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{SerialNumber: serial}
+	tmpl.Subject = pkix.Name{CommonName: ks.cn}
+	tmpl.NotBefore = time.Now()
+	tmpl.NotAfter = time.Unix(sk.ExpireAt, 0)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+
+	sk.CertDer, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	sk.Cert, err = x509.ParseCertificate(sk.CertDer)
+	if err != nil {
+		return nil, err
+	}
+
+	sk.KeyDer, err = x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	sk.PrivKey = signer
+	sk.Kid = KeyIdOf(sk.Cert)
+
+	return sk, nil
+}
+
+// writes the keys to a temporary file first to avoid leaving a partially written keyset
+func (ks *KeySet) save() error {
+	data, err := json.Marshal(ks.keys)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := ks.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, ks.path)
+}
+
+func parseKeys(data []byte) ([]*SigningKey, error) {
+	keys := make([]*SigningKey, 0)
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sk := range keys {
+		sk.Cert, err = x509.ParseCertificate(sk.CertDer)
+		if err != nil {
+			return nil, err
+		}
+
+		sk.PrivKey, err = x509.ParsePKCS8PrivateKey(sk.KeyDer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256", "PS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	case "EdDSA":
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return privKey, err
+	}
+
+	return nil, fmt.Errorf("unsupported signing algorithm %s", alg)
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"bytes"
+	"encoding/gob"
+	bolt "github.com/coreos/bbolt"
+	"sparrow/utils"
+	"strings"
+	"time"
+)
+
+const (
+	DEVICE_GRANT_PENDING = iota
+	DEVICE_GRANT_APPROVED
+	DEVICE_GRANT_DENIED
+)
+
+// the characters used in the user codes, vowels are excluded to avoid forming words (RFC 8628 section 6.1)
+const userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+const USER_CODE_LEN = 8
+
+// a grant created by the device authorization endpoint, RFC 8628. The device polls the token
+// endpoint using the DeviceCode while the user approves the grant by entering the UserCode.
+type DeviceGrant struct {
+	DeviceCode   string
+	UserCode     string // stored without the separator
+	ClientId     string
+	Scope        string // the scopes requested by the device
+	CreatedAt    int64
+	Exp          int64
+	Interval     int64 // the minimum number of seconds the device must wait between polling requests
+	LastPolledAt int64
+	UserId       string   // the ID of the user who approved or denied the grant
+	AuthTime     int64    // the time when the user was authenticated
+	Amr          []string // the methods used for authenticating the user
+	Status       int
+}
+
+// Creates a pending device grant which expires after ttl seconds
+func NewDeviceGrant(cl *Client, scope string, ttl int, interval int) *DeviceGrant {
+	now := time.Now().Unix()
+	dg := &DeviceGrant{DeviceCode: utils.NewRandShaStr(), UserCode: newUserCode(), ClientId: cl.Id, Scope: scope}
+	dg.CreatedAt = now
+	dg.Exp = now + int64(ttl)
+	dg.Interval = int64(interval)
+
+	return dg
+}
+
+func (dg *DeviceGrant) IsExpired() bool {
+	return dg.Exp <= time.Now().Unix()
+}
+
+// Returns the user code in the form shown to the user, e.g. WDJB-MJHT
+func (dg *DeviceGrant) DisplayUserCode() string {
+	half := len(dg.UserCode) / 2
+	return dg.UserCode[:half] + "-" + dg.UserCode[half:]
+}
+
+// Normalizes the user code entered by the user by removing the separators and whitespace
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, userCode)
+}
+
+func newUserCode() string {
+	var sb strings.Builder
+	n := len(userCodeChars)
+	limit := 256 - (256 % n) // to avoid the modulo bias
+	for sb.Len() < USER_CODE_LEN {
+		for _, b := range utils.RandBytes(USER_CODE_LEN) {
+			if int(b) < limit && sb.Len() < USER_CODE_LEN {
+				sb.WriteByte(userCodeChars[int(b)%n])
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+func (osl *OauthSilo) StoreDeviceGrant(dg *DeviceGrant) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		return osl._storeDeviceGrantUsingTx(dg, tx)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to save device grant %s", err)
+		panic(err)
+	}
+}
+
+func (osl *OauthSilo) _storeDeviceGrantUsingTx(dg *DeviceGrant, tx *bolt.Tx) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(dg)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(dg.DeviceCode)
+	err = tx.Bucket(BUC_DEVICE_GRANTS).Put(key, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	exp := utils.Itob(dg.Exp)
+	err = tx.Bucket(BUC_IDX_DEVICE_GRANT_BY_ID).Put(key, exp)
+	if err != nil {
+		return err
+	}
+
+	userCode := []byte(dg.UserCode)
+	err = tx.Bucket(BUC_DEVICE_USER_CODES).Put(userCode, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(BUC_IDX_DEVICE_USER_CODE_BY_ID).Put(userCode, exp)
+}
+
+func (osl *OauthSilo) _getDeviceGrantUsingTx(deviceCode []byte, tx *bolt.Tx) *DeviceGrant {
+	data := tx.Bucket(BUC_DEVICE_GRANTS).Get(deviceCode)
+	if len(data) == 0 {
+		return nil
+	}
+
+	var dg *DeviceGrant
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	err := dec.Decode(&dg)
+	if err != nil {
+		panic(err)
+	}
+
+	return dg
+}
+
+func (osl *OauthSilo) _deleteDeviceGrantUsingTx(dg *DeviceGrant, tx *bolt.Tx) {
+	key := []byte(dg.DeviceCode)
+	tx.Bucket(BUC_DEVICE_GRANTS).Delete(key)
+	tx.Bucket(BUC_IDX_DEVICE_GRANT_BY_ID).Delete(key)
+
+	userCode := []byte(dg.UserCode)
+	tx.Bucket(BUC_DEVICE_USER_CODES).Delete(userCode)
+	tx.Bucket(BUC_IDX_DEVICE_USER_CODE_BY_ID).Delete(userCode)
+}
+
+// Deletes the grant with the given device code, if present
+func (osl *OauthSilo) DeleteDeviceGrant(deviceCode string) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		dg := osl._getDeviceGrantUsingTx([]byte(deviceCode), tx)
+		if dg != nil {
+			osl._deleteDeviceGrantUsingTx(dg, tx)
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Warningf("Failed to delete the device grant %s", err)
+		panic(err)
+	}
+}
+
+// Returns the unexpired grant with the given user code, the user code will be normalized before lookup
+func (osl *OauthSilo) GetDeviceGrantByUserCode(userCode string) (dg *DeviceGrant) {
+	osl.db.View(func(tx *bolt.Tx) error {
+		deviceCode := tx.Bucket(BUC_DEVICE_USER_CODES).Get([]byte(NormalizeUserCode(userCode)))
+		if deviceCode != nil {
+			dg = osl._getDeviceGrantUsingTx(deviceCode, tx)
+		}
+		return nil
+	})
+
+	if dg != nil && dg.IsExpired() {
+		dg = nil
+	}
+
+	return dg
+}
+
+// Records the decision of the user, along with the details of the user's authentication, on the pending grant
+// with the given user code. Returns false if there is no such grant or if the grant was already approved or denied.
+func (osl *OauthSilo) DecideDeviceGrant(userCode string, userId string, authTime int64, amr []string, approved bool) (updated bool) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		deviceCode := tx.Bucket(BUC_DEVICE_USER_CODES).Get([]byte(NormalizeUserCode(userCode)))
+		if deviceCode == nil {
+			return nil
+		}
+
+		dg := osl._getDeviceGrantUsingTx(deviceCode, tx)
+		if dg == nil || dg.IsExpired() || dg.Status != DEVICE_GRANT_PENDING {
+			return nil
+		}
+
+		dg.UserId = userId
+		dg.AuthTime = authTime
+		dg.Amr = amr
+		dg.Status = DEVICE_GRANT_DENIED
+		if approved {
+			dg.Status = DEVICE_GRANT_APPROVED
+		}
+
+		updated = true
+		return osl._storeDeviceGrantUsingTx(dg, tx)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to update the device grant %s", err)
+		panic(err)
+	}
+
+	return updated
+}
+
+// Fetches the grant with the given device code, issued to the given client, on behalf of the polling
+// device. The slowDown flag will be true if the device polled before the interval elapsed, in which case
+// the interval gets increased by 5 seconds. A grant that was approved or denied gets deleted as the
+// device code can only be used once. A nil grant is returned if there is no grant with the given
+// device code or if it belongs to a different client.
+func (osl *OauthSilo) PollDeviceGrant(deviceCode string, clientId string) (dg *DeviceGrant, slowDown bool) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		dg = osl._getDeviceGrantUsingTx([]byte(deviceCode), tx)
+		if dg == nil || dg.ClientId != clientId {
+			dg = nil
+			return nil
+		}
+
+		if dg.Status != DEVICE_GRANT_PENDING || dg.IsExpired() {
+			osl._deleteDeviceGrantUsingTx(dg, tx)
+			return nil
+		}
+
+		now := time.Now().Unix()
+		if dg.LastPolledAt > 0 && (now-dg.LastPolledAt) < dg.Interval {
+			slowDown = true
+			dg.Interval += 5
+		}
+		dg.LastPolledAt = now
+
+		return osl._storeDeviceGrantUsingTx(dg, tx)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to poll the device grant %s", err)
+		panic(err)
+	}
+
+	return dg, slowDown
+}
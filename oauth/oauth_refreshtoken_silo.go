@@ -0,0 +1,209 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"bytes"
+	"encoding/gob"
+	bolt "github.com/coreos/bbolt"
+	"sparrow/utils"
+	"time"
+)
+
+// A refresh token issued to a client. Refresh tokens are rotated on every use, all the tokens
+// issued by rotating a token belong to the same family and share the family's life time.
+type RefreshToken struct {
+	Id        string // the value sent to the client
+	FamilyId  string // the ID of the first token of the family
+	ClientId  string
+	UserId    string
+	OpenId    bool   // flag to indicate that an ID token must be issued along with the access token
+	AcTokenId string // the ID of the access token issued along with this refresh token
+	Scope     string // the scopes granted to the access tokens issued using this token
+	CreatedAt int64
+	Exp       int64    // the time at which this token expires if not used
+	FamilyExp int64    // the time at which all the tokens of the family expire
+	Used      bool     // flag to indicate that this token was already exchanged for a new one
+	AuthTime  int64    // the time when the user was authenticated
+	Amr       []string // the methods used for authenticating the user
+}
+
+// Creates the first refresh token of a new family
+func NewRefreshToken(cl *Client, userId string, acTokenId string, openId bool) *RefreshToken {
+	now := time.Now().Unix()
+	rt := &RefreshToken{Id: utils.NewRandShaStr(), ClientId: cl.Id, UserId: userId, OpenId: openId}
+	rt.FamilyId = rt.Id
+	rt.FamilyExp = now + cl.Oauth.RefreshTokenValidity
+	rt.setExp(cl, now, acTokenId)
+
+	return rt
+}
+
+// Creates the successor of this token
+func (rt *RefreshToken) Next(cl *Client, acTokenId string) *RefreshToken {
+	next := &RefreshToken{Id: utils.NewRandShaStr(), FamilyId: rt.FamilyId, ClientId: rt.ClientId, UserId: rt.UserId, OpenId: rt.OpenId}
+	next.FamilyExp = rt.FamilyExp
+	next.Scope = rt.Scope
+	next.AuthTime = rt.AuthTime
+	next.Amr = rt.Amr
+	next.setExp(cl, time.Now().Unix(), acTokenId)
+
+	return next
+}
+
+func (rt *RefreshToken) setExp(cl *Client, now int64, acTokenId string) {
+	rt.CreatedAt = now
+	rt.AcTokenId = acTokenId
+	rt.Exp = rt.FamilyExp
+	idleTime := cl.Oauth.RefreshTokenIdleTime
+	if idleTime > 0 && (now+idleTime) < rt.Exp {
+		rt.Exp = now + idleTime
+	}
+}
+
+func (rt *RefreshToken) IsExpired() bool {
+	return rt.Exp <= time.Now().Unix()
+}
+
+func (osl *OauthSilo) StoreRefreshToken(rt *RefreshToken) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		return osl._storeRefreshTokenUsingTx(rt, tx)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to save refresh token %s", err)
+		panic(err)
+	}
+}
+
+func (osl *OauthSilo) _storeRefreshTokenUsingTx(rt *RefreshToken, tx *bolt.Tx) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(rt)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(rt.Id)
+	err = tx.Bucket(BUC_REFRESH_TOKENS).Put(key, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// a used token is retained till the family expires for detecting its reuse
+	exp := rt.Exp
+	if rt.Used {
+		exp = rt.FamilyExp
+	}
+
+	err = tx.Bucket(BUC_IDX_REFRESH_TOKEN_BY_ID).Put(key, utils.Itob(exp))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(BUC_IDX_REFRESH_TOKEN_BY_FAMILY).Put(familyIdxKey(rt.FamilyId, rt.Id), []byte{})
+}
+
+// deletes the refresh token with the given ID along with its index entries
+func (osl *OauthSilo) _deleteRefreshTokenUsingTx(id []byte, tx *bolt.Tx) {
+	rt := osl._getRefreshTokenUsingTx(string(id), tx)
+	if rt != nil {
+		tx.Bucket(BUC_IDX_REFRESH_TOKEN_BY_FAMILY).Delete(familyIdxKey(rt.FamilyId, rt.Id))
+	}
+
+	tx.Bucket(BUC_REFRESH_TOKENS).Delete(id)
+	tx.Bucket(BUC_IDX_REFRESH_TOKEN_BY_ID).Delete(id)
+}
+
+// the key of a token in the family index, the IDs never contain the separator
+func familyIdxKey(familyId string, id string) []byte {
+	return []byte(familyId + ":" + id)
+}
+
+func (osl *OauthSilo) _getRefreshTokenUsingTx(id string, tx *bolt.Tx) *RefreshToken {
+	data := tx.Bucket(BUC_REFRESH_TOKENS).Get([]byte(id))
+	if len(data) == 0 {
+		return nil
+	}
+
+	var rt *RefreshToken
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	err := dec.Decode(&rt)
+	if err != nil {
+		panic(err)
+	}
+
+	return rt
+}
+
+func (osl *OauthSilo) GetRefreshToken(id string) (rt *RefreshToken) {
+	osl.db.View(func(tx *bolt.Tx) error {
+		rt = osl._getRefreshTokenUsingTx(id, tx)
+		return nil
+	})
+
+	return rt
+}
+
+// Marks the refresh token with the given ID, issued to the given client, as used. The returned flag
+// will be true if the token was already used before. A nil token is returned if there is no token
+// with the given ID or if it belongs to a different client.
+func (osl *OauthSilo) UseRefreshToken(id string, clientId string) (rt *RefreshToken, reused bool) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		rt = osl._getRefreshTokenUsingTx(id, tx)
+		if rt == nil || rt.ClientId != clientId {
+			rt = nil
+			return nil
+		}
+
+		if rt.Used {
+			reused = true
+			return nil
+		}
+
+		rt.Used = true
+		return osl._storeRefreshTokenUsingTx(rt, tx)
+	})
+
+	if err != nil {
+		log.Warningf("Failed to mark the refresh token as used %s", err)
+		panic(err)
+	}
+
+	return rt, reused
+}
+
+// Deletes all the refresh tokens of the given family and revokes the access tokens issued along with them
+func (osl *OauthSilo) RevokeRefreshTokenFamily(familyId string) {
+	acTokenIds := make([]string, 0)
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		prefix := familyIdxKey(familyId, "")
+		ids := make([][]byte, 0)
+		cursor := tx.Bucket(BUC_IDX_REFRESH_TOKEN_BY_FAMILY).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			ids = append(ids, append([]byte(nil), k[len(prefix):]...))
+		}
+
+		// deleting while iterating with the cursor skips the keys
+		for _, id := range ids {
+			if rt := osl._getRefreshTokenUsingTx(string(id), tx); rt != nil {
+				acTokenIds = append(acTokenIds, rt.AcTokenId)
+			}
+			osl._deleteRefreshTokenUsingTx(id, tx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Warningf("Failed to revoke the refresh token family %s %s", familyId, err)
+		panic(err)
+	}
+
+	for _, jti := range acTokenIds {
+		osl.RevokeOauthSession(jti)
+	}
+
+	log.Debugf("revoked the refresh token family %s", familyId)
+}
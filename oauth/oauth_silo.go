@@ -12,6 +12,8 @@ import (
 	"sparrow/base"
 	"sparrow/utils"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,12 +27,32 @@ var (
 	BUC_IDX_OAUTH_SESSION_BY_JTI = []byte("idx_token_by_jti")
 
 	BUC_IDX_SSO_SESSION_BY_JTI = []byte("idx_session_by_jti")
+
+	BUC_REFRESH_TOKENS = []byte("refresh_tokens")
+
+	BUC_IDX_REFRESH_TOKEN_BY_ID = []byte("idx_refresh_token_by_id")
+
+	// the keys are formed by joining the family ID and the token ID, the values are empty
+	BUC_IDX_REFRESH_TOKEN_BY_FAMILY = []byte("idx_refresh_token_by_family")
+
+	BUC_DEVICE_GRANTS = []byte("device_grants")
+
+	BUC_IDX_DEVICE_GRANT_BY_ID = []byte("idx_device_grant_by_id")
+
+	BUC_DEVICE_USER_CODES = []byte("device_user_codes")
+
+	BUC_IDX_DEVICE_USER_CODE_BY_ID = []byte("idx_device_user_code_by_id")
+
+	// holds the expiration times of the used client assertions, the bucket is its own index
+	BUC_CLIENT_ASSERTIONS = []byte("client_assertions")
 )
 
 type OauthSilo struct {
+	oauthCount         int64 // the number of stored OAuth sessions, accessed atomically
 	db                 *bolt.DB
 	tokenPurgeInterval int
 	rvTokens           map[string]bool
+	rvLock             sync.RWMutex // guards rvTokens
 	grantSilo          *oauthGrantCodeSilo
 }
 
@@ -73,6 +95,28 @@ func Open(path string, tokenPurgeInterval int, grantCodePurgeInterval int, grant
 			return err
 		}
 
+		_, err = tx.CreateBucketIfNotExists(BUC_REFRESH_TOKENS)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(BUC_IDX_REFRESH_TOKEN_BY_ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(BUC_IDX_REFRESH_TOKEN_BY_FAMILY)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{BUC_DEVICE_GRANTS, BUC_IDX_DEVICE_GRANT_BY_ID, BUC_DEVICE_USER_CODES, BUC_IDX_DEVICE_USER_CODE_BY_ID, BUC_CLIENT_ASSERTIONS} {
+			_, err = tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
@@ -85,6 +129,10 @@ func Open(path string, tokenPurgeInterval int, grantCodePurgeInterval int, grant
 	osl.db = db
 	osl.tokenPurgeInterval = tokenPurgeInterval
 	osl.rvTokens = make(map[string]bool)
+	osl.db.View(func(tx *bolt.Tx) error {
+		osl.oauthCount = int64(tx.Bucket(BUC_IDX_OAUTH_SESSION_BY_JTI).Stats().KeyN)
+		return nil
+	})
 
 	if strings.HasSuffix(path, ".db") {
 		path = path[0 : len(path)-3]
@@ -107,6 +155,14 @@ func Open(path string, tokenPurgeInterval int, grantCodePurgeInterval int, grant
 
 	go removeExpiredSessions(osl, BUC_SSO_SESSIONS, BUC_IDX_SSO_SESSION_BY_JTI)
 
+	go removeExpiredSessions(osl, BUC_REFRESH_TOKENS, BUC_IDX_REFRESH_TOKEN_BY_ID)
+
+	go removeExpiredSessions(osl, BUC_DEVICE_GRANTS, BUC_IDX_DEVICE_GRANT_BY_ID)
+
+	go removeExpiredSessions(osl, BUC_DEVICE_USER_CODES, BUC_IDX_DEVICE_USER_CODE_BY_ID)
+
+	go removeExpiredSessions(osl, BUC_CLIENT_ASSERTIONS, BUC_CLIENT_ASSERTIONS)
+
 	return osl, nil
 }
 
@@ -137,10 +193,13 @@ func (osl *OauthSilo) _storeSession(bucketName []byte, idxBuckName []byte, sessi
 		}
 	}()
 
-	osl._storeSessionUsingTx(bucketName, idxBuckName, session, tx)
+	if osl._storeSessionUsingTx(bucketName, idxBuckName, session, tx) {
+		osl.sessionsAdded(bucketName, 1)
+	}
 }
 
-func (osl *OauthSilo) _storeSessionUsingTx(bucketName []byte, idxBuckName []byte, session *base.RbacSession, tx *bolt.Tx) {
+// returns true if the session was not already present in the given bucket
+func (osl *OauthSilo) _storeSessionUsingTx(bucketName []byte, idxBuckName []byte, session *base.RbacSession, tx *bolt.Tx) bool {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(session)
@@ -152,6 +211,7 @@ func (osl *OauthSilo) _storeSessionUsingTx(bucketName []byte, idxBuckName []byte
 
 	clBucket := tx.Bucket(bucketName)
 	key := []byte(session.Jti)
+	added := clBucket.Get(key) == nil
 	err = clBucket.Put(key, buf.Bytes())
 
 	if err != nil {
@@ -162,6 +222,8 @@ func (osl *OauthSilo) _storeSessionUsingTx(bucketName []byte, idxBuckName []byte
 	idxBuck := tx.Bucket(idxBuckName)
 	expTime := utils.Itob(session.Exp)
 	idxBuck.Put(key, expTime)
+
+	return added
 }
 
 func (osl *OauthSilo) RevokeOauthSession(jti string) {
@@ -173,7 +235,9 @@ func (osl *OauthSilo) RevokeOauthSession(jti string) {
 		existing := tBucket.Get(key)
 		if len(existing) == 0 { // only revoke if it wasn't already
 			// AUDIT
+			osl.rvLock.Lock()
 			osl.rvTokens[jti] = true
+			osl.rvLock.Unlock()
 			return tBucket.Put(key, utils.Itob(now))
 		}
 
@@ -189,7 +253,9 @@ func (osl *OauthSilo) RevokeOauthSession(jti string) {
 }
 
 func (osl *OauthSilo) IsRevokedSession(jti string) bool {
+	osl.rvLock.RLock()
 	_, ok := osl.rvTokens[jti]
+	osl.rvLock.RUnlock()
 
 	return ok
 }
@@ -201,6 +267,9 @@ func (osl *OauthSilo) loadRevokedSessions() int {
 		return 0
 	}
 
+	osl.rvLock.Lock()
+	defer osl.rvLock.Unlock()
+
 	tBucket := tx.Bucket(BUC_REVOKED_OAUTH_SESSIONS)
 	cursor := tBucket.Cursor()
 	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
@@ -272,6 +341,7 @@ func (osl *OauthSilo) _deleteSession(bucketName []byte, idxBuckName []byte, jti
 
 	tBucket := tx.Bucket(bucketName)
 	key := []byte(jti)
+	existed := tBucket.Get(key) != nil
 	tBucket.Delete(key)
 
 	idxBuck := tx.Bucket(idxBuckName)
@@ -282,6 +352,10 @@ func (osl *OauthSilo) _deleteSession(bucketName []byte, idxBuckName []byte, jti
 		panic(err)
 	}
 
+	if existed {
+		osl.sessionsAdded(bucketName, -1)
+	}
+
 	return true
 }
 
@@ -307,12 +381,75 @@ func (osl *OauthSilo) AddAppToSsoSession(jti string, spIssuer string, sas base.S
 	osl._storeSessionUsingTx(BUC_SSO_SESSIONS, BUC_IDX_SSO_SESSION_BY_JTI, session, tx)
 }
 
+// Records the use of the client assertion with the given ID till it expires, section 3 of RFC 7523.
+// Returns false if the assertion was already used by the client.
+func (osl *OauthSilo) UseClientAssertion(clientId string, jti string, exp int64) (unused bool) {
+	err := osl.db.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(BUC_CLIENT_ASSERTIONS)
+		key := []byte(clientId + ":" + jti)
+		if buck.Get(key) != nil {
+			return nil
+		}
+
+		unused = true
+		return buck.Put(key, utils.Itob(exp))
+	})
+
+	if err != nil {
+		log.Warningf("Failed to save the ID of the client assertion %s", err)
+		return false
+	}
+
+	return unused
+}
+
+// Returns the number of OAuth sessions stored in the silo without scanning them, the expired
+// sessions are included till they get purged
+func (osl *OauthSilo) OauthSessionCount() int {
+	return int(atomic.LoadInt64(&osl.oauthCount))
+}
+
+// keeps the running count of the OAuth sessions in sync with the given bucket
+func (osl *OauthSilo) sessionsAdded(bucketName []byte, delta int64) {
+	if bytes.Equal(bucketName, BUC_OAUTH_SESSIONS) {
+		atomic.AddInt64(&osl.oauthCount, delta)
+	}
+}
+
+// Returns the number of OAuth and SSO sessions present in the silo
+func (osl *OauthSilo) CountSessions() (oauthCount int, ssoCount int) {
+	now := time.Now().Unix()
+	osl.db.View(func(tx *bolt.Tx) error {
+		oauthCount = countUnexpired(tx.Bucket(BUC_IDX_OAUTH_SESSION_BY_JTI), now)
+		ssoCount = countUnexpired(tx.Bucket(BUC_IDX_SSO_SESSION_BY_JTI), now)
+		return nil
+	})
+
+	return oauthCount, ssoCount
+}
+
+// counts the entries of the given expiry index that are not yet expired, the expired
+// entries stay in the index till they get purged and must not count as active sessions
+func countUnexpired(idxBuck *bolt.Bucket, now int64) int {
+	count := 0
+	cursor := idxBuck.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if utils.Btoi(v) > now {
+			count++
+		}
+	}
+
+	return count
+}
+
 func (osl *OauthSilo) Close() {
 	log.Infof("Closing token silo")
 	osl.db.Close()
 	osl.grantSilo.db.Close()
 	osl.db = nil
+	osl.rvLock.Lock()
 	osl.rvTokens = nil
+	osl.rvLock.Unlock()
 }
 
 func removeExpiredSessions(osl *OauthSilo, buckName []byte, idxBuckName []byte) {
@@ -338,18 +475,30 @@ func removeExpiredSessions(osl *OauthSilo, buckName []byte, idxBuckName []byte)
 
 		t := time.Now()
 		now := t.Unix()
+		expired := make([][]byte, 0)
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
 			exp := utils.Btoi(v)
 			if exp <= now {
-				log.Debugf("Removed expired token %s", string(k))
-				idxBuck.Delete(k)
-				tokenBuck.Delete(k)
+				expired = append(expired, append([]byte(nil), k...))
 			} else {
 				//log.Debugf("token %d didn't expire at %s", exp, t.Format(time.RFC3339))
 			}
 		}
 
-		tx.Commit()
+		// deleting while iterating with the cursor skips the keys
+		for _, k := range expired {
+			log.Debugf("Removed expired token %s", string(k))
+			if bytes.Equal(buckName, BUC_REFRESH_TOKENS) {
+				osl._deleteRefreshTokenUsingTx(k, tx)
+				continue
+			}
+			idxBuck.Delete(k)
+			tokenBuck.Delete(k)
+		}
+
+		if tx.Commit() == nil {
+			osl.sessionsAdded(buckName, -int64(len(expired)))
+		}
 
 		sleepTime := time.Duration(osl.tokenPurgeInterval) * time.Second
 		log.Debugf("Sleeping for %s", sleepTime)
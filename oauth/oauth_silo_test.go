@@ -5,9 +5,12 @@ package oauth
 
 import (
 	"fmt"
+	bolt "github.com/coreos/bbolt"
 	logger "github.com/juju/loggo"
 	"os"
+	"sparrow/base"
 	"sparrow/utils"
+	"strings"
 	"testing"
 	"time"
 )
@@ -108,3 +111,269 @@ func TestGrantCodeAddAndPurge(t *testing.T) {
 		}
 	}
 }
+
+func TestCountSessions(t *testing.T) {
+	initSilo()
+
+	exp := time.Now().Unix() + 600
+	for i := 0; i < 3; i++ {
+		session := &base.RbacSession{Jti: utils.NewRandShaStr(), Exp: exp}
+		osl.StoreOauthSession(session)
+	}
+
+	sso := &base.RbacSession{Jti: utils.NewRandShaStr(), Exp: exp}
+	osl.StoreSsoSession(sso)
+
+	oauthCount, ssoCount := osl.CountSessions()
+	if oauthCount != 3 {
+		t.Errorf("expected 3 oauth sessions but found %d", oauthCount)
+	}
+
+	if ssoCount != 1 {
+		t.Errorf("expected 1 SSO session but found %d", ssoCount)
+	}
+}
+
+func TestCountSessionsSkipsExpired(t *testing.T) {
+	initSilo()
+
+	now := time.Now().Unix()
+	osl.StoreOauthSession(&base.RbacSession{Jti: utils.NewRandShaStr(), Exp: now + 600})
+	osl.StoreOauthSession(&base.RbacSession{Jti: utils.NewRandShaStr(), Exp: now - 1})
+	osl.StoreSsoSession(&base.RbacSession{Jti: utils.NewRandShaStr(), Exp: now - 1})
+
+	// the expired sessions are not yet purged but must not be counted
+	oauthCount, ssoCount := osl.CountSessions()
+	if oauthCount != 1 {
+		t.Errorf("expected 1 unexpired oauth session but found %d", oauthCount)
+	}
+
+	if ssoCount != 0 {
+		t.Errorf("expected no unexpired SSO sessions but found %d", ssoCount)
+	}
+}
+
+func TestOauthSessionCount(t *testing.T) {
+	initSilo()
+
+	session := &base.RbacSession{Jti: utils.NewRandShaStr(), Exp: time.Now().Unix() + 600}
+	osl.StoreOauthSession(session)
+	osl.StoreOauthSession(session) // storing the same session again must not count twice
+	osl.StoreOauthSession(&base.RbacSession{Jti: utils.NewRandShaStr(), Exp: time.Now().Unix() + 600})
+	osl.StoreSsoSession(&base.RbacSession{Jti: utils.NewRandShaStr(), Exp: time.Now().Unix() + 600})
+	if count := osl.OauthSessionCount(); count != 2 {
+		t.Errorf("expected 2 oauth sessions but found %d", count)
+	}
+
+	osl.DeleteOauthSession(session.Jti)
+	osl.DeleteOauthSession(session.Jti)
+	if count := osl.OauthSessionCount(); count != 1 {
+		t.Errorf("expected 1 oauth session after deletion but found %d", count)
+	}
+
+	// the count must be restored when the silo is reopened
+	osl.Close()
+	osl, _ = Open(dbFilePath, 120, grantcodePurgeInterval, grantcodeTTL)
+	if count := osl.OauthSessionCount(); count != 1 {
+		t.Errorf("expected 1 oauth session after reopening but found %d", count)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	initSilo()
+
+	cl := &Client{Id: utils.GenUUID(), Oauth: &ClientOauthConf{RefreshTokenValidity: 600, RefreshTokenIdleTime: 60}}
+	first := NewRefreshToken(cl, "user1", utils.NewRandShaStr(), true)
+	if first.Exp != first.CreatedAt+60 || first.FamilyExp != first.CreatedAt+600 {
+		t.Errorf("invalid expiration times of the refresh token %#v", first)
+	}
+	osl.StoreRefreshToken(first)
+
+	rt, _ := osl.UseRefreshToken(first.Id, "another-client")
+	if rt != nil {
+		t.Errorf("refresh token must not be usable by a different client")
+	}
+
+	rt, reused := osl.UseRefreshToken(first.Id, cl.Id)
+	if rt == nil || reused {
+		t.Errorf("failed to use the refresh token")
+	}
+
+	second := rt.Next(cl, utils.NewRandShaStr())
+	osl.StoreRefreshToken(second)
+	if second.FamilyId != first.Id || second.FamilyExp != first.FamilyExp {
+		t.Errorf("the successor must belong to the same family")
+	}
+
+	rt, reused = osl.UseRefreshToken(first.Id, cl.Id)
+	if rt == nil || !reused {
+		t.Errorf("reuse of the refresh token must be detected")
+	}
+
+	other := NewRefreshToken(cl, "user1", utils.NewRandShaStr(), true)
+	osl.StoreRefreshToken(other)
+
+	osl.RevokeRefreshTokenFamily(rt.FamilyId)
+	if osl.GetRefreshToken(first.Id) != nil || osl.GetRefreshToken(second.Id) != nil {
+		t.Errorf("all the refresh tokens of the family must be deleted")
+	}
+
+	if osl.GetRefreshToken(other.Id) == nil {
+		t.Errorf("the refresh tokens of the other families must be retained")
+	}
+
+	if n := countKeys(BUC_IDX_REFRESH_TOKEN_BY_FAMILY); n != 1 {
+		t.Errorf("the family index must only hold the token of the other family, found %d keys", n)
+	}
+
+	if !osl.IsRevokedSession(first.AcTokenId) || !osl.IsRevokedSession(second.AcTokenId) {
+		t.Errorf("the access tokens issued using the refresh tokens of the family must be revoked")
+	}
+}
+
+func TestPurgeExpiredRefreshTokens(t *testing.T) {
+	initSilo()
+
+	cl := &Client{Id: utils.GenUUID(), Oauth: &ClientOauthConf{RefreshTokenValidity: 600}}
+	for i := 0; i < 20; i++ {
+		rt := NewRefreshToken(cl, "user1", utils.NewRandShaStr(), false)
+		rt.Exp = time.Now().Unix() - 1
+		osl.StoreRefreshToken(rt)
+	}
+
+	// the expired tokens are purged when the silo is opened
+	osl.Close()
+	var err error
+	osl, err = Open(dbFilePath, 120, grantcodePurgeInterval, grantcodeTTL)
+	if err != nil {
+		t.Fatalf("failed to open the silo %s", err)
+	}
+
+	for i := 0; i < 20 && countKeys(BUC_REFRESH_TOKENS) != 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, name := range [][]byte{BUC_REFRESH_TOKENS, BUC_IDX_REFRESH_TOKEN_BY_ID, BUC_IDX_REFRESH_TOKEN_BY_FAMILY} {
+		if n := countKeys(name); n != 0 {
+			t.Errorf("all the expired refresh tokens must be purged, found %d keys in %s", n, name)
+		}
+	}
+}
+
+func countKeys(buckName []byte) (count int) {
+	osl.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(buckName).Stats().KeyN
+		return nil
+	})
+
+	return count
+}
+
+func TestConcurrentRevocation(t *testing.T) {
+	initSilo()
+
+	// must be run with -race to detect the unguarded access of the revoked tokens
+	done := make(chan bool)
+	jtis := make([]string, 50)
+	for i := range jtis {
+		jtis[i] = utils.NewRandShaStr()
+	}
+
+	go func() {
+		for _, jti := range jtis {
+			osl.RevokeOauthSession(jti)
+		}
+		done <- true
+	}()
+
+	for _, jti := range jtis {
+		osl.IsRevokedSession(jti)
+	}
+	<-done
+
+	for _, jti := range jtis {
+		if !osl.IsRevokedSession(jti) {
+			t.Errorf("the session %s must be revoked", jti)
+		}
+	}
+}
+
+func TestDeviceGrantPolling(t *testing.T) {
+	initSilo()
+
+	cl := &Client{Id: utils.GenUUID(), Oauth: &ClientOauthConf{}}
+	dg := NewDeviceGrant(cl, "openid", 600, 5)
+	if len(dg.UserCode) != USER_CODE_LEN || strings.Trim(dg.UserCode, userCodeChars) != "" {
+		t.Errorf("invalid user code %s", dg.UserCode)
+	}
+	osl.StoreDeviceGrant(dg)
+
+	// the user code must be found irrespective of the case and separators
+	entered := strings.ToLower(dg.DisplayUserCode())
+	if loaded := osl.GetDeviceGrantByUserCode(entered); loaded == nil || loaded.DeviceCode != dg.DeviceCode {
+		t.Errorf("failed to find the device grant using the user code %s", entered)
+	}
+
+	loaded, _ := osl.PollDeviceGrant(dg.DeviceCode, "another-client")
+	if loaded != nil {
+		t.Errorf("device grant must not be usable by a different client")
+	}
+
+	loaded, slowDown := osl.PollDeviceGrant(dg.DeviceCode, cl.Id)
+	if loaded == nil || loaded.Status != DEVICE_GRANT_PENDING || slowDown {
+		t.Errorf("the device grant must be pending")
+	}
+
+	loaded, slowDown = osl.PollDeviceGrant(dg.DeviceCode, cl.Id)
+	if !slowDown || loaded.Interval != 10 {
+		t.Errorf("the device must be asked to slow down when polling before the interval")
+	}
+
+	authTime := time.Now().Unix()
+	if !osl.DecideDeviceGrant(entered, "user1", authTime, []string{"pwd", "otp"}, true) {
+		t.Errorf("failed to approve the device grant")
+	}
+
+	if osl.DecideDeviceGrant(entered, "user2", authTime, nil, false) {
+		t.Errorf("the decision on the device grant must not be changed")
+	}
+
+	loaded, _ = osl.PollDeviceGrant(dg.DeviceCode, cl.Id)
+	if loaded == nil || loaded.Status != DEVICE_GRANT_APPROVED || loaded.UserId != "user1" {
+		t.Errorf("the device grant must be approved")
+	} else if loaded.AuthTime != authTime || len(loaded.Amr) != 2 {
+		t.Errorf("the authentication details of the user must be recorded on the device grant")
+	}
+
+	// the device code can only be used once
+	loaded, _ = osl.PollDeviceGrant(dg.DeviceCode, cl.Id)
+	if loaded != nil || osl.GetDeviceGrantByUserCode(entered) != nil {
+		t.Errorf("the device grant must be deleted after use")
+	}
+
+	// deletion of a grant replicated from a peer
+	dg = NewDeviceGrant(cl, "openid", 600, 5)
+	osl.StoreDeviceGrant(dg)
+	osl.DeleteDeviceGrant(dg.DeviceCode)
+	if osl.GetDeviceGrantByUserCode(dg.UserCode) != nil {
+		t.Errorf("the deleted device grant must not be found")
+	}
+}
+
+func TestClientAssertionReplay(t *testing.T) {
+	initSilo()
+
+	exp := time.Now().Unix() + 60
+	if !osl.UseClientAssertion("client1", "jti1", exp) {
+		t.Errorf("the assertion must be accepted when used for the first time")
+	}
+
+	if osl.UseClientAssertion("client1", "jti1", exp) {
+		t.Errorf("the replayed assertion must be rejected")
+	}
+
+	// the IDs are scoped to the client
+	if !osl.UseClientAssertion("client2", "jti1", exp) {
+		t.Errorf("the assertion of another client with the same ID must be accepted")
+	}
+}
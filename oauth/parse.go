@@ -16,11 +16,7 @@ func ParseAuthzReq(r *http.Request) (areq *AuthorizationReq) {
 
 	areq.RedUri = strings.TrimSpace(r.Form.Get("redirect_uri"))
 
-	areq.Scopes = make(map[string]int)
-	scopes := strings.Split(r.Form.Get("scope"), " ")
-	for _, v := range scopes {
-		areq.Scopes[v] = 1
-	}
+	areq.Scopes = ParseScope(r.Form.Get("scope"))
 
 	areq.State = r.Form.Get("state")
 
@@ -28,6 +24,10 @@ func ParseAuthzReq(r *http.Request) (areq *AuthorizationReq) {
 	areq.Nonce = r.Form.Get("nonce")
 	areq.Prompt = r.Form.Get("prompt")
 	areq.ResponseMode = strings.TrimSpace(r.Form.Get("response_mode"))
+	areq.MaxAge = strings.TrimSpace(r.Form.Get("max_age"))
+	areq.AcrValues = r.Form.Get("acr_values")
+	areq.CodeChallenge = strings.TrimSpace(r.Form.Get("code_challenge"))
+	areq.CodeChallengeMethod = strings.TrimSpace(r.Form.Get("code_challenge_method"))
 
 	return areq
 }
@@ -40,9 +40,14 @@ func ParseAccessTokenReq(r *http.Request) (atr *AccessTokenReq, err error) {
 
 	atr = &AccessTokenReq{}
 	atr.ClientId = r.Form.Get("client_id")
+	atr.Secret = r.Form.Get("client_secret")
 	atr.RedUri = r.Form.Get("redirect_uri")
 	atr.Code = r.Form.Get("code")
 	atr.GrantType = r.Form.Get("grant_type")
+	atr.RefreshToken = r.Form.Get("refresh_token")
+	atr.CodeVerifier = r.Form.Get("code_verifier")
+	atr.Scope = r.Form.Get("scope")
+	atr.DeviceCode = r.Form.Get("device_code")
 
 	return atr, nil
 }
@@ -51,7 +56,7 @@ func ValidateAuthReq(areq *AuthorizationReq) *ErrorResp {
 	e := &ErrorResp{}
 	e.State = areq.State
 
-	if areq.RespType != "code" {
+	if !supportedRespTypes[normalizeRespType(areq.RespType)] {
 		e.Err = ERR_UNSUPPORTED_RESPONSE_TYPE
 		e.Desc = "Unsupported response_type " + areq.RespType
 		return e
@@ -63,5 +68,47 @@ func ValidateAuthReq(areq *AuthorizationReq) *ErrorResp {
 		return e
 	}
 
+	switch areq.ResponseMode {
+	case "", RESP_MODE_FRAGMENT, RESP_MODE_FORM_POST:
+
+	case RESP_MODE_QUERY:
+		// the tokens must not be sent in the query, section 5 of OAuth 2.0 Multiple Response Type Encoding Practices
+		if areq.IsImplicitOrHybrid() {
+			e.Err = ERR_INVALID_REQUEST
+			e.Desc = "query response_mode is not allowed for the response_type " + areq.RespType
+			return e
+		}
+
+	default:
+		e.Err = ERR_INVALID_REQUEST
+		e.Desc = "Unsupported response_mode " + areq.ResponseMode
+		return e
+	}
+
+	// section 3.1.2.1 of OpenID Connect core, none must not be combined with other values
+	// as they require an interaction with the user
+	if areq.HasPrompt(PROMPT_NONE) && len(strings.Fields(areq.Prompt)) > 1 {
+		e.Err = ERR_INTERACTION_REQUIRED
+		if areq.HasPrompt(PROMPT_CONSENT) {
+			e.Err = ERR_CONSENT_REQUIRED
+		}
+		e.Desc = "prompt none must not be combined with other values"
+		return e
+	}
+
+	if len(areq.MaxAge) != 0 && areq.MaxAgeSecs() < 0 {
+		e.Err = ERR_INVALID_REQUEST
+		e.Desc = "Invalid max_age " + areq.MaxAge
+		return e
+	}
+
+	// nonce is required in the OpenID Connect implicit and hybrid flows for mitigating the replay of ID tokens
+	oidc := areq.Scopes.Has(SCOPE_OPENID)
+	if (areq.HasRespType("id_token") || (oidc && areq.IsImplicitOrHybrid())) && len(areq.Nonce) == 0 {
+		e.Err = ERR_INVALID_REQUEST
+		e.Desc = "Missing nonce"
+		return e
+	}
+
 	return nil
 }
@@ -0,0 +1,198 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	ERR_INVALID_REDIRECT_URI    = "invalid_redirect_uri"
+	ERR_INVALID_CLIENT_METADATA = "invalid_client_metadata"
+)
+
+const (
+	AUTH_METHOD_BASIC = "client_secret_basic"
+	AUTH_METHOD_POST  = "client_secret_post"
+	AUTH_METHOD_NONE  = "none"
+
+	AUTH_METHOD_PRIVATE_KEY_JWT = "private_key_jwt"
+
+	// not supported, the secrets are stored hashed and cannot be used as keys for verifying the assertions
+	AUTH_METHOD_CLIENT_SECRET_JWT = "client_secret_jwt"
+)
+
+// the grant types a client can register for, the client_credentials grant is not included
+// as it needs the service groups which can only be assigned by an administrator
+var registrableGrantTypes = map[string]bool{
+	AUTHORIZATION_CODE: true,
+	IMPLICIT:           true,
+	REFRESH_TOKEN:      true,
+	DEVICE_CODE:        true,
+}
+
+// the metadata of a client as defined in section 2 of RFC 7591, only the fields which can be
+// mapped onto the Application schema are supported. The fields after Scope are sent by the server.
+type ClientMetadata struct {
+	RedirectUris            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientUri               string   `json:"client_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	Jwks                    *JwkSet  `json:"jwks,omitempty"`
+	ClientId                string   `json:"client_id,omitempty"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"` // zero if the secret doesn't expire
+	RegistrationAccessToken string   `json:"registration_access_token,omitempty"`
+	RegistrationClientUri   string   `json:"registration_client_uri,omitempty"`
+}
+
+// Validates the metadata sent by a client and fills in the default values of the absent fields
+func (md *ClientMetadata) Validate() *ErrorResp {
+	ep := &ErrorResp{Err: ERR_INVALID_CLIENT_METADATA}
+
+	switch md.TokenEndpointAuthMethod {
+	case "":
+		md.TokenEndpointAuthMethod = AUTH_METHOD_BASIC
+	case AUTH_METHOD_BASIC, AUTH_METHOD_POST, AUTH_METHOD_NONE, AUTH_METHOD_PRIVATE_KEY_JWT:
+	case AUTH_METHOD_CLIENT_SECRET_JWT:
+		ep.Desc = "The client_secret_jwt method is not supported, use private_key_jwt instead"
+		return ep
+	default:
+		ep.Desc = "Unsupported token_endpoint_auth_method " + md.TokenEndpointAuthMethod
+		return ep
+	}
+
+	// the keys are stored inline, jwks_uri is not supported
+	if md.Jwks != nil {
+		for _, jwk := range md.Jwks.Keys {
+			if jwk == nil {
+				ep.Desc = "Invalid key in jwks"
+				return ep
+			}
+			if _, err := jwk.PublicKey(); err != nil {
+				ep.Desc = "Invalid jwks " + err.Error()
+				return ep
+			}
+		}
+	}
+
+	if md.TokenEndpointAuthMethod == AUTH_METHOD_PRIVATE_KEY_JWT && (md.Jwks == nil || len(md.Jwks.Keys) == 0) {
+		ep.Desc = "The jwks is required for the private_key_jwt method"
+		return ep
+	}
+
+	if len(md.GrantTypes) == 0 {
+		md.GrantTypes = []string{AUTHORIZATION_CODE}
+	}
+
+	for _, gt := range md.GrantTypes {
+		if !registrableGrantTypes[gt] {
+			ep.Desc = "Unsupported grant type " + gt
+			return ep
+		}
+	}
+
+	if len(md.ResponseTypes) == 0 {
+		md.ResponseTypes = []string{"code"}
+	}
+
+	implicit := md.HasGrantType(IMPLICIT)
+	for _, rt := range md.ResponseTypes {
+		rt = normalizeRespType(rt)
+		if !supportedRespTypes[rt] {
+			ep.Desc = "Unsupported response type " + rt
+			return ep
+		}
+
+		// section 2.1, the response types must be consistent with the grant types
+		if rt != "code" && !implicit {
+			ep.Desc = "The response type " + rt + " requires the implicit grant type"
+			return ep
+		}
+	}
+
+	if len(md.Scope) > MAX_SCOPE_LEN {
+		ep.Desc = "Too many scopes are present"
+		return ep
+	}
+
+	// only one redirect URI can be stored in an Application, the redirect URI
+	// is not needed if the client doesn't use the authorization endpoint
+	redirect := md.HasGrantType(AUTHORIZATION_CODE) || implicit
+	if len(md.RedirectUris) > 1 || (redirect && len(md.RedirectUris) == 0) {
+		ep.Err = ERR_INVALID_REDIRECT_URI
+		ep.Desc = "Exactly one redirect URI must be present"
+		return ep
+	}
+
+	for _, uri := range md.RedirectUris {
+		u, err := url.Parse(uri)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Fragment) != 0 {
+			ep.Err = ERR_INVALID_REDIRECT_URI
+			ep.Desc = "Invalid redirect URI " + uri
+			return ep
+		}
+	}
+
+	return nil
+}
+
+func (md *ClientMetadata) HasGrantType(grantType string) bool {
+	for _, gt := range md.GrantTypes {
+		if gt == grantType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the metadata of the given client. The grant and response types reflect the
+// configuration of the client, which may differ from the ones sent during registration.
+func NewClientMetadata(cl *Client) *ClientMetadata {
+	md := &ClientMetadata{ClientId: cl.Id, ClientName: cl.Name, ClientUri: cl.HomeUrl}
+	md.RedirectUris = []string{cl.Oauth.RedUri}
+	md.Scope = strings.Join(cl.Oauth.AllowedScopes, " ")
+
+	md.Jwks = cl.Oauth.Jwks
+	md.TokenEndpointAuthMethod = AUTH_METHOD_BASIC
+	if cl.Oauth.Public {
+		md.TokenEndpointAuthMethod = AUTH_METHOD_NONE
+	} else {
+		if len(cl.Oauth.TokenEndpointAuthMethod) != 0 {
+			md.TokenEndpointAuthMethod = cl.Oauth.TokenEndpointAuthMethod
+		}
+		// only the hash of the secret is stored, the secret itself is sent once during registration
+		if md.TokenEndpointAuthMethod != AUTH_METHOD_PRIVATE_KEY_JWT {
+			md.ClientSecretExpiresAt = cl.Oauth.SecretExpiresAt
+		}
+	}
+
+	md.GrantTypes = []string{AUTHORIZATION_CODE}
+	md.ResponseTypes = []string{"code"}
+	if !cl.Oauth.DisableImplicit {
+		md.GrantTypes = append(md.GrantTypes, IMPLICIT)
+		for rt, _ := range supportedRespTypes {
+			if rt != "code" {
+				md.ResponseTypes = append(md.ResponseTypes, rt)
+			}
+		}
+		sort.Strings(md.ResponseTypes[1:])
+	}
+
+	if cl.Oauth.RefreshTokenValidity > 0 {
+		md.GrantTypes = append(md.GrantTypes, REFRESH_TOKEN)
+	}
+
+	if !cl.Oauth.DisableDeviceGrant {
+		md.GrantTypes = append(md.GrantTypes, DEVICE_CODE)
+	}
+
+	return md
+}
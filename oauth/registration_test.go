@@ -0,0 +1,77 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"testing"
+)
+
+func TestValidateClientMetadata(t *testing.T) {
+	md := &ClientMetadata{RedirectUris: []string{"https://client.example.com/cb"}}
+	if ep := md.Validate(); ep != nil {
+		t.Errorf("unexpected error %#v", ep)
+	}
+
+	if md.TokenEndpointAuthMethod != AUTH_METHOD_BASIC || len(md.GrantTypes) != 1 || md.GrantTypes[0] != AUTHORIZATION_CODE {
+		t.Errorf("the default values were not set %#v", md)
+	}
+
+	invalid := []*ClientMetadata{
+		{RedirectUris: []string{"https://a.example.com/cb", "https://b.example.com/cb"}},
+		{RedirectUris: []string{"ftp://client.example.com/cb"}},
+		{RedirectUris: []string{"https://client.example.com/cb#frag"}},
+		{},
+		{RedirectUris: []string{"https://client.example.com/cb"}, GrantTypes: []string{CLIENT_CRED}},
+		{RedirectUris: []string{"https://client.example.com/cb"}, ResponseTypes: []string{"token"}},
+		{RedirectUris: []string{"https://client.example.com/cb"}, TokenEndpointAuthMethod: "private_key_jwt"},
+		{RedirectUris: []string{"https://client.example.com/cb"}, TokenEndpointAuthMethod: AUTH_METHOD_CLIENT_SECRET_JWT},
+	}
+
+	for i, md := range invalid {
+		if md.Validate() == nil {
+			t.Errorf("metadata at index %d must be rejected", i)
+		}
+	}
+
+	// a device needs no redirect URI
+	md = &ClientMetadata{GrantTypes: []string{DEVICE_CODE}, TokenEndpointAuthMethod: AUTH_METHOD_NONE}
+	if ep := md.Validate(); ep != nil {
+		t.Errorf("unexpected error %#v", ep)
+	}
+
+	md = &ClientMetadata{RedirectUris: []string{"https://client.example.com/cb"}, GrantTypes: []string{AUTHORIZATION_CODE, IMPLICIT}, ResponseTypes: []string{"token id_token"}}
+	if ep := md.Validate(); ep != nil {
+		t.Errorf("unexpected error %#v", ep)
+	}
+
+	cert, _ := createTestCert()
+	jwk, _ := NewJwk(cert, "RS256")
+	md = &ClientMetadata{RedirectUris: []string{"https://client.example.com/cb"}, TokenEndpointAuthMethod: AUTH_METHOD_PRIVATE_KEY_JWT, Jwks: &JwkSet{Keys: []*Jwk{jwk}}}
+	if ep := md.Validate(); ep != nil {
+		t.Errorf("unexpected error %#v", ep)
+	}
+
+	md.Jwks.Keys[0] = &Jwk{Kty: "RSA", Kid: "1"}
+	if md.Validate() == nil {
+		t.Errorf("metadata with an invalid key must be rejected")
+	}
+}
+
+func TestNewClientMetadata(t *testing.T) {
+	cl := &Client{Id: "1", Name: "cli", Oauth: &ClientOauthConf{RedUri: "https://client.example.com/cb", Public: true, DisableImplicit: true}}
+	cl.Oauth.AllowedScopes = []string{"openid", "email"}
+
+	md := NewClientMetadata(cl)
+	if md.TokenEndpointAuthMethod != AUTH_METHOD_NONE || len(md.ClientSecret) != 0 {
+		t.Errorf("the secret of a public client must not be sent")
+	}
+
+	if md.HasGrantType(IMPLICIT) || md.HasGrantType(REFRESH_TOKEN) || len(md.ResponseTypes) != 1 {
+		t.Errorf("invalid grant types %v and response types %v", md.GrantTypes, md.ResponseTypes)
+	}
+
+	if md.Scope != "openid email" || md.RedirectUris[0] != cl.Oauth.RedUri {
+		t.Errorf("invalid metadata %#v", md)
+	}
+}
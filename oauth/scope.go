@@ -0,0 +1,45 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package oauth
+
+import (
+	"sort"
+	"strings"
+)
+
+// the maximum length of the scope parameter of an authorization request
+const MAX_SCOPE_LEN = 2048
+
+const SCOPE_OPENID = "openid"
+
+// a set of scope names
+type ScopeSet map[string]int
+
+// Parses the space separated list of scopes
+func ParseScope(scope string) ScopeSet {
+	ss := make(ScopeSet)
+	for _, v := range strings.Fields(scope) {
+		ss[v] = 1
+	}
+
+	return ss
+}
+
+// Returns the sorted space separated list of scopes
+func (ss ScopeSet) String() string {
+	names := make([]string, 0, len(ss))
+	for k, _ := range ss {
+		if len(k) > 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, " ")
+}
+
+func (ss ScopeSet) Has(scope string) bool {
+	_, ok := ss[scope]
+	return ok
+}
@@ -4,7 +4,6 @@
 package oauth
 
 import (
-	"crypto"
 	"encoding/json"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
@@ -18,16 +17,25 @@ const (
 	IMPLICIT           = "implicit"
 	RES_OWN_PASS_CRED  = "resource_owner_password_credentials"
 	CLIENT_CRED        = "client_credentials"
+	REFRESH_TOKEN      = "refresh_token"
+	DEVICE_CODE        = "urn:ietf:params:oauth:grant-type:device_code"
 )
 
 const (
 	ERR_INVALID_REQUEST           = "invalid_request"
+	ERR_INVALID_GRANT             = "invalid_grant"
 	ERR_UNAUTHORIZED_CLIENT       = "unauthorized_client"
 	ERR_ACCESS_DENIED             = "access_denied"
 	ERR_UNSUPPORTED_RESPONSE_TYPE = "unsupported_response_type"
 	ERR_INVALID_SCOPE             = "invalid_scope"
 	ERR_SERVER_ERROR              = "server_error"
 	ERR_TEMPORARILY_UNAVAILABLE   = "temporarily_unavailable"
+	ERR_AUTHORIZATION_PENDING     = "authorization_pending"
+	ERR_SLOW_DOWN                 = "slow_down"
+	ERR_EXPIRED_TOKEN             = "expired_token"
+	ERR_LOGIN_REQUIRED            = "login_required"
+	ERR_CONSENT_REQUIRED          = "consent_required"
+	ERR_INTERACTION_REQUIRED      = "interaction_required"
 )
 
 type Client struct {
@@ -40,6 +48,8 @@ type Client struct {
 	GroupIds map[string]int
 	Oauth    *ClientOauthConf
 	Saml     *ClientSamlConf
+	// IDs of the groups whose roles are activated in the sessions created using the client credentials grant
+	ServiceGroupIds []string
 }
 
 type ClientSamlConf struct {
@@ -54,27 +64,47 @@ type ClientSamlConf struct {
 }
 
 type ClientOauthConf struct {
-	Secret          string                   `json:"secret"`
-	RedUri          string                   `json:"redUri"`
-	TokenValidity   int64                    `json:"tokenValidity"` // the life time of an OAuth token in seconds
-	ServerSecret    []byte                   `json:"-"`             // this secret is used as a key
-	HasQueryInUri   bool                     `json:"-"`             // flag to indicate if there is query part in the path
-	ConsentRequired bool                     `json:"consentRequired"`
-	Attributes      map[string]*base.SsoAttr `json:"attrs"`
+	Secret                  string                   `json:"secret"`              // the hash of the secret
+	SecretExpiresAt         int64                    `json:"secretExpiresAt"`     // the expiration time of the secret in seconds since epoch, zero if the secret doesn't expire
+	PrevSecret              string                   `json:"prevSecret"`          // the hash of the secret replaced by the last rotation
+	PrevSecretExpiresAt     int64                    `json:"prevSecretExpiresAt"` // the end of the overlap window of the last rotation
+	RedUri                  string                   `json:"redUri"`
+	TokenValidity           int64                    `json:"tokenValidity"`        // the life time of an OAuth token in seconds
+	RefreshTokenValidity    int64                    `json:"refreshTokenValidity"` // the life time of a family of refresh tokens in seconds, refresh tokens are not issued if zero
+	RefreshTokenIdleTime    int64                    `json:"refreshTokenIdleTime"` // the number of seconds an unused refresh token is valid for
+	ServerSecret            []byte                   `json:"-"`                    // this secret is used as a key
+	HasQueryInUri           bool                     `json:"-"`                    // flag to indicate if there is query part in the path
+	ConsentRequired         bool                     `json:"consentRequired"`
+	Public                  bool                     `json:"public"`                  // a public client cannot hold a secret, it must use PKCE
+	RequirePkce             bool                     `json:"requirePkce"`             // flag to reject the authorization requests without a code challenge
+	AllowPlainPkce          bool                     `json:"allowPlainPkce"`          // flag to allow the plain code challenge method
+	SignUserinfo            bool                     `json:"signUserinfo"`            // flag to send the UserInfo response as a signed JWT
+	AllowedScopes           []string                 `json:"allowedScopes"`           // the scopes the client can request, all the scopes of the domain are allowed if empty
+	DisableImplicit         bool                     `json:"disableImplicit"`         // flag to reject the requests of the implicit and hybrid flows
+	DisableDeviceGrant      bool                     `json:"disableDeviceGrant"`      // flag to reject the device authorization requests
+	TokenEndpointAuthMethod string                   `json:"tokenEndpointAuthMethod"` // the method the client must use for authenticating at the token endpoint, either of the secret methods is allowed if empty
+	Jwks                    *JwkSet                  `json:"jwks"`                    // the keys used for verifying the client assertions
+	Attributes              map[string]*base.SsoAttr `json:"attrs"`
 }
 
 type AuthorizationReq struct {
-	RespType string         `json:"response_type"`
-	ClientId string         `json:"client_id"`
-	RedUri   string         `json:"redirect_uri"`
-	Scopes   map[string]int `json:"scope"`
-	State    string         `json:"state"`
+	RespType string   `json:"response_type"`
+	ClientId string   `json:"client_id"`
+	RedUri   string   `json:"redirect_uri"`
+	Scopes   ScopeSet `json:"scope"`
+	State    string   `json:"state"`
 
 	// OIDC specific parameters
 	Nonce        string
 	Display      string
 	Prompt       string
 	ResponseMode string `json:"response_mode"`
+	MaxAge       string `json:"max_age"`    // the maximum allowed age of the authentication in seconds
+	AcrValues    string `json:"acr_values"` // the space separated list of acceptable ACRs
+
+	// PKCE parameters, RFC 7636
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
 }
 
 type AuthorizationResp struct {
@@ -89,19 +119,51 @@ type ErrorResp struct {
 	State string `json:"state"`
 }
 
+// the response of the device authorization endpoint, RFC 8628
+type DeviceAuthorizationResp struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
 type AccessTokenReq struct {
-	GrantType string `json:"grant_type"`
-	Code      string `json:"code"`
-	RedUri    string `json:"redirect_uri"`
-	ClientId  string `json:"client_id"`
-	Secret    string `json:"client_secret"`
+	GrantType    string `json:"grant_type"`
+	Code         string `json:"code"`
+	RedUri       string `json:"redirect_uri"`
+	ClientId     string `json:"client_id"`
+	Secret       string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	CodeVerifier string `json:"code_verifier"`
+	Scope        string `json:"scope"`
+	DeviceCode   string `json:"device_code"`
 }
 
 type AccessTokenResp struct {
-	AcToken   string `json:"access_token"`
-	IdToken   string `json:"id_token,omitempty"`
-	TokenType string `json:"token_type"`
-	ExpiresIn int    `json:"expires_in,omitempty"`
+	AcToken      string `json:"access_token"`
+	IdToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// the response of the token introspection endpoint, RFC 7662. Only the
+// active flag is sent if the token is not active
+type IntrospectionResp struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Roles     []string `json:"roles,omitempty"` // names of the roles activated in the session
 }
 
 type AttrProfile struct {
@@ -110,11 +172,6 @@ type AttrProfile struct {
 	Attributes []*base.SsoAttr
 }
 
-type OauthScope struct {
-	Name       string
-	UserGroups []string
-}
-
 func (atr *AccessTokenResp) Serialize() []byte {
 	data, err := json.Marshal(atr)
 	if err != nil {
@@ -153,9 +210,12 @@ func (ep *ErrorResp) BuildErrorUri(redUri string) string {
 	return redUri
 }
 
-func ToJwt(claims jwt.MapClaims, key crypto.PrivateKey) string {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	str, err := token.SignedString(key)
+// Signs the claims using the given key, the key ID is added to the header for
+// helping the verifiers to select the key from the JWKS document
+func ToJwt(claims jwt.MapClaims, sk *SigningKey) string {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(sk.Alg), claims)
+	token.Header["kid"] = sk.Kid
+	str, err := token.SignedString(sk.PrivKey)
 	if err != nil {
 		panic(fmt.Errorf("could not create the JWT from IdToken %#v", err))
 	}
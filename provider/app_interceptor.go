@@ -4,11 +4,16 @@ import (
 	"fmt"
 	"net/url"
 	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/oauth"
+	"sparrow/silo"
 	"sparrow/utils"
 	"strings"
 )
 
 type ApplicationInterceptor struct {
+	Config *conf.DomainConfig
+	sl     *silo.Silo // for retaining the secrets of an Application when it is replaced
 }
 
 func (ai *ApplicationInterceptor) PreCreate(crCtx *base.CreateContext) error {
@@ -26,6 +31,17 @@ func (ai *ApplicationInterceptor) PreCreate(crCtx *base.CreateContext) error {
 		return err
 	}
 
+	err = ai.checkServiceGroups(serviceGroupIdsOf(crCtx.InRes), nil, crCtx.OpContext)
+	if err != nil {
+		return err
+	}
+
+	// only the hash of the secret is stored, the secret is sent once in the response
+	for _, name := range clientSecretAts {
+		crCtx.InRes.DeleteAttr(name)
+	}
+	crCtx.Secret = newClientSecret(crCtx.InRes, ai.Config)
+
 	return nil
 }
 
@@ -34,7 +50,55 @@ func (ai *ApplicationInterceptor) PostCreate(crCtx *base.CreateContext) {
 }
 
 func (ai *ApplicationInterceptor) PrePatch(patchCtx *base.PatchContext) error {
-	return nil
+	if patchCtx.Rt.Name != "Application" {
+		return nil
+	}
+
+	// the secrets can only be changed by rotating them
+	for _, po := range patchCtx.Pr.Operations {
+		if po.ParsedPath != nil && isClientSecretAt(po.ParsedPath.AtType.NormName) {
+			return base.NewBadRequestError(fmt.Sprintf("The attribute %s cannot be modified, the secret must be rotated instead", po.Path))
+		}
+
+		// an operation without a path carries the attributes in its value
+		if obj, ok := po.Value.(map[string]interface{}); ok && po.ParsedPath == nil {
+			for name, _ := range obj {
+				if isClientSecretAt(strings.ToLower(name)) {
+					return base.NewBadRequestError(fmt.Sprintf("The attribute %s cannot be modified, the secret must be rotated instead", name))
+				}
+			}
+		}
+	}
+
+	gids := make([]string, 0)
+	for _, po := range patchCtx.Pr.Operations {
+		if po.Op == "remove" {
+			continue
+		}
+
+		if po.ParsedPath != nil {
+			if po.ParsedPath.AtType.NormName == "servicegroupids" {
+				gids = append(gids, toStrings(po.Value)...)
+			}
+		} else if obj, ok := po.Value.(map[string]interface{}); ok {
+			for name, val := range obj {
+				if strings.ToLower(name) == "servicegroupids" {
+					gids = append(gids, toStrings(val)...)
+				}
+			}
+		}
+	}
+
+	if len(gids) == 0 {
+		return nil
+	}
+
+	existing, err := ai.sl.Get(patchCtx.Rid, patchCtx.Rt)
+	if err != nil {
+		return err
+	}
+
+	return ai.checkServiceGroups(gids, existing, patchCtx.OpContext)
 }
 
 func (ai *ApplicationInterceptor) PostPatch(patchCtx *base.PatchContext) {
@@ -102,7 +166,11 @@ func validateClient(rs *base.Resource, opCtx *base.OpContext) error {
 		return base.NewBadRequestError(msg)
 	}
 
-	rs.AddSA("secret", utils.NewRandShaStr())
+	err = validateClientAuthMethod(rs)
+	if err != nil {
+		return err
+	}
+
 	rs.AddSA("serversecret", utils.NewRandShaStr())
 	hasQuery := (len(redUrl.RawQuery) != 0)
 	rs.AddSA("hasqueryinuri", hasQuery)
@@ -110,6 +178,83 @@ func validateClient(rs *base.Resource, opCtx *base.OpContext) error {
 	return nil
 }
 
+// checks the token endpoint authentication method and the JWKS needed by the private_key_jwt method
+func validateClientAuthMethod(rs *base.Resource) error {
+	method := safeGetStrVal("tokenendpointauthmethod", rs)
+	switch method {
+	case "", oauth.AUTH_METHOD_BASIC, oauth.AUTH_METHOD_POST, oauth.AUTH_METHOD_PRIVATE_KEY_JWT:
+	case oauth.AUTH_METHOD_CLIENT_SECRET_JWT:
+		return base.NewBadRequestError("The client_secret_jwt method is not supported, use private_key_jwt instead")
+	default:
+		return base.NewBadRequestError(fmt.Sprintf("Unsupported token endpoint authentication method %s", method))
+	}
+
+	jwks := safeGetStrVal("jwks", rs)
+	if len(jwks) != 0 {
+		_, err := oauth.ParseJwks(jwks)
+		if err != nil {
+			return base.NewBadRequestError(fmt.Sprintf("Invalid JWKS %s", err))
+		}
+	} else if method == oauth.AUTH_METHOD_PRIVATE_KEY_JWT {
+		return base.NewBadRequestError("The JWKS is required for the private_key_jwt method")
+	}
+
+	return nil
+}
+
+// Checks whether the user can grant the roles of the given groups to the application, the groups
+// already assigned to the existing application are not checked. See RbacEngine.CanAssignServiceGroup()
+func (ai *ApplicationInterceptor) checkServiceGroups(gids []string, existing *base.Resource, opCtx *base.OpContext) error {
+	assigned := make(map[string]bool)
+	for _, gid := range serviceGroupIdsOf(existing) {
+		assigned[gid] = true
+	}
+
+	for _, gid := range gids {
+		if assigned[gid] {
+			continue
+		}
+
+		if !ai.sl.Engine.CanAssignServiceGroup(opCtx.Session, gid) {
+			return base.NewForbiddenError(fmt.Sprintf("insufficient privileges to assign the group %s to the application", gid))
+		}
+	}
+
+	return nil
+}
+
+func serviceGroupIdsOf(rs *base.Resource) []string {
+	gids := make([]string, 0)
+	if rs == nil {
+		return gids
+	}
+
+	at := rs.GetAttr("servicegroupids")
+	if at != nil {
+		for _, v := range at.GetSimpleAt().Values {
+			gids = append(gids, v.(string))
+		}
+	}
+
+	return gids
+}
+
+// converts the value of a patch operation, a single string or an array of strings, to a slice
+func toStrings(val interface{}) []string {
+	strs := make([]string, 0)
+	switch v := val.(type) {
+	case string:
+		strs = append(strs, v)
+
+	case []interface{}:
+		for _, item := range v {
+			strs = append(strs, fmt.Sprint(item))
+		}
+	}
+
+	return strs
+}
+
 func (ai *ApplicationInterceptor) PreDelete(delCtx *base.DeleteContext) error {
 	return nil
 }
@@ -118,6 +263,35 @@ func (ai *ApplicationInterceptor) PostDelete(delCtx *base.DeleteContext) {
 }
 
 func (ai *ApplicationInterceptor) PreReplace(replaceCtx *base.ReplaceContext) error {
+	if replaceCtx.InRes.GetType().Name != "Application" {
+		return nil
+	}
+
+	// the default values of the absent attributes are set as during creation
+	err := validateClient(replaceCtx.InRes, replaceCtx.OpContext)
+	if err != nil {
+		return err
+	}
+
+	// the secrets can only be changed by rotating them, the stored values of the secrets
+	// and the other attributes generated by the server are retained
+	existing, err := ai.sl.Get(replaceCtx.InRes.GetId(), replaceCtx.InRes.GetType())
+	if err != nil {
+		return err
+	}
+
+	err = ai.checkServiceGroups(serviceGroupIdsOf(replaceCtx.InRes), existing, replaceCtx.OpContext)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append([]string{"registrationtoken", "serversecret"}, clientSecretAts...) {
+		replaceCtx.InRes.DeleteAttr(name)
+		if at := existing.GetAttr(name); at != nil {
+			replaceCtx.InRes.AddSA(name, at.GetSimpleAt().Values[0])
+		}
+	}
+
 	return nil
 }
 
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"sparrow/base"
+	"sparrow/oauth"
 	"sparrow/schema"
 	"sparrow/silo"
 	"time"
@@ -386,3 +387,84 @@ func (al *AuditLogger) _logDelSession(opCtx *base.OpContext, deleted bool) {
 
 	al.LogEvent(ae)
 }
+
+func (al *AuditLogger) LogIntrospection(cl *oauth.Client, clientIP string, session *base.RbacSession) {
+	go al._logIntrospection(cl, clientIP, session)
+}
+
+// the token is not logged, the subject of the session is logged if the token is active
+func (al *AuditLogger) _logIntrospection(cl *oauth.Client, clientIP string, session *base.RbacSession) {
+	ae := base.AuditEvent{}
+	ae.IpAddress = clientIP
+	ae.ActorId = cl.Id
+	ae.ActorName = cl.Name
+	ae.Operation = "IntrospectToken"
+	ae.StatusCode = 200
+	if session != nil {
+		ae.Desc = fmt.Sprintf("introspected the active token of %s", session.Sub)
+	} else {
+		ae.Desc = "introspected an inactive token"
+	}
+
+	al.LogEvent(ae)
+}
+
+func (al *AuditLogger) LogRevokeToken(cl *oauth.Client, clientIP string, tokenType string, sub string) {
+	go al._logRevokeToken(cl, clientIP, tokenType, sub)
+}
+
+// the token type is empty if the token was not revoked
+func (al *AuditLogger) _logRevokeToken(cl *oauth.Client, clientIP string, tokenType string, sub string) {
+	ae := base.AuditEvent{}
+	ae.IpAddress = clientIP
+	ae.ActorId = cl.Id
+	ae.ActorName = cl.Name
+	ae.Operation = "RevokeToken"
+	ae.StatusCode = 200
+	if len(tokenType) > 0 {
+		ae.Desc = fmt.Sprintf("revoked the %s of %s", tokenType, sub)
+	} else {
+		ae.Desc = "token not found"
+	}
+
+	al.LogEvent(ae)
+}
+
+func (al *AuditLogger) LogClientAuthFailure(clientId string, clientIP string, operation string, reason string) {
+	go al._logClientAuthFailure(clientId, clientIP, operation, reason)
+}
+
+// the client ID is the one claimed by the client, it may not belong to any client of the domain
+func (al *AuditLogger) _logClientAuthFailure(clientId string, clientIP string, operation string, reason string) {
+	ae := base.AuditEvent{}
+	ae.IpAddress = clientIP
+	ae.ActorId = clientId
+	ae.Operation = operation
+	ae.StatusCode = 401
+	ae.Desc = "client authentication failed - " + reason
+
+	al.LogEvent(ae)
+}
+
+func (al *AuditLogger) LogClientSecretExpiry(cl *oauth.Client, clientIP string, exp int64) {
+	go al._logClientSecretExpiry(cl, clientIP, exp)
+}
+
+// the client is authenticated if the secret has not expired yet
+func (al *AuditLogger) _logClientSecretExpiry(cl *oauth.Client, clientIP string, exp int64) {
+	ae := base.AuditEvent{}
+	ae.IpAddress = clientIP
+	ae.ActorId = cl.Id
+	ae.ActorName = cl.Name
+	ae.Operation = "ClientSecretExpiry"
+	expTime := time.Unix(exp, 0).UTC().Format(time.RFC3339)
+	if exp <= time.Now().Unix() {
+		ae.StatusCode = 401
+		ae.Desc = fmt.Sprintf("authentication failed, the secret of the client expired at %s", expTime)
+	} else {
+		ae.StatusCode = 200
+		ae.Desc = fmt.Sprintf("the secret of the client expires at %s, it must be rotated", expTime)
+	}
+
+	al.LogEvent(ae)
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"encoding/json"
+	"net/url"
+	"sparrow/base"
+	"sparrow/oauth"
+	"sparrow/utils"
+)
+
+// the life time in seconds of the refresh token families of a client registered for the refresh_token grant
+const registeredRefreshTokenValidity = 30 * 24 * 3600
+
+// Creates an Application using the metadata sent by a client, RFC 7591. The operation is performed using
+// the session of the initial access token, which must be allowed to create Applications. The returned
+// registration access token is needed for managing the client, only its hash is stored.
+func (pr *Provider) RegisterClient(md *oauth.ClientMetadata, opCtx *base.OpContext) (cl *oauth.Client, secret string, regToken string, err error) {
+	rt := pr.RsTypes["Application"]
+	rs := base.NewResource(rt)
+	rs.AddSA("schemas", rt.Schema)
+	name := md.ClientName
+	if len(name) == 0 {
+		name = "client-" + utils.NewRandShaStr()[:11]
+	}
+	rs.AddSA("name", name)
+	rs.AddSA("consentrequired", true)
+	pr.setClientMetadata(rs, md)
+
+	regToken = utils.NewRandShaStr()
+	rs.AddSA("registrationtoken", utils.HashPassword(regToken, pr.Config.Ppolicy.PasswdHashAlgo))
+
+	crCtx := &base.CreateContext{InRes: rs, OpContext: opCtx}
+	err = pr.CreateResource(crCtx)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	log.Debugf("registered the client %s", rs.GetId())
+	// the attributes which are never returned are removed from the created resource
+	return pr.GetClientById(rs.GetId()), crCtx.Secret, regToken, nil
+}
+
+// Returns the registered client if the given registration access token belongs to it
+func (pr *Provider) GetRegisteredClient(clientId string, regToken string) *oauth.Client {
+	rs := pr.getRegisteredClientRes(clientId, regToken)
+	if rs == nil {
+		return nil
+	}
+
+	return pr._toClient(rs)
+}
+
+// Updates the client using the metadata sent by it, RFC 7592. The access control checks are skipped, the
+// client is authorized by the registration access token, but the interceptors are run as in Replace().
+// The attributes that are not part of the metadata, e.g. the ones set by an administrator, are retained.
+func (pr *Provider) UpdateRegisteredClient(clientId string, regToken string, md *oauth.ClientMetadata, clientIP string) (cl *oauth.Client, err error) {
+	rs := pr.getRegisteredClientRes(clientId, regToken)
+	if rs == nil {
+		return nil, base.NewNotFoundError("client not found")
+	}
+
+	if len(md.ClientName) != 0 {
+		rs.DeleteAttr("name")
+		rs.AddSA("name", md.ClientName)
+	}
+	pr.setClientMetadata(rs, md)
+
+	replaceCtx := &base.ReplaceContext{InRes: rs, Rt: rs.GetType(), IfMatch: rs.GetVersion()}
+	replaceCtx.OpContext = pr.registeredClientOpCtx(rs, clientIP)
+	defer func() {
+		pr.Al.Log(replaceCtx, replaceCtx.Res, err)
+	}()
+
+	err = pr.replace(replaceCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	return pr.GetClientById(clientId), nil
+}
+
+// Deletes the client, the access control checks are skipped as in UpdateRegisteredClient()
+func (pr *Provider) DeleteRegisteredClient(clientId string, regToken string, clientIP string) (err error) {
+	rs := pr.getRegisteredClientRes(clientId, regToken)
+	if rs == nil {
+		return base.NewNotFoundError("client not found")
+	}
+
+	delCtx := &base.DeleteContext{Rid: clientId, Rt: rs.GetType()}
+	delCtx.OpContext = pr.registeredClientOpCtx(rs, clientIP)
+	defer func() {
+		pr.Al.Log(delCtx, nil, err)
+	}()
+
+	err = pr.delete(delCtx)
+	return err
+}
+
+func (pr *Provider) getRegisteredClientRes(clientId string, regToken string) *base.Resource {
+	rs, err := pr.sl.Get(clientId, pr.RsTypes["Application"])
+	if err != nil {
+		return nil
+	}
+
+	// only the dynamically registered clients have a registration token
+	hash := safeGetStrVal("registrationtoken", rs)
+	if len(hash) == 0 || !utils.ComparePassword(regToken, hash) {
+		log.Debugf("invalid registration access token of the client %s", clientId)
+		return nil
+	}
+
+	return rs
+}
+
+// the client acts on its own Application during the management operations
+func (pr *Provider) registeredClientOpCtx(rs *base.Resource, clientIP string) *base.OpContext {
+	opCtx := &base.OpContext{ClientIP: clientIP, Endpoint: "/oauth2/register"}
+	opCtx.Session = &base.RbacSession{Domain: pr.Name, Sub: rs.GetId(), Username: safeGetStrVal("name", rs)}
+
+	return opCtx
+}
+
+// maps the metadata onto the attributes of the Application
+func (pr *Provider) setClientMetadata(rs *base.Resource, md *oauth.ClientMetadata) {
+	for _, name := range []string{"publicclient", "disableimplicit", "disabledevicegrant", "allowedscopes", "tokenendpointauthmethod", "jwks"} {
+		rs.DeleteAttr(name)
+	}
+
+	// the redirect URI is required, the existing value is retained if absent
+	if len(md.RedirectUris) != 0 {
+		rs.DeleteAttr("redirecturi")
+		rs.DeleteAttr("hasqueryinuri")
+		redUri := md.RedirectUris[0]
+		rs.AddSA("redirecturi", redUri)
+		// the value is computed again during creation
+		u, _ := url.Parse(redUri)
+		rs.AddSA("hasqueryinuri", u != nil && len(u.RawQuery) != 0)
+	}
+
+	rs.AddSA("publicclient", md.TokenEndpointAuthMethod == oauth.AUTH_METHOD_NONE)
+	rs.AddSA("disableimplicit", !md.HasGrantType(oauth.IMPLICIT))
+	rs.AddSA("disabledevicegrant", !md.HasGrantType(oauth.DEVICE_CODE))
+
+	// the validity set by an administrator is retained
+	if !md.HasGrantType(oauth.REFRESH_TOKEN) {
+		rs.DeleteAttr("refreshtokenvalidity")
+	} else if rs.GetAttr("refreshtokenvalidity") == nil {
+		rs.AddSA("refreshtokenvalidity", int64(registeredRefreshTokenValidity))
+	}
+
+	// the public clients are identified by the flag
+	if md.TokenEndpointAuthMethod != oauth.AUTH_METHOD_NONE {
+		rs.AddSA("tokenendpointauthmethod", md.TokenEndpointAuthMethod)
+	}
+
+	if md.Jwks != nil {
+		data, _ := json.Marshal(md.Jwks) // safe to ignore, the keys were decoded from JSON
+		rs.AddSA("jwks", string(data))
+	}
+
+	// the home URL is required, the existing value is retained if absent and
+	// the origin of the redirect URI is used for a new client
+	if len(md.ClientUri) != 0 {
+		rs.DeleteAttr("homeurl")
+		rs.AddSA("homeurl", md.ClientUri)
+	} else if rs.GetAttr("homeurl") == nil {
+		if u, err := url.Parse(safeGetStrVal("redirecturi", rs)); err == nil && len(u.Host) != 0 {
+			rs.AddSA("homeurl", u.Scheme+"://"+u.Host)
+		}
+	}
+
+	scopes := oauth.ParseScope(md.Scope)
+	if len(scopes) != 0 {
+		vals := make([]interface{}, 0, len(scopes))
+		for s, _ := range scopes {
+			vals = append(vals, s)
+		}
+		rs.AddSA("allowedscopes", vals...)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/oauth"
+	"sparrow/utils"
+	"time"
+)
+
+// the attributes of an Application holding its secrets, they can only be set by the server
+var clientSecretAts = []string{"secret", "secretexpiresat", "previoussecret", "previoussecretexpiresat"}
+
+// the minimum number of seconds between two expiry warnings of the same client
+const secretWarnInterval = 24 * 3600
+
+func isClientSecretAt(normName string) bool {
+	for _, name := range clientSecretAts {
+		if name == normName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Generates a new secret for the given Application, stores its hash and expiration
+// time in the Application and returns the secret. The secret doesn't expire if the
+// configured max life is zero.
+func newClientSecret(rs *base.Resource, cf *conf.DomainConfig) string {
+	secret := utils.NewRandShaStr()
+	rs.DeleteAttr("secret")
+	rs.DeleteAttr("secretexpiresat")
+	rs.AddSA("secret", utils.HashPassword(secret, cf.Ppolicy.PasswdHashAlgo))
+	if cf.Oauth.ClientSecretMaxLife > 0 {
+		rs.AddSA("secretexpiresat", utils.DateTimeMillis()+int64(cf.Oauth.ClientSecretMaxLife)*1000)
+	}
+
+	return secret
+}
+
+// Replaces the secret of the Application with a new one. The current secret remains valid for the given
+// number of seconds, letting the client switch to the new secret, a secret replaced by an earlier rotation
+// is discarded. The returned secret cannot be retrieved again, only its hash is stored.
+func (pr *Provider) RotateClientSecret(appId string, overlap int, opCtx *base.OpContext) (secret string, res *base.Resource, err error) {
+	rt := pr.RsTypes["Application"]
+	rs, err := pr.sl.Get(appId, rt)
+	if err != nil {
+		return "", nil, err
+	}
+
+	replaceCtx := &base.ReplaceContext{InRes: rs, Rt: rt, IfMatch: rs.GetVersion(), OpContext: opCtx}
+	defer func() {
+		pr.Al.Log(replaceCtx, replaceCtx.Res, err)
+	}()
+
+	if !replaceCtx.AllowOp() {
+		return "", nil, base.NewForbiddenError("insufficient privileges to rotate the secret of the application")
+	}
+
+	if overlap < 0 {
+		return "", nil, base.NewBadRequestError("overlap must not be negative")
+	}
+
+	rs.DeleteAttr("previoussecret")
+	rs.DeleteAttr("previoussecretexpiresat")
+	hashAt := rs.GetAttr("secret")
+	if hashAt != nil && overlap > 0 {
+		prevExp := utils.DateTimeMillis() + int64(overlap)*1000
+		// the overlap cannot extend the life of the current secret
+		if expAt := rs.GetAttr("secretexpiresat"); expAt != nil {
+			if exp := expAt.GetSimpleAt().Values[0].(int64); exp < prevExp {
+				prevExp = exp
+			}
+		}
+		rs.AddSA("previoussecret", hashAt.GetSimpleAt().Values[0])
+		rs.AddSA("previoussecretexpiresat", prevExp)
+	}
+
+	secret = newClientSecret(rs, pr.Config)
+
+	// the pre-replace interceptors are skipped as they retain the stored secrets
+	err = pr.sl.Replace(replaceCtx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, intrcptr := range pr.interceptors {
+		intrcptr.PostReplace(replaceCtx)
+	}
+
+	log.Debugf("rotated the secret of the application %s", appId)
+	return secret, replaceCtx.Res, nil
+}
+
+// Replaces the unhashed secret of the client, stored before hashing was introduced, with its hash.
+// Must only be called after the given secret was verified, the expiration time of the secret is left as it is.
+func (pr *Provider) HashPlainClientSecret(cl *oauth.Client, secret string, clientIP string) (err error) {
+	rt := pr.RsTypes["Application"]
+	rs, err := pr.sl.Get(cl.Id, rt)
+	if err != nil {
+		return err
+	}
+
+	hashAt := rs.GetAttr("secret")
+	if hashAt == nil || utils.IsPasswordHashed(hashAt.GetSimpleAt().Values[0].(string)) {
+		// already hashed, possibly by a concurrent request
+		return nil
+	}
+
+	rs.DeleteAttr("secret")
+	rs.AddSA("secret", utils.HashPassword(secret, pr.Config.Ppolicy.PasswdHashAlgo))
+
+	opCtx := &base.OpContext{ClientIP: clientIP, Endpoint: "/oauth2/token"}
+	opCtx.Session = &base.RbacSession{Domain: pr.Name, Sub: rs.GetId(), Username: safeGetStrVal("name", rs)}
+	replaceCtx := &base.ReplaceContext{InRes: rs, Rt: rt, IfMatch: rs.GetVersion(), OpContext: opCtx}
+	defer func() {
+		pr.Al.Log(replaceCtx, replaceCtx.Res, err)
+	}()
+
+	// the pre-replace interceptors are skipped as they retain the stored secrets
+	err = pr.sl.Replace(replaceCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, intrcptr := range pr.interceptors {
+		intrcptr.PostReplace(replaceCtx)
+	}
+
+	log.Debugf("hashed the unhashed secret of the client %s", cl.Id)
+	return nil
+}
+
+// Logs a warning in the audit log if the secret used by the client has expired or expires within
+// the configured time. The warnings are logged at most once a day for each client.
+func (pr *Provider) WarnClientSecretExpiry(cl *oauth.Client, clientIP string, exp int64) {
+	now := time.Now().Unix()
+	if exp == 0 || exp-now > int64(pr.Config.Oauth.ClientSecretWarnTime) {
+		return
+	}
+
+	last, ok := pr.secretWarnings.Load(cl.Id)
+	if ok && now-last.(int64) < secretWarnInterval {
+		return
+	}
+
+	pr.secretWarnings.Store(cl.Id, now)
+	pr.Al.LogClientSecretExpiry(cl, clientIP, exp)
+}
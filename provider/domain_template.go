@@ -0,0 +1,217 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"sparrow/base"
+	"sparrow/schema"
+)
+
+// Clones the groups, along with their permissions, and the Applications present in the template domain.
+// The cloned resources get fresh IDs and the Applications get fresh secrets and keys.
+// Members of the groups are not cloned. The references to the template's groups, in the inherited and
+// assignable groups, in the separation of duty rules and in the Applications, are mapped to the cloned groups.
+func (prv *Provider) CloneSeedResources(tmpl *Provider) error {
+	opCtx := &base.OpContext{}
+	opCtx.Session = &base.RbacSession{Domain: prv.Name, Sub: AdminUserId, Username: "admin"}
+	// the permissions of the administrator are needed for assigning the service groups of the Applications
+	if admin, err := prv.sl.GetUser(AdminUserId); err == nil {
+		opCtx.Session = prv.GenSessionForUser(admin)
+	}
+	opCtx.Endpoint = "cloneSeedResources"
+
+	// map of template's group IDs to the IDs of cloned groups, the immutable groups retain their IDs
+	gidMap := make(map[string]string)
+	for rid, _ := range prv.immResIds {
+		gidMap[rid] = rid
+	}
+
+	// the references to other groups are added after cloning all the groups, as the IDs
+	// of the referred groups are not known till then, map of cloned group IDs to the
+	// names of the referring attributes and the referred template group IDs
+	groupRefs := make(map[string]map[string][]string)
+
+	groupRt := prv.RsTypes["Group"]
+	tmplGroupRt := tmpl.RsTypes["Group"]
+	if groupRt != nil && tmplGroupRt != nil {
+		for _, rs := range tmpl.readAllOfType(tmplGroupRt) {
+			tmplGid := rs.GetId()
+			if _, ok := prv.immResIds[tmplGid]; ok {
+				continue
+			}
+
+			rs.SetSchema(groupRt)
+			rs.DeleteAttr("members")
+			rs.DeleteAttr("gidNumber")
+			refs := make(map[string][]string)
+			for _, atName := range groupRefAts {
+				if gids := complexValues(rs, atName); len(gids) != 0 {
+					refs[atName] = gids
+				}
+				rs.DeleteAttr(atName)
+			}
+
+			err := prv.createSeedResource(rs, opCtx)
+			if err != nil {
+				log.Warningf("failed to clone the group %s of template domain %s [%s]", tmplGid, tmpl.Name, err)
+				return err
+			}
+
+			gidMap[tmplGid] = rs.GetId()
+			if len(refs) != 0 {
+				groupRefs[rs.GetId()] = refs
+			}
+		}
+
+		for gid, refs := range groupRefs {
+			err := prv.addGroupRefs(gid, refs, gidMap, opCtx)
+			if err != nil {
+				log.Warningf("failed to add the references of the cloned group %s of template domain %s [%s]", gid, tmpl.Name, err)
+				return err
+			}
+		}
+	}
+
+	// the separation of duty rules copied from the template refer to the template's groups
+	sodRules := append(prv.Config.Rbac.StaticSod, prv.Config.Rbac.DynamicSod...)
+	for _, rule := range sodRules {
+		rule.GroupIds = mapGroupIds(rule.GroupIds, gidMap)
+	}
+
+	if len(sodRules) != 0 {
+		err := prv.SaveConf()
+		if err != nil {
+			log.Warningf("failed to save the separation of duty rules of the domain %s [%s]", prv.Name, err)
+			return err
+		}
+	}
+
+	appRt := prv.RsTypes["Application"]
+	tmplAppRt := tmpl.RsTypes["Application"]
+	if appRt != nil && tmplAppRt != nil {
+		for _, rs := range tmpl.readAllOfType(tmplAppRt) {
+			tmplAppId := rs.GetId()
+			rs.SetSchema(appRt)
+			for _, name := range clientSecretAts {
+				rs.DeleteAttr(name)
+			}
+			rs.DeleteAttr("serverSecret")
+			rs.DeleteAttr("registrationToken")
+			rs.DeleteAttr("x509Cert")
+			rs.DeleteAttr("x509PrivKey")
+
+			for _, atName := range []string{"groupids", "servicegroupids"} {
+				at := rs.GetAttr(atName)
+				if at == nil {
+					continue
+				}
+
+				sa := at.GetSimpleAt()
+				gids := make([]interface{}, 0)
+				for _, gid := range mapGroupIds(toStrings(sa.Values), gidMap) {
+					gids = append(gids, gid)
+				}
+
+				if len(gids) == 0 {
+					rs.DeleteAttr(atName)
+				} else {
+					sa.Values = gids
+				}
+			}
+
+			err := prv.createSeedResource(rs, opCtx)
+			if err != nil {
+				log.Warningf("failed to clone the application %s of template domain %s [%s]", tmplAppId, tmpl.Name, err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// the attributes of a Group holding the IDs of other groups
+var groupRefAts = []string{"inherits", "assignablegroups"}
+
+// adds the references to the other groups, which are mapped to the cloned groups, to the given cloned group
+func (prv *Provider) addGroupRefs(gid string, refs map[string][]string, gidMap map[string]string, opCtx *base.OpContext) error {
+	rt := prv.RsTypes["Group"]
+	rs, err := prv.sl.Get(gid, rt)
+	if err != nil {
+		return err
+	}
+
+	for atName, tmplGids := range refs {
+		vals := make([]map[string]interface{}, 0)
+		for _, refGid := range mapGroupIds(tmplGids, gidMap) {
+			vals = append(vals, map[string]interface{}{"value": refGid})
+		}
+
+		if len(vals) != 0 {
+			rs.AddCA(atName, vals...)
+		}
+	}
+
+	replaceCtx := &base.ReplaceContext{InRes: rs, Rt: rt, IfMatch: rs.GetVersion(), OpContext: opCtx}
+	return prv.replace(replaceCtx)
+}
+
+// returns the IDs of the cloned groups of the given template group IDs, the IDs of the groups which were not cloned are dropped
+func mapGroupIds(tmplGids []string, gidMap map[string]string) []string {
+	gids := make([]string, 0, len(tmplGids))
+	for _, tmplGid := range tmplGids {
+		if gid, ok := gidMap[tmplGid]; ok {
+			gids = append(gids, gid)
+		}
+	}
+
+	return gids
+}
+
+// returns the values of the "value" sub-attribute of the given multi-valued complex attribute
+func complexValues(rs *base.Resource, atName string) []string {
+	vals := make([]string, 0)
+	at := rs.GetAttr(atName)
+	if at == nil {
+		return vals
+	}
+
+	for _, subAtMap := range at.GetComplexAt().SubAts {
+		if sa := subAtMap["value"]; sa != nil {
+			vals = append(vals, sa.Values[0].(string))
+		}
+	}
+
+	return vals
+}
+
+// creates the resource after running all the interceptors, skips the access control checks
+func (prv *Provider) createSeedResource(rs *base.Resource, opCtx *base.OpContext) error {
+	crCtx := &base.CreateContext{InRes: rs, OpContext: opCtx}
+	err := prv.firePreInterceptors(crCtx)
+	if err != nil {
+		return err
+	}
+
+	err = prv.sl.Insert(crCtx)
+	if err == nil {
+		for _, intrcptr := range prv.interceptors {
+			intrcptr.PostCreate(crCtx)
+		}
+	}
+
+	return err
+}
+
+func (prv *Provider) readAllOfType(rt *schema.ResourceType) []*base.Resource {
+	outPipe := make(chan *base.Resource)
+	go prv.sl.ReadAllOfType(rt, outPipe)
+
+	resources := make([]*base.Resource, 0)
+	for rs := range outPipe {
+		resources = append(resources, rs)
+	}
+
+	return resources
+}
@@ -0,0 +1,44 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"time"
+)
+
+// the number of seconds to wait between successive checks for rotating the signing keys
+const keyRotationCheckInterval = 60
+
+// Rotates the signing keys of the domain periodically until the provider is closed.
+// The keyset is sent to the peers at startup and whenever a new key gets generated
+// so that all the nodes sign using the same key and publish the same JWKS.
+func (prv *Provider) rotateSigningKeys() {
+	log.Debugf("starting the rotation of signing keys of domain %s", prv.Name)
+	prv.replicateSigningKeys()
+	for !prv.closed {
+		time.Sleep(keyRotationCheckInterval * time.Second)
+
+		generated, err := prv.ks.Rotate(time.Now())
+		if err != nil {
+			log.Warningf("failed to rotate the signing keys of domain %s [%s]", prv.Name, err)
+		} else if generated {
+			prv.replicateSigningKeys()
+		}
+	}
+}
+
+func (prv *Provider) replicateSigningKeys() {
+	data, err := prv.ks.Export()
+	if err != nil {
+		log.Warningf("failed to export the signing keys of domain %s [%s]", prv.Name, err)
+		return
+	}
+
+	prv.replInterceptor.PostStoreSigningKeys(data, prv.sl.Csn().String())
+}
+
+// intended for use by the replication-event-handler only
+func (prv *Provider) MergeReplSigningKeys(data []byte) error {
+	return prv.ks.Merge(data)
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sparrow/base"
+	"time"
+)
+
+// Removes the expired group memberships periodically until the provider is closed
+func (prv *Provider) removeExpiredMemberships() {
+	log.Debugf("starting the remover of expired memberships of domain %s", prv.Name)
+	defer func() {
+		// this can happen when the provider gets closed
+		// while the removal is in progress
+		recover()
+	}()
+
+	for !prv.closed {
+		prv.RemoveExpiredMemberships()
+
+		sleepTime := time.Duration(prv.Config.Rbac.MembershipPurgeInterval) * time.Second
+		time.Sleep(sleepTime)
+	}
+}
+
+// Removes the expired memberships from all the groups. The members are removed by patching
+// the groups, as the admin user, so that the removal gets audited and replicated.
+func (prv *Provider) RemoveExpiredMemberships() {
+	rt := prv.RsTypes["Group"]
+	if rt == nil {
+		return
+	}
+
+	var opCtx *base.OpContext
+	now := time.Now()
+	for _, group := range prv.readAllOfType(rt) {
+		members := group.GetAttr("members")
+		if members == nil {
+			continue
+		}
+
+		ops := make([]map[string]string, 0)
+		for _, subAtMap := range members.GetComplexAt().SubAts {
+			if base.IsMembershipExpired(subAtMap, now) {
+				path := fmt.Sprintf("members[value eq \"%s\"]", subAtMap["value"].Values[0].(string))
+				ops = append(ops, map[string]string{"op": "remove", "path": path})
+			}
+		}
+
+		if len(ops) == 0 {
+			continue
+		}
+
+		if opCtx == nil {
+			admin, err := prv.sl.GetUser(AdminUserId)
+			if err != nil {
+				log.Warningf("failed to fetch the admin user for removing the expired memberships [%s]", err)
+				return
+			}
+			opCtx = &base.OpContext{Session: prv.sl.Engine.NewRbacSession(admin), Endpoint: "removeExpiredMemberships"}
+		}
+
+		req := map[string]interface{}{"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}, "Operations": ops}
+		data, _ := json.Marshal(req)
+		pr, err := base.ParsePatchReq(bytes.NewReader(data), rt)
+		if err != nil {
+			log.Warningf("failed to create the patch request for removing the expired members of group %s [%s]", group.GetId(), err)
+			continue
+		}
+		pr.IfMatch = group.GetVersion()
+
+		patchCtx := &base.PatchContext{Rid: group.GetId(), Rt: rt, Pr: pr, OpContext: opCtx}
+		err = prv.Patch(patchCtx)
+		if err != nil {
+			log.Warningf("failed to remove the expired members of group %s [%s]", group.GetId(), err)
+		} else {
+			log.Debugf("removed %d expired members of group %s", len(ops), group.GetId())
+		}
+	}
+}
@@ -5,8 +5,10 @@ package provider
 
 import (
 	//logger "github.com/juju/loggo"
+	"crypto/rsa"
 	"encoding/hex"
 	"encoding/xml"
+	"fmt"
 	samlTypes "github.com/russellhaering/gosaml2/types"
 	"io/ioutil"
 	"net/http"
@@ -67,6 +69,13 @@ func (pr *Provider) _toClient(rs *base.Resource) (cl *oauth.Client) {
 		}
 	}
 
+	serviceGroupIdsAt := rs.GetAttr("servicegroupids")
+	if serviceGroupIdsAt != nil {
+		for _, v := range serviceGroupIdsAt.GetSimpleAt().Values {
+			cl.ServiceGroupIds = append(cl.ServiceGroupIds, v.(string))
+		}
+	}
+
 	oauthConf := &oauth.ClientOauthConf{}
 	redUri := safeGetStrVal("redirecturi", rs)
 	if len(redUri) > 0 {
@@ -75,6 +84,28 @@ func (pr *Provider) _toClient(rs *base.Resource) (cl *oauth.Client) {
 		oauthConf.ConsentRequired = rs.GetAttr("consentRequired").GetSimpleAt().Values[0].(bool)
 		oauthConf.HasQueryInUri = rs.GetAttr("hasqueryinuri").GetSimpleAt().Values[0].(bool)
 		oauthConf.Secret = safeGetStrVal("secret", rs)
+		oauthConf.SecretExpiresAt = safeGetTimeVal("secretexpiresat", rs)
+		oauthConf.PrevSecret = safeGetStrVal("previoussecret", rs)
+		oauthConf.PrevSecretExpiresAt = safeGetTimeVal("previoussecretexpiresat", rs)
+		oauthConf.Public = safeGetBoolVal("publicclient", rs)
+		oauthConf.RequirePkce = safeGetBoolVal("requirepkce", rs)
+		oauthConf.AllowPlainPkce = safeGetBoolVal("allowplainpkce", rs)
+		oauthConf.SignUserinfo = safeGetBoolVal("signuserinfo", rs)
+		oauthConf.DisableImplicit = safeGetBoolVal("disableimplicit", rs)
+		oauthConf.DisableDeviceGrant = safeGetBoolVal("disabledevicegrant", rs)
+		oauthConf.TokenEndpointAuthMethod = safeGetStrVal("tokenendpointauthmethod", rs)
+		if jwks := safeGetStrVal("jwks", rs); len(jwks) != 0 {
+			var err error
+			oauthConf.Jwks, err = oauth.ParseJwks(jwks)
+			if err != nil {
+				log.Warningf("invalid JWKS of the client %s %s", cl.Id, err)
+			}
+		}
+		if allowedScopesAt := rs.GetAttr("allowedscopes"); allowedScopesAt != nil {
+			for _, v := range allowedScopesAt.GetSimpleAt().Values {
+				oauthConf.AllowedScopes = append(oauthConf.AllowedScopes, v.(string))
+			}
+		}
 		ss := safeGetStrVal("serversecret", rs)
 		oauthConf.ServerSecret, _ = hex.DecodeString(ss) // safe to ignore error
 		oauthAt := rs.GetAttr("oauthattributes")
@@ -89,6 +120,16 @@ func (pr *Provider) _toClient(rs *base.Resource) (cl *oauth.Client) {
 			tokenValidity = 120 // 2 minutes is the default
 		}
 		oauthConf.TokenValidity = tokenValidity
+
+		// refresh tokens are not issued unless their validity is configured
+		refreshValidityAt := rs.GetAttr("refreshtokenvalidity")
+		if refreshValidityAt != nil {
+			oauthConf.RefreshTokenValidity = refreshValidityAt.GetSimpleAt().Values[0].(int64)
+		}
+		refreshIdleAt := rs.GetAttr("refreshtokenidletime")
+		if refreshIdleAt != nil {
+			oauthConf.RefreshTokenIdleTime = refreshIdleAt.GetSimpleAt().Values[0].(int64)
+		}
 	}
 
 	samlConf := &oauth.ClientSamlConf{}
@@ -128,6 +169,27 @@ func (pr *Provider) _toClient(rs *base.Resource) (cl *oauth.Client) {
 	return cl
 }
 
+func safeGetBoolVal(atName string, rs *base.Resource) bool {
+	at := rs.GetAttr(atName)
+	if at == nil {
+		return false
+	}
+
+	val, _ := at.GetSimpleAt().Values[0].(bool)
+	return val
+}
+
+// returns the value of a dateTime attribute in seconds since epoch, zero if the attribute is absent
+func safeGetTimeVal(atName string, rs *base.Resource) int64 {
+	at := rs.GetAttr(atName)
+	if at == nil {
+		return 0
+	}
+
+	millis, _ := at.GetSimpleAt().Values[0].(int64)
+	return millis / 1000
+}
+
 func safeGetStrVal(atName string, rs *base.Resource) string {
 	at := rs.GetAttr(atName)
 	if at == nil {
@@ -170,9 +232,19 @@ func parseSsoAttributes(tmpResAt base.Attribute) map[string]*base.SsoAttr {
 
 	return m
 }
-func (pr *Provider) StoreOauthSession(session *base.RbacSession) {
+func (pr *Provider) StoreOauthSession(session *base.RbacSession) error {
+	max := pr.Config.Limits.MaxSessions
+	if max > 0 {
+		if pr.osl.OauthSessionCount() >= max {
+			detail := fmt.Sprintf("maximum number of active sessions(%d) reached", max)
+			log.Debugf(detail)
+			return base.NewQuotaExceededError(detail)
+		}
+	}
+
 	pr.osl.StoreOauthSession(session)
 	pr.replInterceptor.PostStoreSession(session, false, pr.sl.Csn().String())
+	return nil
 }
 
 func (pr *Provider) StoreSsoSession(session *base.RbacSession) {
@@ -222,6 +294,100 @@ func (pr *Provider) HasGrantCodeId(creationTime int64, gcIvAsId []byte) bool {
 	return pr.osl.HasGrantCodeId(creationTime, gcIvAsId)
 }
 
+func (pr *Provider) StoreRefreshToken(rt *oauth.RefreshToken) {
+	pr.osl.StoreRefreshToken(rt)
+	pr.replInterceptor.PostStoreRefreshToken(rt, pr.sl.Csn().String())
+}
+
+func (pr *Provider) GetRefreshToken(id string) *oauth.RefreshToken {
+	return pr.osl.GetRefreshToken(id)
+}
+
+// Marks the refresh token as used, see OauthSilo.UseRefreshToken()
+func (pr *Provider) UseRefreshToken(id string, clientId string) (rt *oauth.RefreshToken, reused bool) {
+	rt, reused = pr.osl.UseRefreshToken(id, clientId)
+	if rt != nil && !reused {
+		pr.replInterceptor.PostStoreRefreshToken(rt, pr.sl.Csn().String())
+	}
+
+	return rt, reused
+}
+
+func (pr *Provider) RevokeRefreshTokenFamily(familyId string) {
+	pr.osl.RevokeRefreshTokenFamily(familyId)
+	pr.replInterceptor.PostRevokeRefreshTokenFamily(familyId, pr.sl.Csn().String())
+}
+
+// intended for use by the replication-event-handler only
+func (pr *Provider) StoreReplRefreshToken(rt *oauth.RefreshToken) {
+	pr.osl.StoreRefreshToken(rt)
+}
+
+// intended for use by the replication-event-handler only
+func (pr *Provider) RevokeReplRefreshTokenFamily(familyId string) {
+	pr.osl.RevokeRefreshTokenFamily(familyId)
+}
+
+// device grants are replicated, unlike the grant codes, since the user may approve
+// the grant on a server different from the one being polled by the device
+func (pr *Provider) StoreDeviceGrant(dg *oauth.DeviceGrant) {
+	pr.osl.StoreDeviceGrant(dg)
+	pr.replInterceptor.PostStoreDeviceGrant(dg, pr.sl.Csn().String())
+}
+
+func (pr *Provider) GetDeviceGrantByUserCode(userCode string) *oauth.DeviceGrant {
+	return pr.osl.GetDeviceGrantByUserCode(userCode)
+}
+
+// Records the decision of the user, see OauthSilo.DecideDeviceGrant()
+func (pr *Provider) DecideDeviceGrant(userCode string, userId string, authTime int64, amr []string, approved bool) bool {
+	updated := pr.osl.DecideDeviceGrant(userCode, userId, authTime, amr, approved)
+	if updated {
+		if dg := pr.osl.GetDeviceGrantByUserCode(userCode); dg != nil {
+			pr.replInterceptor.PostStoreDeviceGrant(dg, pr.sl.Csn().String())
+		}
+	}
+
+	return updated
+}
+
+// Fetches the grant on behalf of the polling device, see OauthSilo.PollDeviceGrant(). The deletion
+// of a used or expired grant is replicated so that the device code cannot be used on another server.
+func (pr *Provider) PollDeviceGrant(deviceCode string, clientId string) (dg *oauth.DeviceGrant, slowDown bool) {
+	dg, slowDown = pr.osl.PollDeviceGrant(deviceCode, clientId)
+	if dg != nil && (dg.Status != oauth.DEVICE_GRANT_PENDING || dg.IsExpired()) {
+		pr.replInterceptor.PostDeleteDeviceGrant(dg.DeviceCode, pr.sl.Csn().String())
+	}
+
+	return dg, slowDown
+}
+
+// intended for use by the replication-event-handler only
+func (pr *Provider) StoreReplDeviceGrant(dg *oauth.DeviceGrant) {
+	pr.osl.StoreDeviceGrant(dg)
+}
+
+// intended for use by the replication-event-handler only
+func (pr *Provider) DeleteReplDeviceGrant(deviceCode string) {
+	pr.osl.DeleteDeviceGrant(deviceCode)
+}
+
+// Records the use of a client assertion, see OauthSilo.UseClientAssertion(). The IDs are
+// replicated for detecting the replay of an assertion on the other servers.
+func (pr *Provider) UseClientAssertion(clientId string, jti string, exp int64) bool {
+	unused := pr.osl.UseClientAssertion(clientId, jti, exp)
+	if unused {
+		pr.replInterceptor.PostUseClientAssertion(clientId, jti, exp, pr.sl.Csn().String())
+	}
+
+	return unused
+}
+
+// intended for use by the replication-event-handler only
+func (pr *Provider) UseReplClientAssertion(clientId string, jti string, exp int64) {
+	pr.osl.UseClientAssertion(clientId, jti, exp)
+}
+
 func (pr *Provider) DeleteOauthSession(opCtx *base.OpContext) bool {
 	deleted := pr.DeleteReplSsoSessionById(opCtx.Session.Jti, false, false)
 	pr.Al.LogDelSession(opCtx, deleted)
@@ -273,3 +439,35 @@ func parseMetadata(location string) (spmd *samlTypes.SPSSODescriptor, err error)
 
 	return spmd, err
 }
+
+// Returns the key used for signing the tokens issued by this domain
+func (pr *Provider) SigningKey() *oauth.SigningKey {
+	return pr.ks.Active()
+}
+
+// Returns the published key with the given ID, nil if the key is not found or expired
+func (pr *Provider) VerificationKey(kid string) *oauth.SigningKey {
+	return pr.ks.Get(kid)
+}
+
+// Returns the set of keys that can be used for verifying the tokens issued by this domain
+func (pr *Provider) Jwks() (*oauth.JwkSet, error) {
+	return pr.ks.Jwks()
+}
+
+// Returns the certificates of all the published RSA keys, SAML service providers use these for
+// verifying the responses. The server's certificate is returned if the domain has no RSA keys.
+func (pr *Provider) SamlCerts() [][]byte {
+	certs := make([][]byte, 0)
+	for _, sk := range pr.ks.Keys() {
+		if _, ok := sk.PrivKey.(*rsa.PrivateKey); ok {
+			certs = append(certs, sk.Cert.Raw)
+		}
+	}
+
+	if len(certs) == 0 {
+		certs = append(certs, pr.Cert.Raw)
+	}
+
+	return certs
+}
@@ -28,6 +28,7 @@ import (
 	"sparrow/silo"
 	"sparrow/utils"
 	"strings"
+	"sync"
 )
 
 type Provider struct {
@@ -45,10 +46,24 @@ type Provider struct {
 	immResIds       map[string]int // map of IDs of resources that cannot be deleted
 	domainCode      string
 	osl             *oauth.OauthSilo
+	ks              *oauth.KeySet
 	interceptors    []base.Interceptor
 	Al              *AuditLogger
 	SamlMdCache     map[string]*samlTypes.SPSSODescriptor
 	replInterceptor *ReplInterceptor
+	closed          bool
+	secretWarnings  sync.Map // the time of the last warning about the expiry of the secret of each client
+}
+
+// statistics of a domain
+type DomainStats struct {
+	Name          string           `json:"name"`
+	DomainCode    string           `json:"domainCode"`
+	Disabled      bool             `json:"disabled"`
+	Resources     map[string]int64 `json:"resources"` // number of resources of each resourcetype
+	OauthSessions int              `json:"oauthSessions"`
+	SsoSessions   int              `json:"ssoSessions"`
+	DataSize      int64            `json:"dataSize"` // total size of the data files in bytes
 }
 
 const AdminGroupId = "01000000-0000-4000-4000-000000000000"
@@ -70,6 +85,7 @@ func NewProvider(layout *Layout, sc *conf.ServerConf, peers map[uint16]*repl.Rep
 	prv = &Provider{}
 	prv.ServerId = sc.ServerId
 	prv.Schemas = schemas
+	// the server's key is only used for signing the SAML responses if the domain has no RSA keys
 	prv.Cert = sc.CertChain[0]
 	prv.PrivKey = sc.PrivKey
 	prv.ServerId = sc.ServerId
@@ -120,6 +136,13 @@ func NewProvider(layout *Layout, sc *conf.ServerConf, peers map[uint16]*repl.Rep
 		return nil, err
 	}
 
+	signCf := prv.Config.Signing
+	ksFilePath := filepath.Join(layout.DataDir, "keys.json")
+	prv.ks, err = oauth.OpenKeySet(ksFilePath, prv.Name, signCf.Algorithm, signCf.RotationInterval, signCf.PrePublishTime, signCf.RetentionTime)
+	if err != nil {
+		return nil, err
+	}
+
 	replDataFilePath := filepath.Join(layout.DataDir, "repl-events.db")
 	replSilo, err := repl.OpenReplProviderSilo(replDataFilePath, prv.Config.Replication.EventTtl, prv.Config.Replication.PurgeInterval)
 	if err != nil {
@@ -143,7 +166,7 @@ func NewProvider(layout *Layout, sc *conf.ServerConf, peers map[uint16]*repl.Rep
 	// can be eliminated before preserving the modified resource for replication
 	prv.interceptors = make([]base.Interceptor, 4)
 	prv.interceptors[0] = replInterceptor
-	prv.interceptors[1] = &ApplicationInterceptor{}
+	prv.interceptors[1] = &ApplicationInterceptor{Config: cf, sl: prv.sl}
 	prv.interceptors[2] = &RemoveNeverAttrInterceptor{}
 	prv.interceptors[3] = &PpolicyInterceptor{Config: cf.Ppolicy}
 
@@ -174,11 +197,17 @@ func NewProvider(layout *Layout, sc *conf.ServerConf, peers map[uint16]*repl.Rep
 	prv.Al = NewLocalAuditLogger(prv)
 	prv.SamlMdCache = make(map[string]*samlTypes.SPSSODescriptor)
 
+	if err == nil {
+		go prv.removeExpiredMemberships()
+		go prv.rotateSigningKeys()
+	}
+
 	return prv, err
 }
 
 func (pr *Provider) Close() {
 	log.Debugf("closing provider %s", pr.Name)
+	pr.closed = true
 	pr.sl.Close()
 	pr.osl.Close()
 	pr.Al.Close()
@@ -372,6 +401,11 @@ func (prv *Provider) CreateResource(crCtx *base.CreateContext) (err error) {
 		return base.NewForbiddenError("insufficient privileges to create a resource")
 	}
 
+	err = prv.checkResourceQuota(crCtx.InRes.GetType())
+	if err != nil {
+		return err
+	}
+
 	err = prv.firePreInterceptors(crCtx)
 	if err != nil {
 		return err
@@ -388,6 +422,40 @@ func (prv *Provider) CreateResource(crCtx *base.CreateContext) (err error) {
 	return err
 }
 
+// Checks if creating a new resource of the given type exceeds any of the domain's quotas
+func (prv *Provider) checkResourceQuota(rt *schema.ResourceType) error {
+	limits := prv.Config.Limits
+	if limits.MaxDataFileSize > 0 {
+		if prv.dataFileSize() >= int64(limits.MaxDataFileSize)*1024*1024 {
+			detail := fmt.Sprintf("data file size limit of %dMB reached", limits.MaxDataFileSize)
+			log.Debugf(detail)
+			return base.NewQuotaExceededError(detail)
+		}
+	}
+
+	max := limits.MaxResourcesPerType
+	if rt.Name == "Application" && limits.MaxApplications > 0 {
+		max = limits.MaxApplications
+	}
+
+	if max > 0 && prv.sl.Count(rt) >= int64(max) {
+		detail := fmt.Sprintf("maximum number of %s resources(%d) reached", rt.Name, max)
+		log.Debugf(detail)
+		return base.NewQuotaExceededError(detail)
+	}
+
+	return nil
+}
+
+func (prv *Provider) dataFileSize() int64 {
+	fi, err := os.Stat(filepath.Join(prv.layout.DataDir, "data.db"))
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
 func (prv *Provider) DeleteResource(delCtx *base.DeleteContext) (err error) {
 	if delCtx.Repl {
 		return prv.sl.Delete(delCtx)
@@ -428,6 +496,17 @@ func (prv *Provider) DeleteResource(delCtx *base.DeleteContext) (err error) {
 		return err
 	}
 
+	err = prv.delete(delCtx)
+	return err
+}
+
+// deletes the resource after running the interceptors, skips the access control checks
+func (prv *Provider) delete(delCtx *base.DeleteContext) error {
+	err := prv.firePreInterceptors(delCtx)
+	if err != nil {
+		return err
+	}
+
 	err = prv.sl.Delete(delCtx)
 	if err == nil {
 		for _, intrcptr := range prv.interceptors {
@@ -513,8 +592,18 @@ func (prv *Provider) Replace(replaceCtx *base.ReplaceContext) (err error) {
 		return base.NewForbiddenError("insufficient privileges to replace the resource")
 	}
 
-	err = prv.sl.Replace(replaceCtx)
+	err = prv.replace(replaceCtx)
+	return err
+}
+
+// replaces the resource after running the interceptors, skips the access control checks
+func (prv *Provider) replace(replaceCtx *base.ReplaceContext) error {
+	err := prv.firePreInterceptors(replaceCtx)
+	if err != nil {
+		return err
+	}
 
+	err = prv.sl.Replace(replaceCtx)
 	if err == nil {
 		for _, intrcptr := range prv.interceptors {
 			intrcptr.PostReplace(replaceCtx)
@@ -588,6 +677,13 @@ func (prv *Provider) Authenticate(ar base.AuthRequest) (lr base.LoginResult) {
 		prv.Al.LogAuth(lr.Id, ar.Username, ar.ClientIP, originalStatus)
 	}()
 
+	if prv.Config.Disabled {
+		log.Debugf("rejecting the login of user %s, domain %s is disabled", ar.Username, prv.Name)
+		lr.Status = base.LOGIN_FAILED
+		originalStatus = lr.Status
+		return lr
+	}
+
 	lr, err := prv.sl.Authenticate(ar.Username, ar.Password)
 	originalStatus = lr.Status
 
@@ -647,12 +743,23 @@ func (prv *Provider) GetUserByName(username string) (res *base.Resource) {
 	return user
 }
 
+// Generates a session for the user with the given ID, an error is returned if the user is not active
 func (prv *Provider) GenSessionForUserId(rid string) (session *base.RbacSession, err error) {
 	user, err := prv.sl.GetUser(rid)
 	if err != nil {
 		return nil, err
 	}
 
+	active := false
+	activeAt := user.GetAttr("active")
+	if activeAt != nil {
+		active = activeAt.GetSimpleAt().Values[0].(bool)
+	}
+
+	if !active {
+		return nil, base.NewForbiddenError("Account is not active")
+	}
+
 	session = prv.GenSessionForUser(user)
 	return session, nil
 }
@@ -661,6 +768,11 @@ func (prv *Provider) GenSessionForUser(user *base.Resource) *base.RbacSession {
 	return prv.sl.Engine.NewRbacSession(user)
 }
 
+// Generates a session holding the roles assigned to the given client, used in the client credentials grant
+func (prv *Provider) GenSessionForClient(cl *oauth.Client) *base.RbacSession {
+	return prv.sl.Engine.NewClientSession(cl.Id, cl.Name, cl.ServiceGroupIds)
+}
+
 func (prv *Provider) GetUserById(rid string) (user *base.Resource, err error) {
 	user, err = prv.sl.GetUser(rid)
 	if err != nil {
@@ -683,6 +795,10 @@ func (prv *Provider) ModifyGroupsOfUser(autg base.ModifyGroupsOfUserRequest) (us
 	return prv.sl.ModifyGroupsOfUser(autg)
 }
 
+func (prv *Provider) Layout() *Layout {
+	return prv.layout
+}
+
 func (prv *Provider) DomainCode() string {
 	return prv.domainCode
 }
@@ -696,6 +812,12 @@ func (prv *Provider) firePreInterceptors(ctx interface{}) (err error) {
 		case *base.PatchContext:
 			err = i.PrePatch(ctx.(*base.PatchContext))
 
+		case *base.ReplaceContext:
+			err = i.PreReplace(ctx.(*base.ReplaceContext))
+
+		case *base.DeleteContext:
+			err = i.PreDelete(ctx.(*base.DeleteContext))
+
 		default:
 			log.Warningf("unknown operation context type %t", t)
 		}
@@ -708,11 +830,19 @@ func (prv *Provider) firePreInterceptors(ctx interface{}) (err error) {
 	return nil
 }
 
-// make provider a dsig.X509KeyStore
+// make provider a dsig.X509KeyStore. XML signatures are created using the active key of the domain
+// if it is an RSA key, otherwise the server's key is used
 func (prv *Provider) GetKeyPair() (privateKey *rsa.PrivateKey, cert []byte, err error) {
-	// TODO this is a dangerous cast and must be eliminated
-	// when other privatekey types are supported
-	rsaKey := prv.PrivKey.(*rsa.PrivateKey)
+	sk := prv.ks.Active()
+	if rsaKey, ok := sk.PrivKey.(*rsa.PrivateKey); ok {
+		return rsaKey, sk.Cert.Raw, nil
+	}
+
+	rsaKey, ok := prv.PrivKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("no RSA key is available for signing the SAML responses of domain %s", prv.Name)
+	}
+
 	return rsaKey, prv.Cert.Raw, nil
 }
 
@@ -852,7 +982,7 @@ func (prv *Provider) UpdateAuthData(rid string, version string, ad base.AuthData
 	return prv.sl.UpdateAuthData(rid, version, ad)
 }
 
-func (prv *Provider) SendCreateDomainEvent(name string, ctx *base.OpContext) error {
+func (prv *Provider) SendCreateDomainEvent(name string, templateDomain string, ctx *base.OpContext) error {
 	defer func() {
 		event := base.AuditEvent{}
 		event.StatusCode = 201
@@ -861,11 +991,76 @@ func (prv *Provider) SendCreateDomainEvent(name string, ctx *base.OpContext) err
 		event.Desc = "created new domain"
 		event.IpAddress = ctx.ClientIP
 		event.Payload = name
+		if len(templateDomain) > 0 {
+			event.Payload += " (template " + templateDomain + ")"
+		}
 		event.Uri = ctx.Endpoint
 		event.Operation = "createDomain"
 		prv.Al.LogEvent(event)
 	}()
-	return prv.replInterceptor.PostCreateDomain(name, prv.sl.Csn().String())
+	return prv.replInterceptor.PostCreateDomain(name, templateDomain, prv.sl.Csn().String())
+}
+
+func (prv *Provider) SendDeleteDomainEvent(name string, ctx *base.OpContext) error {
+	defer prv.logDomainEvent(name, "deleted domain", "deleteDomain", ctx)
+	return prv.replInterceptor.PostDeleteDomain(name, prv.sl.Csn().String())
+}
+
+func (prv *Provider) SendDisableDomainEvent(name string, disabled bool, ctx *base.OpContext) error {
+	if disabled {
+		defer prv.logDomainEvent(name, "disabled domain", "disableDomain", ctx)
+	} else {
+		defer prv.logDomainEvent(name, "enabled domain", "enableDomain", ctx)
+	}
+	return prv.replInterceptor.PostDisableDomain(name, disabled, prv.sl.Csn().String())
+}
+
+func (prv *Provider) SendRenameDomainEvent(name string, newName string, ctx *base.OpContext) error {
+	defer prv.logDomainEvent(name+" -> "+newName, "renamed domain", "renameDomain", ctx)
+	return prv.replInterceptor.PostRenameDomain(name, newName, prv.sl.Csn().String())
+}
+
+func (prv *Provider) logDomainEvent(payload string, desc string, operation string, ctx *base.OpContext) {
+	event := base.AuditEvent{}
+	event.StatusCode = 200
+	event.ActorId = ctx.Session.Sub
+	event.ActorName = ctx.Session.Username
+	event.Desc = desc
+	event.IpAddress = ctx.ClientIP
+	event.Payload = payload
+	event.Uri = ctx.Endpoint
+	event.Operation = operation
+	prv.Al.LogEvent(event)
+}
+
+func (prv *Provider) IsDisabled() bool {
+	return prv.Config.Disabled
+}
+
+// Sets the disabled state of the domain and saves the configuration
+func (prv *Provider) SetDisabled(disabled bool) error {
+	prv.Config.Disabled = disabled
+	return prv.SaveConf()
+}
+
+// Collects the statistics of the domain
+func (prv *Provider) Stats() *DomainStats {
+	ds := &DomainStats{Name: prv.Name, DomainCode: prv.domainCode, Disabled: prv.Config.Disabled}
+	ds.Resources = make(map[string]int64)
+	for name, rt := range prv.RsTypes {
+		ds.Resources[name] = prv.sl.Count(rt)
+	}
+
+	ds.OauthSessions, ds.SsoSessions = prv.osl.CountSessions()
+
+	files, _ := ioutil.ReadDir(prv.layout.DataDir)
+	for _, f := range files {
+		if !f.IsDir() {
+			ds.DataSize += f.Size()
+		}
+	}
+
+	return ds
 }
 
 func genDomainCode(name string) string {
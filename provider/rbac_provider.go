@@ -0,0 +1,165 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sparrow/base"
+)
+
+// Returns the resolved hierarchy of the group with the given ID
+func (prv *Provider) GetRoleHierarchy(gid string) (*base.RoleNode, error) {
+	node := prv.sl.Engine.GetHierarchy(gid)
+	if node == nil {
+		return nil, base.NewNotFoundError(fmt.Sprintf("Group with ID %s not found", gid))
+	}
+
+	return node, nil
+}
+
+// Returns the origins of all the permissions of the group with the given ID, including the inherited ones
+func (prv *Provider) ExplainGroupPermissions(gid string) ([]*base.PermissionOrigin, error) {
+	if prv.sl.Engine.GetHierarchy(gid) == nil {
+		return nil, base.NewNotFoundError(fmt.Sprintf("Group with ID %s not found", gid))
+	}
+
+	return prv.sl.Engine.ExplainRolePermissions(gid), nil
+}
+
+// Returns the origins of all the effective permissions of the user with the given ID
+func (prv *Provider) ExplainUserPermissions(userId string) ([]*base.PermissionOrigin, error) {
+	user, err := prv.sl.GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return prv.sl.Engine.ExplainPermissions(user), nil
+}
+
+// Evaluates whether the user with the given ID can perform the operation on the given resourcetype
+// or on the resource with the given ID. The decision is made using the same checks that are
+// applied while serving the corresponding SCIM requests.
+func (prv *Provider) CheckPermission(subjectId string, op string, rtName string, resId string) (*base.PermissionCheck, error) {
+	user, err := prv.sl.GetUser(subjectId)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := prv.RsTypes[rtName]
+	if rt == nil {
+		return nil, base.NewBadRequestError(fmt.Sprintf("unknown resourcetype %s", rtName))
+	}
+
+	var res *base.Resource
+	if len(resId) != 0 {
+		res, err = prv.sl.Get(resId, rt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	session := prv.sl.Engine.NewRbacSession(user)
+	opCtx := &base.OpContext{Session: session}
+
+	pc := &base.PermissionCheck{Subject: subjectId, Op: op, ResType: rt.Name, ResId: resId}
+	var od base.OpDecision
+	var eval func() bool
+
+	switch op {
+	case "read":
+		getCtx := &base.GetContext{Rid: resId, Rt: rt, OpContext: opCtx}
+		od = getCtx.GetDecision()
+		eval = func() bool { return getCtx.AllowRead(res) }
+
+	case "patch":
+		patchCtx := &base.PatchContext{Rid: resId, Rt: rt, Pr: &base.PatchReq{}, OpContext: opCtx}
+		od = patchCtx.GetDecision()
+		eval = func() bool { return patchCtx.EvalPatch(res) }
+
+	case "replace":
+		replaceCtx := &base.ReplaceContext{InRes: res, Rt: rt, OpContext: opCtx}
+		od = replaceCtx.GetDecision()
+		eval = replaceCtx.AllowOp
+
+	case "delete":
+		delCtx := &base.DeleteContext{Rid: resId, Rt: rt, OpContext: opCtx}
+		od = delCtx.GetDecision()
+		eval = func() bool { return delCtx.EvalDelete(res) }
+
+	default:
+		return nil, base.NewBadRequestError(fmt.Sprintf("unsupported operation %s, must be one of read, patch, replace or delete", op))
+	}
+
+	switch {
+	case od.Deny:
+		pc.Decision = "deny"
+	case od.Allow:
+		pc.Decision = "allow"
+		pc.Allow = true
+	case od.EvalWithoutFetch:
+		pc.Decision = "evalWithoutFetch"
+		pc.Allow = eval()
+		pc.FilterEvald = true
+	case od.EvalFilter:
+		pc.Decision = "evalFilter"
+		// the filter can only be evaluated against an existing resource
+		if res != nil {
+			pc.Allow = eval()
+			pc.FilterEvald = true
+		}
+	}
+
+	permOp := "write"
+	if op == "read" {
+		permOp = "read"
+	}
+
+	pc.Roles = make([]*base.PermissionOrigin, 0)
+	for _, po := range prv.sl.Engine.ExplainPermissions(user) {
+		if _, active := session.Roles[po.AssignedRoleId]; !active {
+			continue
+		}
+
+		if po.ResType == rt.Name && po.Op == permOp {
+			pc.Roles = append(pc.Roles, po)
+		}
+	}
+
+	if rp := session.EffPerms[rt.Name]; rp != nil {
+		p := rp.WritePerm
+		if op == "read" {
+			p = rp.ReadPerm
+		}
+
+		if p != nil {
+			pc.OnAnyResource = p.OnAnyResource
+			pc.AllowAll = p.AllowAll
+			if p.Filter != nil {
+				pc.Filter = p.Filter.String()
+			}
+			pc.AllowAttrs = allowedAttrNames(p.AllowAttrs)
+		}
+	}
+
+	return pc, nil
+}
+
+func allowedAttrNames(allowAttrs map[string]*base.AttributeParam) []string {
+	names := make([]string, 0)
+	for name, ap := range allowAttrs {
+		if len(ap.SubAts) == 0 {
+			names = append(names, name)
+			continue
+		}
+
+		for subName, _ := range ap.SubAts {
+			names = append(names, name+"."+subName)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
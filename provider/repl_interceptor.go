@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"sparrow/base"
+	"sparrow/oauth"
 	"sparrow/repl"
 	"sparrow/utils"
 )
@@ -135,6 +136,104 @@ func (ri *ReplInterceptor) PostRevokeSession(jti string, version string) {
 	}
 }
 
+func (ri *ReplInterceptor) PostStoreRefreshToken(rt *oauth.RefreshToken, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.STORE_REFRESH_TOKEN
+	event.RefreshToken = rt
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated refresh token replication event [%#v]", err)
+	}
+}
+
+func (ri *ReplInterceptor) PostRevokeRefreshTokenFamily(familyId string, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.REVOKE_REFRESH_TOKEN_FAMILY
+	event.RevokedFamilyId = familyId
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated refresh token family revocation event [%#v]", err)
+	}
+}
+
+func (ri *ReplInterceptor) PostStoreDeviceGrant(dg *oauth.DeviceGrant, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.STORE_DEVICE_GRANT
+	event.DeviceGrant = dg
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated device grant replication event [%#v]", err)
+	}
+}
+
+func (ri *ReplInterceptor) PostDeleteDeviceGrant(deviceCode string, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.DELETE_DEVICE_GRANT
+	event.DeviceCode = deviceCode
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated device grant deletion event [%#v]", err)
+	}
+}
+
+func (ri *ReplInterceptor) PostUseClientAssertion(clientId string, jti string, exp int64, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.USE_CLIENT_ASSERTION
+	event.ClientId = clientId
+	event.AssertionId = jti
+	event.AssertionExp = exp
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated client assertion replication event [%#v]", err)
+	}
+}
+
+func (ri *ReplInterceptor) PostStoreSigningKeys(keys []byte, version string) {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainCode = ri.domainCode
+	event.Type = repl.STORE_SIGNING_KEYS
+	event.Data = keys
+
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the generated signing keys replication event [%#v]", err)
+	}
+}
+
 func (ri *ReplInterceptor) PostChangePassword(cpContext *base.ChangePasswordContext) {
 	// send the changed password hash as patch to avoid storing and transmitting the plaintext value
 	event := repl.ReplicationEvent{}
@@ -194,10 +293,11 @@ func (ri *ReplInterceptor) PostAuthDataUpdate(user *base.Resource) {
 	}
 }
 
-func (ri *ReplInterceptor) PostCreateDomain(name string, version string) error {
+func (ri *ReplInterceptor) PostCreateDomain(name string, templateDomain string, version string) error {
 	event := repl.ReplicationEvent{}
 	event.Version = version
 	event.NewDomainName = name
+	event.TemplateDomain = templateDomain
 	event.Type = repl.NEW_DOMAIN
 	dataBuf, err := ri.replSilo.StoreEvent(event)
 	// send to the peers
@@ -210,6 +310,47 @@ func (ri *ReplInterceptor) PostCreateDomain(name string, version string) error {
 	return err
 }
 
+func (ri *ReplInterceptor) PostDeleteDomain(name string, version string) error {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainName = name
+	event.Type = repl.DELETE_DOMAIN
+	return ri.storeAndSendDomainEvent(event)
+}
+
+func (ri *ReplInterceptor) PostDisableDomain(name string, disabled bool, version string) error {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainName = name
+	if disabled {
+		event.Type = repl.DISABLE_DOMAIN
+	} else {
+		event.Type = repl.ENABLE_DOMAIN
+	}
+	return ri.storeAndSendDomainEvent(event)
+}
+
+func (ri *ReplInterceptor) PostRenameDomain(name string, newName string, version string) error {
+	event := repl.ReplicationEvent{}
+	event.Version = version
+	event.DomainName = name
+	event.NewDomainName = newName
+	event.Type = repl.RENAME_DOMAIN
+	return ri.storeAndSendDomainEvent(event)
+}
+
+func (ri *ReplInterceptor) storeAndSendDomainEvent(event repl.ReplicationEvent) error {
+	dataBuf, err := ri.replSilo.StoreEvent(event)
+	// send to the peers
+	if err == nil {
+		go ri.sendToPeers(dataBuf, event, ri.peers)
+	} else {
+		log.Debugf("failed to store the domain lifecycle replication event of type %d [%#v]", event.Type, err)
+	}
+
+	return err
+}
+
 func (ri *ReplInterceptor) sendToPeers(dataBuf *bytes.Buffer, event repl.ReplicationEvent, peers map[uint16]*repl.ReplicationPeer) {
 	for _, v := range peers {
 		go v.SendEvent(dataBuf.Bytes(), ri.transport, ri.serverId, ri.webhookToken, event.DomainCode, event.Version, ri.replSilo)
@@ -0,0 +1,119 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/oauth"
+	"strings"
+)
+
+// Returns the scopes granted to the client out of the requested scopes, the scopes that
+// are not defined in the domain or not allowed for the client are dropped
+func (pr *Provider) GrantScopes(cl *oauth.Client, requested oauth.ScopeSet) oauth.ScopeSet {
+	granted := make(oauth.ScopeSet)
+	for name, _ := range requested {
+		if pr.scopeDef(name) == nil {
+			continue
+		}
+
+		if cl.Oauth != nil && len(cl.Oauth.AllowedScopes) > 0 && !contains(cl.Oauth.AllowedScopes, name) {
+			continue
+		}
+
+		granted[name] = 1
+	}
+
+	return granted
+}
+
+// Returns the definitions of the given scopes in the order they are defined in the domain
+func (pr *Provider) ScopeDefs(scopes oauth.ScopeSet) []*conf.ScopeConfig {
+	defs := make([]*conf.ScopeConfig, 0)
+	for _, sc := range pr.Config.Oauth.Scopes {
+		if scopes.Has(sc.Name) {
+			defs = append(defs, sc)
+		}
+	}
+
+	return defs
+}
+
+// Returns true if the claim can be released when the given scopes are granted. A claim listed
+// in the definitions of scopes is released only if one of those scopes is granted, the claims
+// not listed in any scope are released along with the openid scope.
+func (pr *Provider) IsClaimReleased(claim string, granted oauth.ScopeSet) bool {
+	listed := false
+	for _, sc := range pr.Config.Oauth.Scopes {
+		if contains(sc.Claims, claim) {
+			if granted.Has(sc.Name) {
+				return true
+			}
+			listed = true
+		}
+	}
+
+	return !listed && granted.Has(oauth.SCOPE_OPENID)
+}
+
+// Sets the granted scopes in the session and narrows the permissions of the session to the
+// intersection of its permissions and the permissions of the scopes. The permissions are not
+// narrowed if none of the granted scopes restricts the permissions. The administrative scopes
+// of the session are dropped unless the narrowed permissions allow writing Users or Groups.
+func (pr *Provider) NarrowSession(session *base.RbacSession, granted oauth.ScopeSet) {
+	session.Scope = granted.String()
+
+	var allowed map[string]map[string]bool
+	for _, sc := range pr.ScopeDefs(granted) {
+		if sc.Permissions == nil {
+			continue
+		}
+
+		if allowed == nil {
+			allowed = make(map[string]map[string]bool)
+		}
+
+		for _, sp := range sc.Permissions {
+			rtName := strings.ToLower(sp.ResType)
+			ops := allowed[rtName]
+			if ops == nil {
+				ops = make(map[string]bool)
+				allowed[rtName] = ops
+			}
+
+			for _, op := range sp.Ops {
+				ops[op] = true
+			}
+		}
+	}
+
+	if allowed != nil {
+		session.RestrictPerms(allowed)
+		// a delegated administrator modifies the memberships of users, which needs write access to them
+		if !allowed["user"]["write"] && !allowed["group"]["write"] {
+			session.AdmScopes = nil
+		}
+	}
+}
+
+func (pr *Provider) scopeDef(name string) *conf.ScopeConfig {
+	for _, sc := range pr.Config.Oauth.Scopes {
+		if sc.Name == name {
+			return sc
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+
+	return false
+}
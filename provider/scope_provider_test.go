@@ -0,0 +1,48 @@
+// Copyright 2019 Keydap. All rights reserved.
+// Licensed under the Apache License, Version 2.0, see LICENSE.
+
+package provider
+
+import (
+	"sparrow/base"
+	"sparrow/conf"
+	"sparrow/oauth"
+	"testing"
+)
+
+func TestNarrowSessionDropsAdminScopes(t *testing.T) {
+	cf := conf.DefaultDomainConfig()
+	cf.Oauth.Scopes = append(cf.Oauth.Scopes,
+		&conf.ScopeConfig{Name: "devices", Permissions: []*conf.ScopePermission{{ResType: "Device", Ops: []string{"read"}}}},
+		&conf.ScopeConfig{Name: "users", Permissions: []*conf.ScopePermission{{ResType: "User", Ops: []string{"read", "write"}}}})
+	pr := &Provider{Config: cf}
+
+	newSession := func() *base.RbacSession {
+		session := &base.RbacSession{}
+		session.EffPerms = make(map[string]*base.ResourcePermission)
+		for _, rtName := range []string{"User", "Device"} {
+			session.EffPerms[rtName] = &base.ResourcePermission{ReadPerm: &base.Permission{Name: "read", OnAnyResource: true, AllowAll: true},
+				WritePerm: &base.Permission{Name: "write", OnAnyResource: true, AllowAll: true}}
+		}
+		session.AdmScopes = []*base.AdminScope{{RoleId: "helpdesk"}}
+		return session
+	}
+
+	session := newSession()
+	pr.NarrowSession(session, oauth.ParseScope("openid devices"))
+	if len(session.AdmScopes) != 0 {
+		t.Errorf("administrative scopes must be dropped when the granted scopes do not allow writing Users or Groups")
+	}
+
+	session = newSession()
+	pr.NarrowSession(session, oauth.ParseScope("users"))
+	if len(session.AdmScopes) != 1 {
+		t.Errorf("administrative scopes must be retained when the granted scopes allow writing Users")
+	}
+
+	session = newSession()
+	pr.NarrowSession(session, oauth.ParseScope("openid"))
+	if len(session.AdmScopes) != 1 {
+		t.Errorf("administrative scopes must be retained when the permissions are not narrowed")
+	}
+}
@@ -4,16 +4,20 @@
 package rbac
 
 import (
+	"fmt"
 	"sparrow/base"
+	"sparrow/conf"
 	"sparrow/schema"
 	"sparrow/utils"
 	"time"
 )
 
 type RbacEngine struct {
-	TokenTtl int64
-	Domain   string
-	allRoles map[string]*base.Role
+	TokenTtl   int64
+	Domain     string
+	StaticSod  []*conf.SodRule
+	DynamicSod []*conf.SodRule
+	allRoles   map[string]*base.Role
 }
 
 func NewEngine() *RbacEngine {
@@ -25,9 +29,51 @@ func NewEngine() *RbacEngine {
 }
 
 func (engine *RbacEngine) NewRbacSession(rs *base.Resource) *base.RbacSession {
+	session := engine.newSession(rs.GetId())
+	session.Username = rs.GetAttr("username").GetSimpleAt().GetStringVal()
+
+	groups := rs.GetAttr("groups")
+	if groups == nil {
+		return session
+	}
+
+	ca := groups.GetComplexAt()
 
+	now := time.Now()
+	roleIds := make([]string, 0)
+	for _, subAtMap := range ca.SubAts {
+		// memberships that are not yet effective or expired are not activated
+		if !base.IsMembershipActive(subAtMap, now) {
+			continue
+		}
+
+		gAt := subAtMap["value"]
+		if gAt != nil {
+			roleIds = append(roleIds, gAt.Values[0].(string))
+		}
+	}
+
+	engine.activateRoles(session, roleIds, rs)
+
+	return session
+}
+
+// Creates a session for an OAuth client authenticated using the client credentials grant, the
+// session holds the roles assigned to the client instead of the roles of a user
+func (engine *RbacEngine) NewClientSession(clientId string, clientName string, roleIds []string) *base.RbacSession {
+	session := engine.newSession(clientId)
+	session.Username = clientName
+	session.Ito = clientId
+
+	// there is no user to resolve the $self variables, filters containing them never match
+	engine.activateRoles(session, roleIds, nil)
+
+	return session
+}
+
+func (engine *RbacEngine) newSession(sub string) *base.RbacSession {
 	session := &base.RbacSession{}
-	session.Sub = rs.GetId()
+	session.Sub = sub
 
 	session.Roles = make(map[string]string)
 
@@ -37,41 +83,455 @@ func (engine *RbacEngine) NewRbacSession(rs *base.Resource) *base.RbacSession {
 	session.LastAccAt = session.Iat
 	session.Exp = session.Iat + engine.TokenTtl
 	session.Jti = utils.NewRandShaStr()
-	session.Username = rs.GetAttr("username").GetSimpleAt().GetStringVal()
 
-	groups := rs.GetAttr("groups")
+	return session
+}
+
+// Activates the given roles and all of their juniors, and computes the effective permissions of the session
+func (engine *RbacEngine) activateRoles(session *base.RbacSession, roleIds []string, self *base.Resource) {
+	effPerms := make(map[string]*base.ResourcePermission)
+	for _, roleId := range roleIds {
+		resolved := engine.resolveRoles(roleId)
+		// a role conflicting with the already activated roles is not activated
+		if engine.violatesDynamicSod(session.Roles, resolved) != nil {
+			continue
+		}
+
+		// the assigned role and all of its juniors
+		for _, role := range resolved {
+			if _, ok := session.Roles[role.Id]; ok {
+				continue // already merged through another role
+			}
+
+			session.Roles[role.Id] = role.Name
+			if role.Scope != nil {
+				as := role.Scope.Clone()
+				as.ResolveSelfVars(self)
+				session.AdmScopes = append(session.AdmScopes, as)
+			}
+
+			// now gather the permissions from role
+			for _, resPerm := range role.Perms {
+				existingResPerm, ok := effPerms[resPerm.RType.Name]
+
+				if !ok {
+					effPerms[resPerm.RType.Name] = resPerm
+				} else {
+					effPerms[resPerm.RType.Name] = merge(existingResPerm, resPerm)
+				}
+			}
+		}
+	}
+
+	// the $self variables in the filters are resolved once per session
+	for rtName, rp := range effPerms {
+		effPerms[rtName] = rp.ResolveSelfVars(self)
+	}
+
+	session.EffPerms = effPerms
+	engine.pruneAssignableGroups(session)
+}
+
+// Removes the groups that are not held by the session from the assignable groups if they are
+// administrative or if their permissions, including the inherited ones, are not a subset of the
+// session's effective permissions so that a delegated administrator cannot grant more power than they hold
+func (engine *RbacEngine) pruneAssignableGroups(session *base.RbacSession) {
+	for _, as := range session.AdmScopes {
+		for gid, _ := range as.AssignableGroups {
+			role := engine.allRoles[gid]
+			if role == nil {
+				continue
+			}
+
+			if _, held := session.Roles[gid]; held {
+				continue
+			}
+
+			for _, r := range engine.resolveRoles(gid) {
+				if r.Scope != nil || !permsCovered(session.EffPerms, r.Perms) {
+					delete(as.AssignableGroups, gid)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Checks whether the given session can grant the roles of the given group to an application. Allowed if the
+// session can modify all the groups, if the group is assignable by a delegated administrator of the session or
+// if the group is not administrative and its permissions, including the inherited ones, are held by the session
+func (engine *RbacEngine) CanAssignServiceGroup(session *base.RbacSession, gid string) bool {
+	if engine.allRoles[gid] == nil {
+		return false
+	}
+
+	if rp := session.EffPerms["Group"]; rp != nil && rp.WritePerm != nil && rp.WritePerm.OnAnyResource && rp.WritePerm.AllowAll {
+		return true
+	}
+
+	for _, as := range session.AdmScopes {
+		if as.AssignableGroups[gid] {
+			return true
+		}
+	}
+
+	for _, r := range engine.resolveRoles(gid) {
+		if r.Scope != nil || !permsCovered(session.EffPerms, r.Perms) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns true if every permission in the given role permissions is also granted by the held permissions
+func permsCovered(held map[string]*base.ResourcePermission, perms map[string]*base.ResourcePermission) bool {
+	for rtName, rp := range perms {
+		hrp := held[rtName]
+		if hrp == nil {
+			hrp = &base.ResourcePermission{}
+		}
+
+		if !permCovers(hrp.ReadPerm, rp.ReadPerm) || !permCovers(hrp.WritePerm, rp.WritePerm) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Checks whether the held permission allows at least the attributes and resources allowed by the given permission
+func permCovers(held *base.Permission, p *base.Permission) bool {
+	if grantsNothing(p) {
+		return true
+	}
+
+	if grantsNothing(held) {
+		return false
+	}
+
+	if !held.OnAnyResource {
+		if p.OnAnyResource || !filterCovers(held.Filter, p.Filter) {
+			return false
+		}
+	}
+
+	if held.AllowAll {
+		return true
+	}
+
+	if p.AllowAll {
+		return false
+	}
+
+	for name, ap := range p.AllowAttrs {
+		hap := held.AllowAttrs[name]
+		if hap == nil {
+			return false
+		}
+
+		// no sub-attributes means all the sub-attributes are allowed
+		if len(hap.SubAts) == 0 {
+			continue
+		}
+
+		if len(ap.SubAts) == 0 {
+			return false
+		}
+
+		for sn, _ := range ap.SubAts {
+			if _, ok := hap.SubAts[sn]; !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func grantsNothing(p *base.Permission) bool {
+	if p == nil {
+		return true
+	}
+
+	if !p.OnAnyResource && p.Filter == nil {
+		return true
+	}
+
+	return !p.AllowAll && len(p.AllowAttrs) == 0
+}
+
+// a filter is covered only if it is identical to the held filter or to one of the
+// filters merged into the held filter, no attempt is made to evaluate the filter semantics
+func filterCovers(held *base.FilterNode, fn *base.FilterNode) bool {
+	if held == nil || fn == nil {
+		return false
+	}
+
+	if held.String() == fn.String() {
+		return true
+	}
+
+	if held.Op == "OR" {
+		for _, child := range held.Children {
+			if filterCovers(child, fn) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks whether membership in all the given groups violates any of the static separation of duty rules,
+// the roles inherited by the groups are included in the check
+func (engine *RbacEngine) CheckStaticSod(groupIds []string) error {
+	if len(engine.StaticSod) == 0 {
+		return nil
+	}
+
+	resolved := make([]string, 0, len(groupIds))
+	seen := make(map[string]bool)
+	for _, gid := range groupIds {
+		// a group that is not a role yet(e.g. has no permissions) has no juniors
+		ids := []string{gid}
+		for _, role := range engine.resolveRoles(gid) {
+			ids = append(ids, role.Id)
+		}
+
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				resolved = append(resolved, id)
+			}
+		}
+	}
+
+	for _, rule := range engine.StaticSod {
+		if countSodMatches(rule, resolved) >= cardinalityOf(rule) {
+			detail := fmt.Sprintf("membership in the groups %v violates the separation of duty rule %s", rule.GroupIds, rule.Name)
+			return base.NewConflictError(detail)
+		}
+	}
+
+	return nil
+}
+
+// Returns the dynamic separation of duty rule that would be violated if the given roles
+// were activated in addition to the active roles, nil otherwise
+func (engine *RbacEngine) violatesDynamicSod(active map[string]string, roles []*base.Role) *conf.SodRule {
+	if len(engine.DynamicSod) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(active)+len(roles))
+	for id := range active {
+		ids = append(ids, id)
+	}
+
+	for _, r := range roles {
+		if _, ok := active[r.Id]; !ok {
+			ids = append(ids, r.Id)
+		}
+	}
+
+	for _, rule := range engine.DynamicSod {
+		if countSodMatches(rule, ids) >= cardinalityOf(rule) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func countSodMatches(rule *conf.SodRule, groupIds []string) int {
+	count := 0
+	for _, gid := range groupIds {
+		for _, rgid := range rule.GroupIds {
+			if gid == rgid {
+				count++
+				break
+			}
+		}
+	}
+
+	return count
+}
+
+func cardinalityOf(rule *conf.SodRule) int {
+	if rule.Cardinality < 2 {
+		return 2
+	}
+
+	return rule.Cardinality
+}
+
+// Returns the role with the given ID followed by all the roles inherited by it, directly or transitively
+func (engine *RbacEngine) resolveRoles(roleId string) []*base.Role {
+	roles := make([]*base.Role, 0)
+	visited := make(map[string]bool)
+
+	var walk func(id string)
+	walk = func(id string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+
+		role := engine.allRoles[id]
+		if role == nil {
+			return
+		}
+
+		roles = append(roles, role)
+		for _, jid := range role.Juniors {
+			walk(jid)
+		}
+	}
+
+	walk(roleId)
+
+	return roles
+}
+
+// Validates the role hierarchy and the administrative scope of the given group
+func (engine *RbacEngine) ValidateRole(groupRes *base.Resource) error {
+	err := engine.CheckHierarchy(groupRes)
+	if err != nil {
+		return err
+	}
+
+	filterAt := groupRes.GetAttr("adminfilter")
+	if filterAt != nil {
+		_, err = base.ParseFilter(filterAt.GetSimpleAt().GetStringVal())
+		if err != nil {
+			return base.NewBadRequestError(fmt.Sprintf("invalid adminFilter %s", err))
+		}
+	}
+
+	return nil
+}
+
+// Checks that all the groups inherited by the given group exist and that the
+// inheritance does not form a cycle
+func (engine *RbacEngine) CheckHierarchy(groupRes *base.Resource) error {
+	gid := groupRes.GetId()
+	for _, jid := range parseJuniors(groupRes) {
+		if jid == gid {
+			return base.NewBadRequestError(fmt.Sprintf("group %s cannot inherit itself", gid))
+		}
+
+		if _, ok := engine.allRoles[jid]; !ok {
+			return base.NewBadRequestError(fmt.Sprintf("inherited group %s does not exist", jid))
+		}
+
+		for _, r := range engine.resolveRoles(jid) {
+			if r.Id == gid {
+				return base.NewBadRequestError(fmt.Sprintf("inheriting the group %s creates a cycle in the role hierarchy", jid))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the names of the roles which directly inherit the role with the given ID
+func (engine *RbacEngine) SeniorsOf(roleId string) []string {
+	seniors := make([]string, 0)
+	for _, role := range engine.allRoles {
+		for _, jid := range role.Juniors {
+			if jid == roleId {
+				seniors = append(seniors, role.Name)
+				break
+			}
+		}
+	}
+
+	return seniors
+}
+
+// Returns the hierarchy of roles starting from the role with the given ID
+func (engine *RbacEngine) GetHierarchy(roleId string) *base.RoleNode {
+	return engine.buildNode(roleId, make(map[string]bool))
+}
+
+func (engine *RbacEngine) buildNode(roleId string, path map[string]bool) *base.RoleNode {
+	role := engine.allRoles[roleId]
+	if role == nil || path[roleId] {
+		return nil
+	}
+
+	node := &base.RoleNode{Id: role.Id, Name: role.Name}
+	path[roleId] = true
+	for _, jid := range role.Juniors {
+		child := engine.buildNode(jid, path)
+		if child != nil {
+			node.Inherits = append(node.Inherits, child)
+		}
+	}
+	delete(path, roleId)
+
+	return node
+}
+
+// Returns the origins of all the permissions a session of the given user would receive
+func (engine *RbacEngine) ExplainPermissions(userRes *base.Resource) []*base.PermissionOrigin {
+	origins := make([]*base.PermissionOrigin, 0)
+
+	groups := userRes.GetAttr("groups")
 	if groups == nil {
-		return session
+		return origins
 	}
 
-	ca := groups.GetComplexAt()
+	now := time.Now()
+	for _, subAtMap := range groups.GetComplexAt().SubAts {
+		if !base.IsMembershipActive(subAtMap, now) {
+			continue
+		}
 
-	effPerms := make(map[string]*base.ResourcePermission)
-	for _, subAtMap := range ca.SubAts {
 		gAt := subAtMap["value"]
 		if gAt != nil {
-			roleId := gAt.Values[0].(string)
-			role := engine.allRoles[roleId]
-			session.Roles[roleId] = role.Name
+			origins = append(origins, engine.ExplainRolePermissions(gAt.Values[0].(string))...)
+		}
+	}
 
-			// now gather the permissions from role
-			if role != nil {
-				for _, resPerm := range role.Perms {
-					existingResPerm, ok := effPerms[resPerm.RType.Name]
-
-					if !ok {
-						effPerms[resPerm.RType.Name] = resPerm
-					} else {
-						effPerms[resPerm.RType.Name] = merge(existingResPerm, resPerm)
-					}
-				}
+	return origins
+}
+
+// Returns the origins of all the permissions of the given role including the inherited ones
+func (engine *RbacEngine) ExplainRolePermissions(roleId string) []*base.PermissionOrigin {
+	origins := make([]*base.PermissionOrigin, 0)
+	assigned := engine.allRoles[roleId]
+	if assigned == nil {
+		return origins
+	}
+
+	for _, role := range engine.resolveRoles(roleId) {
+		for rtName, resPerm := range role.Perms {
+			if resPerm.ReadPerm != nil {
+				origins = append(origins, newPermissionOrigin(assigned, role, rtName, "read", resPerm.ReadPerm))
+			}
+			if resPerm.WritePerm != nil {
+				origins = append(origins, newPermissionOrigin(assigned, role, rtName, "write", resPerm.WritePerm))
 			}
 		}
 	}
 
-	session.EffPerms = effPerms
+	return origins
+}
 
-	return session
+func newPermissionOrigin(assigned *base.Role, source *base.Role, rtName string, op string, p *base.Permission) *base.PermissionOrigin {
+	po := &base.PermissionOrigin{ResType: rtName, Op: op, AssignedRoleId: assigned.Id, AssignedRoleName: assigned.Name}
+	po.RoleId = source.Id
+	po.RoleName = source.Name
+	po.Inherited = (assigned.Id != source.Id)
+	po.AllowAll = p.AllowAll
+	po.OnAnyResource = p.OnAnyResource
+	if p.Filter != nil {
+		po.Filter = p.Filter.String()
+	}
+
+	return po
 }
 
 func (engine *RbacEngine) DeleteRole(groupId string) {
@@ -88,10 +548,58 @@ func (engine *RbacEngine) UpsertRole(groupRes *base.Resource, resTypes map[strin
 	}
 
 	role.Perms = base.ParseResPerms(groupRes, resTypes)
+	role.Juniors = parseJuniors(groupRes)
+	role.Scope = parseAdminScope(groupRes)
 
 	engine.allRoles[role.Id] = role
 }
 
+// Returns the IDs of the groups inherited by the given group
+func parseJuniors(groupRes *base.Resource) []string {
+	juniors := make([]string, 0)
+	inherits := groupRes.GetAttr("inherits")
+	if inherits == nil {
+		return juniors
+	}
+
+	for _, subAtMap := range inherits.GetComplexAt().SubAts {
+		jAt := subAtMap["value"]
+		if jAt != nil {
+			juniors = append(juniors, jAt.Values[0].(string))
+		}
+	}
+
+	return juniors
+}
+
+// Returns the administrative scope of the given group, nil if the group has no
+// admin filter or if the filter is invalid
+func parseAdminScope(groupRes *base.Resource) *base.AdminScope {
+	filterAt := groupRes.GetAttr("adminfilter")
+	if filterAt == nil {
+		return nil
+	}
+
+	node, err := base.ParseFilter(filterAt.GetSimpleAt().GetStringVal())
+	if err != nil {
+		return nil
+	}
+
+	as := &base.AdminScope{RoleId: groupRes.GetId(), Filter: node}
+	as.AssignableGroups = make(map[string]bool)
+	assignable := groupRes.GetAttr("assignablegroups")
+	if assignable != nil {
+		for _, subAtMap := range assignable.GetComplexAt().SubAts {
+			gAt := subAtMap["value"]
+			if gAt != nil {
+				as.AssignableGroups[gAt.Values[0].(string)] = true
+			}
+		}
+	}
+
+	return as
+}
+
 // Merges the existing and nextPerm and returns a new ResourcePermission instance
 // the resulting instance contains a union of operation permissions
 func merge(existing *base.ResourcePermission, nextPerm *base.ResourcePermission) *base.ResourcePermission {
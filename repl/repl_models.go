@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"sparrow/base"
+	"sparrow/oauth"
 	"sparrow/utils"
 	"strings"
 	"sync"
@@ -35,6 +36,15 @@ const (
 	NEW_DOMAIN
 	DELETE_DOMAIN
 	REPLACE_AUTHDATA
+	DISABLE_DOMAIN
+	ENABLE_DOMAIN
+	RENAME_DOMAIN
+	STORE_REFRESH_TOKEN
+	REVOKE_REFRESH_TOKEN_FAMILY
+	STORE_SIGNING_KEYS
+	STORE_DEVICE_GRANT
+	DELETE_DEVICE_GRANT
+	USE_CLIENT_ASSERTION
 )
 
 type ReplicationEvent struct {
@@ -55,7 +65,16 @@ type ReplicationEvent struct {
 	NewPassword      string
 	HashAlgo         string
 	NewDomainName    string
-	Cloning          bool // flag to indicate that this was generated as part of clone operation
+	DomainName       string // name of the domain targeted by a domain lifecycle operation
+	TemplateDomain   string // name of the template domain used for creating a new domain
+	Cloning          bool   // flag to indicate that this was generated as part of clone operation
+	RefreshToken     *oauth.RefreshToken
+	RevokedFamilyId  string // ID of the revoked family of refresh tokens
+	DeviceGrant      *oauth.DeviceGrant
+	DeviceCode       string // the device code of the deleted device grant
+	ClientId         string // the ID of the client that used the assertion
+	AssertionId      string // the jti of the used client assertion
+	AssertionExp     int64  // the expiration time of the used client assertion
 }
 
 type JoinRequest struct {
@@ -4,6 +4,7 @@
 package silo
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -11,6 +12,7 @@ import (
 	"math/rand"
 	"os"
 	"sparrow/base"
+	"sparrow/conf"
 	"testing"
 	"time"
 )
@@ -38,7 +40,7 @@ func TestCreateJwt(t *testing.T) {
 		panic(err)
 	}
 
-	fmt.Println(session.ToJwt(priv))
+	fmt.Println(session.ToJwt("RS256", "", priv))
 	if false {
 		block := &pem.Block{}
 		block.Bytes, _ = x509.MarshalPKIXPublicKey(priv.Public())
@@ -48,3 +50,361 @@ func TestCreateJwt(t *testing.T) {
 		keyFile.Close()
 	}
 }
+
+func parseTestGroup(name string, userId string, juniorId string) *base.Resource {
+	tmpl := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+	          "displayName": "%s",
+	          "permissions": [{"value": "Device", "opsArr" : "[{\"op\":\"read\",\"allowAttrs\": \"*\",\"filter\":\"ANY\"}]"}]
+	         }`
+
+	group, err := base.ParseResource(restypes, schemas, bytes.NewReader([]byte(fmt.Sprintf(tmpl, name))))
+	if err != nil {
+		panic(err)
+	}
+
+	if len(userId) > 0 {
+		group.AddCA("members", map[string]interface{}{"value": userId})
+	}
+
+	if len(juniorId) > 0 {
+		group.AddCA("inherits", map[string]interface{}{"value": juniorId})
+	}
+
+	return group
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	initSilo()
+
+	user := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: user})
+
+	junior := parseTestGroup("Helpdesk", "", "")
+	err := sl.Insert(&base.CreateContext{InRes: junior})
+	if err != nil {
+		t.Errorf("failed to insert the junior group %s", err)
+		return
+	}
+
+	senior := parseTestGroup("HelpdeskLead", user.GetId(), junior.GetId())
+	err = sl.Insert(&base.CreateContext{InRes: senior})
+	if err != nil {
+		t.Errorf("failed to insert the senior group %s", err)
+		return
+	}
+
+	user, _ = sl.Get(user.GetId(), userType)
+	session := sl.Engine.NewRbacSession(user)
+	if _, ok := session.Roles[junior.GetId()]; !ok {
+		t.Errorf("session must contain the inherited role %s", junior.GetId())
+	}
+
+	if _, ok := session.EffPerms["Device"]; !ok {
+		t.Errorf("session must contain the permissions of the inherited role")
+	}
+
+	origins := sl.Engine.ExplainPermissions(user)
+	// read and write permissions from both the roles
+	if len(origins) != 4 {
+		t.Errorf("expected four permission origins but found %d", len(origins))
+	}
+
+	// a cycle must be rejected
+	junior, _ = sl.Get(junior.GetId(), groupType)
+	junior.AddCA("inherits", map[string]interface{}{"value": senior.GetId()})
+	replaceCtx := &base.ReplaceContext{InRes: junior, IfMatch: junior.GetVersion()}
+	err = sl.Replace(replaceCtx)
+	if err == nil {
+		t.Errorf("inheriting the senior group must fail due to a cycle")
+	}
+
+	// an inherited group cannot be deleted
+	err = sl.Delete(&base.DeleteContext{Rid: junior.GetId(), Rt: groupType})
+	if err == nil {
+		t.Errorf("deletion of an inherited group must fail")
+	}
+}
+
+func TestSeparationOfDuty(t *testing.T) {
+	initSilo()
+
+	user := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: user})
+
+	approver := parseTestGroup("PaymentsApprover", user.GetId(), "")
+	sl.Insert(&base.CreateContext{InRes: approver})
+	submitter := parseTestGroup("PaymentsSubmitter", "", "")
+	sl.Insert(&base.CreateContext{InRes: submitter})
+
+	rule := &conf.SodRule{Name: "payments", GroupIds: []string{approver.GetId(), submitter.GetId()}, Cardinality: 2}
+	sl.Engine.StaticSod = []*conf.SodRule{rule}
+	defer func() {
+		sl.Engine.StaticSod = nil
+		sl.Engine.DynamicSod = nil
+	}()
+
+	user, _ = sl.Get(user.GetId(), userType)
+	mgur := base.ModifyGroupsOfUserRequest{UserRid: user.GetId(), AddGids: []string{submitter.GetId()}, UserVersion: user.GetVersion()}
+	_, err := sl.ModifyGroupsOfUser(mgur)
+	se, ok := err.(*base.ScimError)
+	if !ok || se.Code() != 409 {
+		t.Errorf("adding user to conflicting groups must fail with a conflict error %#v", err)
+	}
+
+	// the same combination is allowed when only enforced at the time of activation
+	sl.Engine.StaticSod = nil
+	sl.Engine.DynamicSod = []*conf.SodRule{rule}
+	_, err = sl.ModifyGroupsOfUser(mgur)
+	if err != nil {
+		t.Errorf("failed to add user to the group %s", err)
+		return
+	}
+
+	user, _ = sl.Get(user.GetId(), userType)
+	session := sl.Engine.NewRbacSession(user)
+	_, hasApprover := session.Roles[approver.GetId()]
+	_, hasSubmitter := session.Roles[submitter.GetId()]
+	if hasApprover == hasSubmitter {
+		t.Errorf("exactly one of the conflicting roles must be activated")
+	}
+}
+
+func TestDelegatedAdmin(t *testing.T) {
+	initSilo()
+
+	admin := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: admin})
+	target := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: target})
+
+	helpdesk := parseTestGroup("Helpdesk", "", "")
+	sl.Insert(&base.CreateContext{InRes: helpdesk})
+
+	superAdmins := parseTestGroup("SuperAdmins", "", "")
+	superAdmins.AddSA("adminFilter", "username pr")
+	sl.Insert(&base.CreateContext{InRes: superAdmins})
+
+	// a group without an admin filter but with more permissions than the delegated administrator
+	admTmpl := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+	          "displayName": "Administrators",
+	          "permissions": [{"value": "User", "opsArr" : "[{\"op\":\"write\",\"allowAttrs\": \"*\",\"filter\":\"ANY\"}]"}]
+	         }`
+	administrators, err := base.ParseResource(restypes, schemas, bytes.NewReader([]byte(admTmpl)))
+	if err != nil {
+		t.Errorf("failed to parse the Administrators group %s", err)
+		return
+	}
+	sl.Insert(&base.CreateContext{InRes: administrators})
+
+	targetName := target.GetAttr("username").GetSimpleAt().GetStringVal()
+	euAdmins := parseTestGroup("EuAdmins", admin.GetId(), "")
+	euAdmins.AddSA("adminFilter", fmt.Sprintf("username eq \"%s\"", targetName))
+	euAdmins.AddCA("assignableGroups", map[string]interface{}{"value": helpdesk.GetId()},
+		map[string]interface{}{"value": superAdmins.GetId()},
+		map[string]interface{}{"value": administrators.GetId()})
+	err = sl.Insert(&base.CreateContext{InRes: euAdmins})
+	if err != nil {
+		t.Errorf("failed to insert the administrative group %s", err)
+		return
+	}
+
+	admin, _ = sl.Get(admin.GetId(), userType)
+	target, _ = sl.Get(target.GetId(), userType)
+	session := sl.Engine.NewRbacSession(admin)
+	opCtx := &base.OpContext{Session: session}
+
+	mgur := base.ModifyGroupsOfUserRequest{UserRid: target.GetId(), AddGids: []string{helpdesk.GetId()}, OpContext: opCtx}
+	if !mgur.AllowOp(target) {
+		t.Errorf("delegated administrator must be allowed to assign the group %s", helpdesk.GetId())
+	}
+
+	// cannot grant an administrative group that is not held
+	mgur.AddGids = []string{superAdmins.GetId()}
+	if mgur.AllowOp(target) {
+		t.Errorf("delegated administrator must not be allowed to assign a more powerful group")
+	}
+
+	// cannot grant a group whose permissions are not held
+	mgur.AddGids = []string{administrators.GetId()}
+	if mgur.AllowOp(target) {
+		t.Errorf("delegated administrator must not be allowed to assign the Administrators group")
+	}
+
+	// cannot manage users outside the scope, including self
+	mgur.AddGids = []string{helpdesk.GetId()}
+	if mgur.AllowOp(admin) {
+		t.Errorf("delegated administrator must not be allowed to manage users outside the scope")
+	}
+
+	// an invalid admin filter must be rejected
+	invalid := parseTestGroup("Invalid", "", "")
+	invalid.AddSA("adminFilter", "username eq")
+	err = sl.Insert(&base.CreateContext{InRes: invalid})
+	if err == nil {
+		t.Errorf("group with an invalid adminFilter must be rejected")
+	}
+}
+
+func TestTimeBoundMembership(t *testing.T) {
+	initSilo()
+
+	user := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: user})
+
+	expired := parseTestGroup("Contractors", "", "")
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	expired.AddCA("members", map[string]interface{}{"value": user.GetId(), "validUntil": past})
+	err := sl.Insert(&base.CreateContext{InRes: expired})
+	if err != nil {
+		t.Errorf("failed to insert the group %s", err)
+		return
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	pending := parseTestGroup("BreakGlass", "", "")
+	pending.AddCA("members", map[string]interface{}{"value": user.GetId(), "validFrom": future})
+	sl.Insert(&base.CreateContext{InRes: pending})
+
+	user, _ = sl.Get(user.GetId(), userType)
+	groups := user.GetAttr("groups").GetComplexAt()
+	if len(groups.SubAts) != 2 {
+		t.Errorf("expected the user to be a member of two groups but found %d", len(groups.SubAts))
+	}
+
+	for _, subAtMap := range groups.SubAts {
+		if subAtMap["validuntil"] == nil && subAtMap["validfrom"] == nil {
+			t.Errorf("the validity of the membership must be copied to the user's groups")
+		}
+	}
+
+	session := sl.Engine.NewRbacSession(user)
+	if len(session.Roles) != 0 {
+		t.Errorf("expired and not yet effective memberships must not be activated %v", session.Roles)
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	initSilo()
+
+	junior := parseTestGroup("DeviceReaders", "", "")
+	sl.Insert(&base.CreateContext{InRes: junior})
+	senior := parseTestGroup("Provisioners", "", junior.GetId())
+	sl.Insert(&base.CreateContext{InRes: senior})
+
+	session := sl.Engine.NewClientSession("client1", "Backend Job", []string{senior.GetId(), "unknown-group"})
+	if session.Sub != "client1" || session.Ito != "client1" || session.Username != "Backend Job" {
+		t.Errorf("invalid subject of the client session %#v", session)
+	}
+
+	if len(session.Roles) != 2 {
+		t.Errorf("expected the assigned and the inherited roles in the client session but found %v", session.Roles)
+	}
+
+	if _, ok := session.EffPerms["Device"]; !ok {
+		t.Errorf("client session must contain the permissions of the roles assigned to the client")
+	}
+}
+
+func TestAssignServiceGroup(t *testing.T) {
+	initSilo()
+
+	user := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: user})
+
+	readers := parseTestGroup("DeviceReaders", user.GetId(), "")
+	sl.Insert(&base.CreateContext{InRes: readers})
+	auditors := parseTestGroup("DeviceAuditors", "", "")
+	sl.Insert(&base.CreateContext{InRes: auditors})
+
+	admTmpl := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+	          "displayName": "Administrators",
+	          "permissions": [{"value": "User", "opsArr" : "[{\"op\":\"write\",\"allowAttrs\": \"*\",\"filter\":\"ANY\"}]"}]
+	         }`
+	administrators, err := base.ParseResource(restypes, schemas, bytes.NewReader([]byte(admTmpl)))
+	if err != nil {
+		t.Fatalf("failed to parse the Administrators group %s", err)
+	}
+	sl.Insert(&base.CreateContext{InRes: administrators})
+
+	user, _ = sl.Get(user.GetId(), userType)
+	session := sl.Engine.NewRbacSession(user)
+
+	if !sl.Engine.CanAssignServiceGroup(session, auditors.GetId()) {
+		t.Errorf("a group whose permissions are held by the user must be assignable to an application")
+	}
+
+	if sl.Engine.CanAssignServiceGroup(session, administrators.GetId()) {
+		t.Errorf("a group with more permissions than the user must not be assignable to an application")
+	}
+
+	if sl.Engine.CanAssignServiceGroup(session, "unknown-group") {
+		t.Errorf("an unknown group must not be assignable to an application")
+	}
+}
+
+func TestRestrictPerms(t *testing.T) {
+	initSilo()
+
+	readers := parseTestGroup("DeviceReaders", "", "")
+	sl.Insert(&base.CreateContext{InRes: readers})
+
+	session := sl.Engine.NewClientSession("client1", "Backend Job", []string{readers.GetId()})
+	if !session.EffPerms["Device"].ReadPerm.OnAnyResource {
+		t.Fatalf("client session must be allowed to read any Device")
+	}
+
+	session.RestrictPerms(map[string]map[string]bool{"device": {"write": true}})
+	if session.EffPerms["Device"].ReadPerm.OnAnyResource {
+		t.Errorf("read permission must be removed from the restricted session")
+	}
+
+	// the permissions of the role must not be modified
+	session = sl.Engine.NewClientSession("client1", "Backend Job", []string{readers.GetId()})
+	if !session.EffPerms["Device"].ReadPerm.OnAnyResource {
+		t.Errorf("restricting a session must not modify the permissions of the roles")
+	}
+
+	session.RestrictPerms(map[string]map[string]bool{})
+	if _, ok := session.EffPerms["Device"]; ok {
+		t.Errorf("permissions on the resourcetypes which are not allowed must be removed")
+	}
+}
+
+func TestSeparationOfDutyWithInheritedRoles(t *testing.T) {
+	initSilo()
+
+	user := createTestUser()
+	sl.Insert(&base.CreateContext{InRes: user})
+
+	approver := parseTestGroup("InvoiceApprover", user.GetId(), "")
+	sl.Insert(&base.CreateContext{InRes: approver})
+	submitter := parseTestGroup("InvoiceSubmitter", "", "")
+	sl.Insert(&base.CreateContext{InRes: submitter})
+	// a senior role inheriting the conflicting role
+	clerk := parseTestGroup("InvoiceClerk", "", submitter.GetId())
+	sl.Insert(&base.CreateContext{InRes: clerk})
+
+	rule := &conf.SodRule{Name: "invoices", GroupIds: []string{approver.GetId(), submitter.GetId()}, Cardinality: 2}
+	sl.Engine.StaticSod = []*conf.SodRule{rule}
+	defer func() {
+		sl.Engine.StaticSod = nil
+	}()
+
+	user, _ = sl.Get(user.GetId(), userType)
+	mgur := base.ModifyGroupsOfUserRequest{UserRid: user.GetId(), AddGids: []string{clerk.GetId()}, UserVersion: user.GetVersion()}
+	_, err := sl.ModifyGroupsOfUser(mgur)
+	se, ok := err.(*base.ScimError)
+	if !ok || se.Code() != 409 {
+		t.Errorf("adding user to a group inheriting a conflicting role must fail with a conflict error %#v", err)
+	}
+
+	// a replicated membership was validated on the originating server and must be applied as is
+	user, _ = sl.Get(user.GetId(), userType)
+	clerk, _ = sl.Get(clerk.GetId(), groupType)
+	clerk.AddCA("members", map[string]interface{}{"value": user.GetId()})
+	replaceCtx := &base.ReplaceContext{InRes: clerk, Repl: true, ReplVersion: clerk.GetVersion()}
+	err = sl.Replace(replaceCtx)
+	if err != nil {
+		t.Errorf("failed to apply the replicated membership %s", err)
+	}
+}
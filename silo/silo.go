@@ -73,6 +73,7 @@ type Index struct {
 
 type modifyHints struct {
 	modified bool
+	repl     bool // set while applying a replicated patch
 }
 
 func (mh *modifyHints) markDirty() {
@@ -511,6 +512,10 @@ func Open(path string, serverId uint16, config *conf.DomainConfig, rtypes map[st
 	})
 
 	sl.Engine = rbac.NewEngine()
+	if config.Rbac != nil {
+		sl.Engine.StaticSod = config.Rbac.StaticSod
+		sl.Engine.DynamicSod = config.Rbac.DynamicSod
+	}
 
 	sl.cg = base.NewCsnGenerator(serverId)
 	// load the roles
@@ -524,6 +529,20 @@ func (sl *Silo) Close() {
 	sl.db.Close()
 }
 
+// Returns the number of resources of the given resourcetype
+func (sl *Silo) Count(rt *schema.ResourceType) int64 {
+	var count int64
+	sl.db.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(sl.resources[rt.Name])
+		if buck != nil {
+			count = int64(buck.Stats().KeyN)
+		}
+		return nil
+	})
+
+	return count
+}
+
 func (sl *Silo) createResourceBucket(rc *schema.ResourceType) error {
 	data := []byte(rc.Name)
 
@@ -772,11 +791,18 @@ func (sl *Silo) InsertInternal(crCtx *base.CreateContext) (err error) {
 
 	if rt.Name == "Group" {
 		isGroup = true
+		if !crCtx.Repl {
+			err := sl.Engine.ValidateRole(inRes)
+			if err != nil {
+				panic(err)
+			}
+		}
+
 		members := inRes.GetAttr("members")
 		if members != nil {
 			displayName := inRes.GetAttr("displayname").GetSimpleAt().GetStringVal()
 			ca := members.GetComplexAt()
-			sl.addGroupMembers(ca, rid, displayName, tx)
+			sl.addGroupMembers(ca, rid, displayName, crCtx.Repl, tx)
 		}
 	}
 
@@ -797,7 +823,9 @@ func (sl *Silo) InsertInternal(crCtx *base.CreateContext) (err error) {
 	return nil
 }
 
-func (sl *Silo) addGroupMembers(members *base.ComplexAttribute, groupRid string, displayName string, tx *bolt.Tx) {
+// adds the given members to the group, the separation of duty rules are not enforced on the
+// memberships received through replication, they were already validated on the originating server
+func (sl *Silo) addGroupMembers(members *base.ComplexAttribute, groupRid string, displayName string, repl bool, tx *bolt.Tx) {
 	groupType := sl.resTypes["Group"]
 	gRefAtType := groupType.GetAtType("members.$ref")
 	gTypeAtType := groupType.GetAtType("members.type")
@@ -835,7 +863,7 @@ func (sl *Silo) addGroupMembers(members *base.ComplexAttribute, groupRid string,
 			subAtMap["type"] = base.NewSimpleAt(gTypeAtType, refRType.Name)
 
 			if refRType.Name == "User" {
-				updated := sl.addGroupToUser(refRes, groupRid, displayName)
+				updated := sl.addGroupToUser(refRes, groupRid, displayName, subAtMap, !repl)
 				if updated {
 					ugroupIdx.add(groupRid, refId, tx)
 					//refRes.UpdateLastModTime(sl.cg.NewCsn())
@@ -846,16 +874,31 @@ func (sl *Silo) addGroupMembers(members *base.ComplexAttribute, groupRid string,
 	}
 }
 
-func (sl *Silo) addGroupToUser(refRes *base.Resource, groupRid string, groupDisplayName string) bool {
+// adds the group to the user's groups attribute, the validity period of the membership, if any,
+// is copied from the given sub-attributes of the Group's members attribute
+func (sl *Silo) addGroupToUser(refRes *base.Resource, groupRid string, groupDisplayName string, memberSubAtMap map[string]*base.SimpleAttribute, checkSod bool) bool {
 	groups := refRes.GetAttr("groups")
 	subAt := make(map[string]interface{})
 	subAt["value"] = groupRid
 	subAt["$ref"] = "/Groups/" + groupRid
 	subAt["type"] = "Group"
 	subAt["display"] = groupDisplayName
+	for _, name := range []string{"validfrom", "validuntil"} {
+		if sa := memberSubAtMap[name]; sa != nil {
+			subAt[name] = utils.FormatMillis(sa.Values[0].(int64))
+		}
+	}
 
 	updated := false
 	if groups == nil {
+		if checkSod {
+			// the juniors of the group alone can conflict
+			err := sl.Engine.CheckStaticSod([]string{groupRid})
+			if err != nil {
+				panic(err)
+			}
+		}
+
 		err := refRes.AddCA("groups", subAt)
 		if err != nil {
 			panic(err)
@@ -864,16 +907,30 @@ func (sl *Silo) addGroupToUser(refRes *base.Resource, groupRid string, groupDisp
 	} else {
 		ca := groups.GetComplexAt()
 		present := false
+		gids := make([]string, 0, len(ca.SubAts)+1)
 		// add only if the group is not already present in this user
-		for _, groupAtMap := range ca.SubAts {
+		for key, groupAtMap := range ca.SubAts {
 			existingGid := groupAtMap["value"].Values[0].(string)
 			if existingGid == groupRid {
 				present = true
+				// refresh the entry if the validity of the membership was changed
+				if !sameValidity(groupAtMap, memberSubAtMap) {
+					delete(ca.SubAts, key)
+					ca.AddSubAts(subAt)
+					updated = true
+				}
 				break
 			}
+			gids = append(gids, existingGid)
 		}
 
 		if !present {
+			if checkSod {
+				err := sl.Engine.CheckStaticSod(append(gids, groupRid))
+				if err != nil {
+					panic(err)
+				}
+			}
 			ca.AddSubAts(subAt)
 			updated = true
 		}
@@ -882,6 +939,22 @@ func (sl *Silo) addGroupToUser(refRes *base.Resource, groupRid string, groupDisp
 	return updated
 }
 
+func sameValidity(groupAtMap map[string]*base.SimpleAttribute, memberSubAtMap map[string]*base.SimpleAttribute) bool {
+	for _, name := range []string{"validfrom", "validuntil"} {
+		existing := groupAtMap[name]
+		given := memberSubAtMap[name]
+		if existing == nil && given == nil {
+			continue
+		}
+
+		if existing == nil || given == nil || existing.Values[0].(int64) != given.Values[0].(int64) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // FIXME there is a method duplicating this functionality in addSAtoIndex() in silo_patch.go
 func addToIndex(atPath string, sa *base.SimpleAttribute, rid string, idx *Index, prIdx *Index, tx *bolt.Tx) {
 	for _, val := range sa.Values {
@@ -976,6 +1049,13 @@ func (sl *Silo) Delete(delCtx *base.DeleteContext) (err error) {
 		sl.mutex.Unlock()
 	}()
 
+	if rt.Name == "Group" && !delCtx.Repl {
+		seniors := sl.Engine.SeniorsOf(rid)
+		if len(seniors) > 0 {
+			return base.NewConflictError(fmt.Sprintf("group %s is inherited by the groups %s", rid, strings.Join(seniors, ", ")))
+		}
+	}
+
 	err = sl._removeResource(rid, rt, tx)
 
 	if err == nil {
@@ -1204,6 +1284,13 @@ func (sl *Silo) Replace(replaceCtx *base.ReplaceContext) (err error) {
 
 	if rt.Name == "Group" {
 		isGroup = true
+		if !replaceCtx.Repl {
+			err := sl.Engine.ValidateRole(inRes)
+			if err != nil {
+				return err
+			}
+		}
+
 		var inMembers, existingMembers *base.ComplexAttribute
 		inMemAt := inRes.GetAttr("members")
 		if inMemAt != nil {
@@ -1223,7 +1310,7 @@ func (sl *Silo) Replace(replaceCtx *base.ReplaceContext) (err error) {
 		} else {
 			sl.deleteGroupMembers(existingMembers, rid, tx)
 			displayName := inRes.GetAttr("displayname").GetSimpleAt().GetStringVal()
-			sl.addGroupMembers(inMembers, rid, displayName, tx)
+			sl.addGroupMembers(inMembers, rid, displayName, replaceCtx.Repl, tx)
 		}
 	}
 
@@ -1469,10 +1556,10 @@ func (sl *Silo) replaceAtGroup(resName string, rid string, tx *bolt.Tx, prIdx *I
 			continue
 		}
 
-		exAt := exAtg.ComplexAts[name]
-
 		// there is no way to identify the equality when it is multivalued, just overwrite it
-		sl.dropCAtFromIndex(exAt, prIdx, resName, rid, tx)
+		if exAt := exAtg.ComplexAts[name]; exAt != nil {
+			sl.dropCAtFromIndex(exAt, prIdx, resName, rid, tx)
+		}
 
 		exAtg.ComplexAts[name] = ca
 		// index them now
@@ -2072,7 +2159,7 @@ func (sl *Silo) addUserToGroups(user *base.Resource, gids []string, fetchedGroup
 		subAt["type"] = "User"
 		ca.AddSubAts(subAt)
 		displayName := group.GetAttr("displayname").GetSimpleAt().GetStringVal()
-		sl.addGroupToUser(user, id, displayName)
+		sl.addGroupToUser(user, id, displayName, nil, true)
 		updated = true
 
 		ugroupIdx.add(id, userId, tx)
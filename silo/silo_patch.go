@@ -76,7 +76,7 @@ func (sl *Silo) Patch(patchCtx *base.PatchContext) (err error) {
 		return base.NewPreCondError(msg)
 	}
 
-	mh := &modifyHints{}
+	mh := &modifyHints{repl: patchCtx.Repl}
 
 	for _, po := range pr.Operations {
 		log.Debugf("Patch %s operation on resource %s", po.Op, rid)
@@ -106,6 +106,13 @@ func (sl *Silo) Patch(patchCtx *base.PatchContext) (err error) {
 			res.UpdateSchemas()
 		}
 
+		if rt.Name == "Group" && !patchCtx.Repl {
+			err = sl.Engine.ValidateRole(res)
+			if err != nil {
+				return err
+			}
+		}
+
 		if patchCtx.Repl {
 			// update the version with the given value
 			meta := res.GetMeta().GetFirstSubAt()
@@ -180,7 +187,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 
 			if isGroup {
 				if ca.Name == "members" {
-					sl.addGroupMembers(ca, rid, displayName, tx)
+					sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 				}
 			}
 		}
@@ -207,7 +214,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 			ca := base.ParseComplexAttr(pp.AtType, po.Value)
 			sl.addAttrTo(res, ca, tx, prIdx, mh)
 			if isMembers {
-				sl.addGroupMembers(ca, rid, displayName, tx)
+				sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 			}
 		} else {
 			tCa := tAt.GetComplexAt()
@@ -247,7 +254,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 
 					if isMembers {
 						sl.deleteGroupMembers(tCa, rid, tx)
-						sl.addGroupMembers(ca, rid, displayName, tx)
+						sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 					}
 
 					tCa.SubAts = ca.SubAts
@@ -280,7 +287,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 					}
 					sl.addCAtoIndex(tCa, prIdx, rt.Name, rid, tx)
 					if isMembers {
-						sl.addGroupMembers(tCa, rid, displayName, tx)
+						sl.addGroupMembers(tCa, rid, displayName, mh.repl, tx)
 					}
 					mh.markDirty()
 				}
@@ -333,7 +340,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 					if isMemberVal {
 						membersCa := base.NewComplexAt(tCa.GetType())
 						membersCa.SubAts["1"] = tSaMap
-						sl.addGroupMembers(membersCa, rid, displayName, tx)
+						sl.addGroupMembers(membersCa, rid, displayName, mh.repl, tx)
 					}
 					sl.addSAtoIndex(sa, atPath, prIdx, rt.Name, rid, tx)
 					mh.markDirty()
@@ -350,7 +357,7 @@ func (sl *Silo) handleReplace(po *base.PatchOp, res *base.Resource, rid string,
 					if isMemberVal {
 						membersCa := base.NewComplexAt(tCa.GetType())
 						membersCa.SubAts["1"] = tSaMap
-						sl.addGroupMembers(membersCa, rid, displayName, tx)
+						sl.addGroupMembers(membersCa, rid, displayName, mh.repl, tx)
 					}
 
 					sl.addSAtoIndex(sa, atPath, prIdx, rt.Name, rid, tx)
@@ -526,7 +533,7 @@ func (sl *Silo) handleAdd(po *base.PatchOp, res *base.Resource, rid string, mh *
 			sl.addAttrTo(res, ca, tx, prIdx, mh)
 			if isGroup {
 				if ca.Name == "members" {
-					sl.addGroupMembers(ca, rid, displayName, tx)
+					sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 				}
 			}
 		}
@@ -554,7 +561,7 @@ func (sl *Silo) handleAdd(po *base.PatchOp, res *base.Resource, rid string, mh *
 			if ca != nil {
 				sl.addAttrTo(res, ca, tx, prIdx, mh)
 				if isMembers {
-					sl.addGroupMembers(ca, rid, displayName, tx)
+					sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 				}
 			}
 		} else {
@@ -602,7 +609,7 @@ func (sl *Silo) handleAdd(po *base.PatchOp, res *base.Resource, rid string, mh *
 							// check if the attribute already exists
 							// only values of 'value'attribute are considered for equality
 
-							sl.addGroupMembers(ca, rid, displayName, tx)
+							sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 							// the $ref and type values will be updated in the subAtMap when addGroupMembers is called
 							// so use this updated subAtMap
 							tCa.SubAts[key] = subAtMap
@@ -624,7 +631,7 @@ func (sl *Silo) handleAdd(po *base.PatchOp, res *base.Resource, rid string, mh *
 					if isMembers {
 						// the ca should hold only one subAtMap so keeping the key as a constant
 						ca.SubAts[key] = subAtMap
-						sl.addGroupMembers(ca, rid, displayName, tx)
+						sl.addGroupMembers(ca, rid, displayName, mh.repl, tx)
 						// the $ref and type values will be updated in the subAtMap when addGroupMembers is called
 						// so use this updated subAtMap
 						tCa.SubAts[key] = subAtMap
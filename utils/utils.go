@@ -135,6 +135,11 @@ func DateTimeMillis() int64 {
 	return t
 }
 
+// formats the given time in RFC3339 format retaining the milliseconds
+func FormatMillis(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
 func GetTimeMillis(rfc3339Date string) int64 {
 	t, err := time.Parse(time.RFC3339, rfc3339Date)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"math"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestSerializeInt(t *testing.T) {
@@ -33,6 +34,19 @@ func TestDateTime(t *testing.T) {
 	}
 }
 
+func TestFormatMillis(t *testing.T) {
+	millis := int64(1546300800123)
+	formatted := FormatMillis(millis)
+	if formatted != "2019-01-01T00:00:00.123Z" {
+		t.Errorf("the milliseconds must be retained in %s", formatted)
+	}
+
+	parsed, err := time.Parse(time.RFC3339, formatted)
+	if err != nil || parsed.UnixNano()/int64(time.Millisecond) != millis {
+		t.Errorf("failed to parse the formatted time %s", formatted)
+	}
+}
+
 func encodeDecodeInt(in int64, t *testing.T) {
 	data := Itob(in)
 	out := Btoi(data)
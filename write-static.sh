@@ -13,10 +13,12 @@ writeHtml() {
   writeConst "login_html" "templates/login.html" $targetFile
   writeConst "consent_html" "templates/consent.html" $targetFile
   writeConst "saml_response_html" "templates/saml_response.html" $targetFile
+  writeConst "form_post_html" "templates/form_post.html" $targetFile
   writeConst "totp_register_html" "templates/totp-register.html" $targetFile
   writeConst "totp_send_html" "templates/totp-send.html" $targetFile
   writeConst "changepassword_html" "templates/changepassword.html" $targetFile
   writeConst "webauthn_html" "templates/webauthn.html" $targetFile
+  writeConst "device_verification_html" "templates/device-verification.html" $targetFile
 
   # default CSS
   writeConst "login_style" "templates/login-style.css" $targetFile